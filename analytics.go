@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Card events
+const (
+	EventView    = "view"
+	EventScan    = "scan"
+	EventVCard   = "vcard"
+	EventInstall = "install"
+)
+
+const (
+	qrSource      = "qr" // Value of src param in URL encoded in QR code
+	cardStatsDays = 30   // Days in card chart
+	maxStatsDays  = 366  // Days owners can request from JSON endpoint
+)
+
+type cardStatKey struct {
+	cid uint
+	day time.Time
+}
+
+// Counts card events in memory until they are flushed to DB
+type analytics struct {
+	mu      sync.Mutex
+	day     time.Time
+	salt    []byte            // Random, changes with day and never stored
+	seen    map[[32]byte]bool // Hashes of today's visitors of cards
+	pending map[cardStatKey]CardStat
+}
+
+func newAnalytics() *analytics {
+	return &analytics{pending: map[cardStatKey]CardStat{}}
+}
+
+func statDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// Counts event of card. Visitor identifies browser (e.g. IP and user
+// agent); only its hash salted with today's salt is kept until day ends.
+func (a *analytics) track(cid uint, event, visitor string, now time.Time) {
+	day := statDay(now)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !day.Equal(a.day) {
+		a.day = day
+		a.salt = make([]byte, 32)
+		if _, err := rand.Read(a.salt); err != nil {
+			panic(err)
+		}
+		a.seen = map[[32]byte]bool{}
+	}
+
+	key := cardStatKey{cid, day}
+	stat := a.pending[key]
+	stat.CardID, stat.Day = cid, day
+	switch event {
+	case EventView:
+		stat.Views++
+		mac := hmac.New(sha256.New, a.salt)
+		fmt.Fprintf(mac, "%d|%s", cid, visitor)
+		var hash [32]byte
+		copy(hash[:], mac.Sum(nil))
+		if !a.seen[hash] {
+			a.seen[hash] = true
+			stat.Visitors++
+		}
+	case EventScan:
+		stat.Scans++
+	case EventVCard:
+		stat.VCards++
+	case EventInstall:
+		stat.Installs++
+	}
+	a.pending[key] = stat
+}
+
+// Returns and forgets counters not flushed yet
+func (a *analytics) take() []CardStat {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := make([]CardStat, 0, len(a.pending))
+	for _, stat := range a.pending {
+		stats = append(stats, stat)
+	}
+	a.pending = map[cardStatKey]CardStat{}
+	return stats
+}
+
+// Puts back counters that failed to flush
+func (a *analytics) restore(stats []CardStat) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, stat := range stats {
+		key := cardStatKey{stat.CardID, stat.Day}
+		a.pending[key] = stat.Add(a.pending[key])
+	}
+}
+
+// Visitors asking not to be tracked
+func doNotTrack(c *gin.Context) bool {
+	return c.GetHeader("DNT") == "1" || c.GetHeader("Sec-GPC") == "1"
+}
+
+func (h *Handler) trackCard(c *gin.Context, cid uint, events ...string) {
+	if !h.cfg.Analytics.Enabled || doNotTrack(c) {
+		return
+	}
+	visitor := h.clientIP(c) + "|" + c.Request.UserAgent()
+	for _, event := range events {
+		h.analytics.track(cid, event, visitor, time.Now())
+	}
+}
+
+func (h *Handler) flushAnalytics() {
+	stats := h.analytics.take()
+	if len(stats) == 0 {
+		return
+	}
+	if err := h.db.AddCardStats(stats); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to save card stats")
+		h.analytics.restore(stats)
+	}
+}
+
+// Periodically writes counters to DB, and once more on shutdown
+func (h *Handler) runAnalytics() {
+	go func() {
+		ticker := time.NewTicker(h.cfg.Analytics.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.ctx.Done():
+				h.flushAnalytics()
+				return
+			case <-ticker.C:
+				h.flushAnalytics()
+			}
+		}
+	}()
+}
+
+// Events reported by card page: vCard downloads and app installs. Sent
+// with navigator.sendBeacon, so no CSRF token.
+func (h *Handler) cardEventRoute(c *gin.Context) {
+	cid, err := getUintParam(c, "id")
+	event := c.Param("event")
+	if err != nil || (event != EventVCard && event != EventInstall) {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	card, err := h.db.GetCard(cid)
+	if err != nil || !h.cardVisible(getUser(c), card) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if !h.canManageCard(getUser(c), card, PermCardsEditAny) {
+		h.trackCard(c, cid, event)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Returns card which stats user can see, or error status and message
+func (h *Handler) statsCard(c *gin.Context) (Card, int, string) {
+	cid, err := getUintParam(c, "id")
+	if err != nil {
+		return Card{}, http.StatusBadRequest, h.localize(c, "ErrMsgInvalidCardID")
+	}
+	card, err := h.db.GetCard(cid)
+	if err != nil || !h.canManageCard(getUser(c), card, PermCardsEditAny) {
+		return Card{}, http.StatusNotFound, h.localize(c, "ErrCode404")
+	}
+	return card, 0, ""
+}
+
+// Stats of last days with missing days filled with zeros
+func (h *Handler) cardStats(cid uint, days int) ([]CardStat, error) {
+	from := statDay(time.Now()).AddDate(0, 0, 1-days)
+	stored, err := h.db.ListCardStats(cid, from)
+	if err != nil {
+		return nil, err
+	}
+	byDay := map[string]CardStat{}
+	for _, stat := range stored {
+		byDay[stat.Day.Format(time.DateOnly)] = stat
+	}
+	stats := make([]CardStat, days)
+	for i := range stats {
+		day := from.AddDate(0, 0, i)
+		stats[i] = CardStat{CardID: cid, Day: day}.Add(byDay[day.Format(time.DateOnly)])
+	}
+	return stats, nil
+}
+
+// Daily counters of card as JSON for owner; days param sets period
+func (h *Handler) cardStatsRoute(c *gin.Context) {
+	card, status, msg := h.statsCard(c)
+	if status != 0 {
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+	days := cardStatsDays
+	if str := c.Query("days"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 1 || n > maxStatsDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": h.localize(c, "ErrMsgInvalidStatsDays")})
+			return
+		}
+		days = n
+	}
+
+	stats, err := h.cardStats(card.ID, days)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"cid": card.ID,
+		}).Error("Failed to list card stats")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": h.localize(c, "ErrMsgFailedToListCardStats")})
+		return
+	}
+
+	list := []gin.H{}
+	total := CardStat{}
+	for _, stat := range stats {
+		total = total.Add(stat)
+		list = append(list, gin.H{
+			"day":      stat.Day.Format(time.DateOnly),
+			"views":    stat.Views,
+			"visitors": stat.Visitors,
+			"scans":    stat.Scans,
+			"vcards":   stat.VCards,
+			"installs": stat.Installs,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"card": card.ID,
+		"days": list,
+		"total": gin.H{
+			"views":    total.Views,
+			"visitors": total.Visitors,
+			"scans":    total.Scans,
+			"vcards":   total.VCards,
+			"installs": total.Installs,
+		},
+	})
+}
+
+// Small bar chart of views for card list
+func (h *Handler) cardStatsChartRoute(c *gin.Context) {
+	card, status, msg := h.statsCard(c)
+	if status != 0 {
+		h.errorBlock(c, status, msg)
+		return
+	}
+	stats, err := h.cardStats(card.ID, cardStatsDays)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"cid": card.ID,
+		}).Error("Failed to list card stats")
+		h.errorBlock(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToListCardStats"),
+		)
+		return
+	}
+
+	const height = 40
+	total := CardStat{}
+	var most int64
+	for _, stat := range stats {
+		total = total.Add(stat)
+		most = max(most, stat.Views)
+	}
+	bars := []gin.H{}
+	for i, stat := range stats {
+		size := int64(0)
+		if most > 0 {
+			size = stat.Views * height / most
+		}
+		bars = append(bars, gin.H{
+			"X":     i * 4,
+			"Y":     height - size,
+			"H":     size,
+			"Day":   stat.Day.Format(time.DateOnly),
+			"Views": stat.Views,
+		})
+	}
+
+	h.execHTML(c, http.StatusOK, "comp_cardStats.html", gin.H{
+		"Card":   card,
+		"Bars":   bars,
+		"Width":  len(stats) * 4,
+		"Height": height,
+		"Total":  total,
+		"Days":   cardStatsDays,
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Audit actions
+const (
+	AuditLogin             = "user.login"
+	AuditRoleChanged       = "user.role-changed"
+	AuditPlanChanged       = "user.plan-changed"
+	AuditSessionsRevoked   = "user.sessions-revoked"
+	AuditUsersMerged       = "user.merged"
+	AuditPasskeyAdded      = "user.passkey-added"
+	AuditPasskeyDeleted    = "user.passkey-deleted"
+	AuditDeletionScheduled = "user.deletion-scheduled"
+	AuditDeletionCancelled = "user.deletion-cancelled"
+	AuditUserErased        = "user.erased"
+	AuditCardUpdated       = "card.updated"
+	AuditCardVisibility    = "card.visibility-changed"
+	AuditCardDeleted       = "card.deleted"
+	AuditOrgRoleChanged    = "org.role-changed"
+	AuditOrgMemberRemoved  = "org.member-removed"
+	AuditOrgDeleted        = "org.deleted"
+)
+
+// Actions in order shown in audit log filter
+var AuditActions = []string{
+	AuditLogin,
+	AuditRoleChanged,
+	AuditPlanChanged,
+	AuditSessionsRevoked,
+	AuditUsersMerged,
+	AuditPasskeyAdded,
+	AuditPasskeyDeleted,
+	AuditDeletionScheduled,
+	AuditDeletionCancelled,
+	AuditUserErased,
+	AuditCardUpdated,
+	AuditCardVisibility,
+	AuditCardDeleted,
+	AuditOrgRoleChanged,
+	AuditOrgMemberRemoved,
+	AuditOrgDeleted,
+}
+
+// Changed values as field -> [before, after]
+type AuditDiff map[string][2]any
+
+// Adds field if its value changed
+func (d AuditDiff) Add(field string, before, after any) AuditDiff {
+	if !reflect.DeepEqual(before, after) && !(isEmptyValue(before) && isEmptyValue(after)) {
+		d[field] = [2]any{before, after}
+	}
+	return d
+}
+
+// Names of changed fields, for diffs of personal data whose values must
+// not be kept in audit log
+func (d AuditDiff) Fields() []string {
+	return slices.Sorted(maps.Keys(d))
+}
+
+// Nil and empty maps and slices are the same for diff
+func isEmptyValue(value any) bool {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice:
+		return v.Len() == 0
+	}
+	return !v.IsValid() || v.IsZero()
+}
+
+// Diff of exported fields of two values of the same struct type
+func structDiff(before, after any) AuditDiff {
+	d := AuditDiff{}
+	b, a := reflect.ValueOf(before), reflect.ValueOf(after)
+	for i := 0; i < b.NumField(); i++ {
+		if f := b.Type().Field(i); f.IsExported() {
+			d.Add(f.Name, b.Field(i).Interface(), a.Field(i).Interface())
+		}
+	}
+	return d
+}
+
+func auditTarget(kind string, id uint) string {
+	return fmt.Sprintf("%s:%d", kind, id)
+}
+
+// Appends entry with diff marshaled to JSON
+func (h *Handler) appendAudit(entry AuditEntry, diff any) error {
+	if diff != nil {
+		data, err := json.Marshal(diff)
+		if err != nil {
+			return err
+		}
+		entry.Diff = string(data)
+	}
+	entry.CreatedAt = time.Now()
+	return h.db.AppendAudit(entry)
+}
+
+// Records action done by actor in request. Failures are logged only, so
+// audit never breaks the action itself.
+func (h *Handler) audit(c *gin.Context, actor uint, action, target string, diff any) {
+	err := h.appendAudit(AuditEntry{
+		ActorID: actor,
+		Action:  action,
+		Target:  target,
+		IP:      h.clientIP(c),
+	}, diff)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err":    err,
+			"action": action,
+			"target": target,
+		}).Error("Failed to write audit entry")
+	}
+}
+
+const auditPageSize = 50
+
+// Builds filter from query params: actor, action, target, from and to
+// dates (inclusive) and before cursor
+func parseAuditFilter(c *gin.Context) (AuditFilter, error) {
+	f := AuditFilter{
+		Action: c.Query("action"),
+		Target: strings.TrimSpace(c.Query("target")),
+	}
+	var err error
+	parseUint := func(name string) uint {
+		str := c.Query(name)
+		if str == "" || err != nil {
+			return 0
+		}
+		var v uint64
+		v, err = strconv.ParseUint(str, 10, 64)
+		return uint(v)
+	}
+	parseDate := func(name string) time.Time {
+		str := c.Query(name)
+		if str == "" || err != nil {
+			return time.Time{}
+		}
+		var t time.Time
+		t, err = time.ParseInLocation(time.DateOnly, str, time.Local)
+		return t
+	}
+	f.ActorID = parseUint("actor")
+	f.BeforeID = parseUint("before")
+	f.From = parseDate("from")
+	if f.To = parseDate("to"); !f.To.IsZero() {
+		f.To = f.To.AddDate(0, 0, 1)
+	}
+	return f, err
+}
+
+func (h *Handler) auditRoute(c *gin.Context) {
+	if !getUser(c).Can(PermAuditView, 0) {
+		h.errorPage(c, http.StatusNotFound, "")
+		return
+	}
+
+	f, err := parseAuditFilter(c)
+	if err != nil {
+		h.errorPage(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgInvalidAuditFilter"),
+		)
+		return
+	}
+	f.Limit = auditPageSize + 1 // One more to know if there is next page
+
+	entries, err := h.db.ListAudit(f)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to list audit log")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToListAudit"),
+		)
+		return
+	}
+
+	// Keeps filter in pagination and export links
+	q := c.Request.URL.Query()
+	q.Del("before")
+	next := ""
+	if len(entries) > auditPageSize {
+		entries = entries[:auditPageSize]
+		nq := maps.Clone(q)
+		nq.Set("before", fmt.Sprint(entries[len(entries)-1].ID))
+		next = "/admin/audit?" + nq.Encode()
+	}
+
+	h.execHTML(c, http.StatusOK, "page_audit.html", gin.H{
+		"Title":     h.localize(c, "TitleAudit"),
+		"Entries":   entries,
+		"Actions":   AuditActions,
+		"Query":     c.Request.URL.Query(),
+		"Next":      next,
+		"Export":    "/admin/audit.csv?" + q.Encode(),
+		"Retention": int(h.cfg.Audit.Retention.Hours() / 24),
+	})
+}
+
+// Exports all entries matching filter
+func (h *Handler) auditCSVRoute(c *gin.Context) {
+	if !getUser(c).Can(PermAuditView, 0) {
+		h.errorPage(c, http.StatusNotFound, "")
+		return
+	}
+
+	f, err := parseAuditFilter(c)
+	if err != nil {
+		h.errorPage(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgInvalidAuditFilter"),
+		)
+		return
+	}
+
+	entries, err := h.db.ListAudit(f)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to list audit log")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToListAudit"),
+		)
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="audit.csv"`)
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "time", "actor", "action", "target", "diff", "ip"})
+	for _, e := range entries {
+		w.Write([]string{
+			fmt.Sprint(e.ID),
+			e.CreatedAt.UTC().Format(time.RFC3339),
+			fmt.Sprint(e.ActorID),
+			e.Action,
+			e.Target,
+			e.Diff,
+			e.IP,
+		})
+	}
+	w.Flush()
+}
+
+// Periodically deletes entries older than retention period
+func (h *Handler) runAuditRetention() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.ctx.Done():
+				return
+			case now := <-ticker.C:
+				n, err := h.db.DeleteAuditBefore(now.Add(-h.cfg.Audit.Retention))
+				if err != nil {
+					h.log.WithFields(logrus.Fields{
+						"err": err,
+					}).Error("Failed to delete old audit entries")
+				} else if n > 0 {
+					h.log.WithFields(logrus.Fields{
+						"count": n,
+					}).Info("Old audit entries deleted")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+	"github.com/sirupsen/logrus"
+)
+
+// Subscription events reported by payment providers
+const (
+	EventSubscriptionCreated   = "subscription.created"
+	EventSubscriptionRenewed   = "subscription.renewed"
+	EventSubscriptionCancelled = "subscription.cancelled"
+	EventSubscriptionFailed    = "subscription.failed" // Renewal payment failed
+)
+
+const (
+	SubscriptionActive    = "active"
+	SubscriptionCancelled = "cancelled" // Won't be renewed
+	SubscriptionPastDue   = "past-due"  // Last payment failed
+)
+
+// Paid plan subscription; managed by billing webhooks only.
+// Plan is available until the end of paid period whatever the status is.
+type Subscription struct {
+	ID        string // Provider subscription ID
+	Plan      string
+	Status    string
+	PeriodEnd time.Time
+}
+
+func (s Subscription) Active(now time.Time) bool {
+	return s.Plan != "" && now.Before(s.PeriodEnd)
+}
+
+// Provider event normalized by BillingProvider
+type BillingEvent struct {
+	ID             string    `json:"id"` // Unique for provider; events are applied once
+	Type           string    `json:"type"`
+	UserID         uint      `json:"user"`
+	Plan           string    `json:"plan"`
+	SubscriptionID string    `json:"subscription"`
+	PeriodEnd      time.Time `json:"period_end"`
+}
+
+func (e BillingEvent) validate() error {
+	switch e.Type {
+	case EventSubscriptionCreated, EventSubscriptionRenewed:
+		if _, ok := FindPlan(e.Plan); !ok {
+			return fmt.Errorf("unknown plan %q", e.Plan)
+		}
+	case EventSubscriptionCancelled, EventSubscriptionFailed:
+	default:
+		return fmt.Errorf("unknown event type %q", e.Type)
+	}
+	if e.ID == "" || e.UserID == 0 || e.SubscriptionID == "" {
+		return errors.New("event id, user and subscription are required")
+	}
+	return nil
+}
+
+// Updates subscription with event. Cancellations and failures of other
+// subscriptions than the current one are stale and ignored; paid period
+// never shrinks, so events delivered out of order don't revoke the plan.
+func (s *Subscription) Apply(event BillingEvent) {
+	switch event.Type {
+	case EventSubscriptionCreated, EventSubscriptionRenewed:
+		if event.SubscriptionID != s.ID {
+			*s = Subscription{ID: event.SubscriptionID}
+		}
+		s.Plan = event.Plan
+		s.Status = SubscriptionActive
+		if event.PeriodEnd.After(s.PeriodEnd) {
+			s.PeriodEnd = event.PeriodEnd
+		}
+	case EventSubscriptionCancelled:
+		if event.SubscriptionID == s.ID {
+			s.Status = SubscriptionCancelled
+		}
+	case EventSubscriptionFailed:
+		if event.SubscriptionID == s.ID && s.Status == SubscriptionActive {
+			s.Status = SubscriptionPastDue
+		}
+	}
+}
+
+// Payment provider. Subscription state is changed only by webhook events,
+// so Checkout and Cancel just ask provider to do the job.
+type BillingProvider interface {
+	// Returns URL of provider payment page for user subscribing to plan
+	Checkout(user User, plan Plan) (string, error)
+	Cancel(user User) error
+	// Verifies webhook request signature and parses its event
+	ParseWebhook(r *http.Request) (BillingEvent, error)
+}
+
+// Signs webhook payloads. Header is "t=<unix time>,v1=<hex HMAC-SHA256 of
+// "<unix time>.<payload>">"; old signatures are rejected to prevent replays.
+type WebhookSigner struct {
+	Secret    []byte
+	Tolerance time.Duration
+}
+
+func (s *WebhookSigner) mac(payload []byte, ts int64) []byte {
+	mac := hmac.New(sha256.New, s.Secret)
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (s *WebhookSigner) Sign(payload []byte, now time.Time) string {
+	ts := now.Unix()
+	return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(s.mac(payload, ts)))
+}
+
+func (s *WebhookSigner) Verify(payload []byte, header string, now time.Time) error {
+	var ts int64
+	sigs := [][]byte{}
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			ts, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			if sig, err := hex.DecodeString(value); err == nil {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+	if ts == 0 || len(sigs) == 0 {
+		return errors.New("malformed signature header")
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > s.Tolerance || age < -s.Tolerance {
+		return errors.New("signature timestamp is out of tolerance")
+	}
+	expected := s.mac(payload, ts)
+	// Several signatures are sent while secret is rotated
+	for _, sig := range sigs {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+const (
+	fakeSignatureHeader = "Fake-Signature"
+	maxWebhookSize      = 64 << 10
+)
+
+// Local provider for development: payment page is served by the service
+// itself and events are signed and delivered to the webhook endpoint over
+// HTTP, as a real provider would do. Payment page and event routes exist
+// only if routes is true; otherwise events can be sent with billing sign
+// command only.
+type FakeBilling struct {
+	signer     *WebhookSigner
+	webhookURL string
+	period     time.Duration
+	client     *http.Client
+	routes     bool
+}
+
+func randomID(prefix string) string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return prefix + hex.EncodeToString(buf)
+}
+
+func (f *FakeBilling) Checkout(user User, plan Plan) (string, error) {
+	if !f.routes {
+		return "", errors.New("fake checkout is disabled")
+	}
+	return "/billing/fake/checkout?plan=" + url.QueryEscape(plan.ID), nil
+}
+
+func (f *FakeBilling) Cancel(user User) error {
+	return f.Send(EventSubscriptionCancelled, user, "")
+}
+
+// Delivers event about user's subscription to webhook endpoint. Created
+// event starts new subscription to plan, renewed one extends current
+// subscription by one period.
+func (f *FakeBilling) Send(typ string, user User, plan string) error {
+	sub := user.Subscription
+	event := BillingEvent{
+		ID:             randomID("evt_"),
+		Type:           typ,
+		UserID:         user.ID,
+		Plan:           sub.Plan,
+		SubscriptionID: sub.ID,
+		PeriodEnd:      sub.PeriodEnd,
+	}
+	switch typ {
+	case EventSubscriptionCreated:
+		event.Plan = plan
+		event.SubscriptionID = randomID("sub_")
+		event.PeriodEnd = time.Now().Add(f.period)
+	case EventSubscriptionRenewed:
+		event.PeriodEnd = sub.PeriodEnd.Add(f.period)
+		if sub.PeriodEnd.Before(time.Now()) {
+			event.PeriodEnd = time.Now().Add(f.period)
+		}
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, f.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(fakeSignatureHeader, f.signer.Sign(payload, time.Now()))
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (f *FakeBilling) ParseWebhook(r *http.Request) (BillingEvent, error) {
+	event := BillingEvent{}
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookSize))
+	if err != nil {
+		return event, err
+	}
+	if err := f.signer.Verify(payload, r.Header.Get(fakeSignatureHeader), time.Now()); err != nil {
+		return event, err
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return event, err
+	}
+	return event, event.validate()
+}
+
+// Returns nil if BILLING_PROVIDER is not set, so subscriptions are disabled
+func SetupBilling(log *logrus.Logger, cfg *Config) BillingProvider {
+	switch cfg.Billing.Provider {
+	case "":
+		return nil
+	default:
+		log.Warn("Fake billing is used; payments are not charged")
+		if cfg.Billing.FakeRoutes {
+			log.Warn("Fake billing routes are enabled; any user can get paid plan for free")
+		}
+		return &FakeBilling{
+			signer: &WebhookSigner{
+				Secret:    []byte(cfg.Billing.WebhookSecret),
+				Tolerance: 5 * time.Minute,
+			},
+			webhookURL: cfg.PublicURL + "/billing/webhook",
+			period:     cfg.Billing.Period,
+			client:     &http.Client{Timeout: 10 * time.Second},
+			routes:     cfg.Billing.FakeRoutes,
+		}
+	}
+}
+
+// Plans that can be bought; the default one is free
+func (h *Handler) paidPlans() []Plan {
+	plans := []Plan{}
+	for _, plan := range Plans {
+		if plan.ID != h.cfg.DefaultPlan {
+			plans = append(plans, plan)
+		}
+	}
+	return plans
+}
+
+func (h *Handler) billingRoute(c *gin.Context) {
+	user := getUser(c)
+
+	plans := []gin.H{}
+	for _, plan := range h.paidPlans() {
+		plans = append(plans, gin.H{
+			"ID":    plan.ID,
+			"Title": h.planTitle(c, plan),
+		})
+	}
+
+	sub := user.Subscription
+	status := ""
+	if sub.Active(time.Now()) {
+		status = h.localize(
+			c, "SubscriptionStatus"+camelKey(sub.Status),
+			"Plan", h.planTitle(c, h.userPlan(user)),
+			"Date", sub.PeriodEnd.Format("2006-01-02"),
+		)
+	}
+
+	fake, ok := h.billing.(*FakeBilling)
+	fakeRoutes := ok && fake.routes
+	h.execHTML(c, http.StatusOK, "page_billing.html", gin.H{
+		"Title":      h.localize(c, "TitleBilling"),
+		"Plan":       h.planTitle(c, h.userPlan(user)),
+		"Plans":      plans,
+		"Status":     status,
+		"Cancelable": sub.Active(time.Now()) && sub.Status != SubscriptionCancelled,
+		"Fake":       fakeRoutes && sub.ID != "",
+	})
+}
+
+// Sends user to provider payment page for :plan
+func (h *Handler) checkoutRoute(c *gin.Context) {
+	user := getUser(c)
+
+	plan, ok := FindPlan(c.Param("plan"))
+	if !ok || plan.ID == h.cfg.DefaultPlan {
+		h.errorBlock(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgUnknownPlan"),
+		)
+		return
+	}
+
+	target, err := h.billing.Checkout(*user, plan)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err":  err,
+			"uid":  user.ID,
+			"plan": plan.ID,
+		}).Error("Failed to start checkout")
+		h.errorBlock(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToStartCheckout"),
+		)
+		return
+	}
+
+	redirect(c, target)
+}
+
+func (h *Handler) cancelSubscriptionRoute(c *gin.Context) {
+	user := getUser(c)
+
+	if !user.Subscription.Active(time.Now()) {
+		h.errorBlock(c, http.StatusNotFound, "")
+		return
+	}
+
+	if err := h.billing.Cancel(*user); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"uid": user.ID,
+		}).Error("Failed to cancel subscription")
+		h.errorBlock(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToCancelSubscription"),
+		)
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"uid": user.ID,
+		"sub": user.Subscription.ID,
+	}).Info("Subscription cancellation requested")
+
+	redirect(c, "/billing")
+}
+
+// Applies provider events. Events that were already applied or belong to
+// erased users are acknowledged, so provider stops redelivering them.
+func (h *Handler) billingWebhookRoute(c *gin.Context) {
+	event, err := h.billing.ParseWebhook(c.Request)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"ip":  h.clientIP(c),
+		}).Warn("Rejected billing webhook")
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.ProcessBillingEvent(event)
+	if errors.Is(err, ErrEventProcessed) {
+		h.log.WithFields(logrus.Fields{
+			"event": event.ID,
+		}).Debug("Billing event is already processed")
+		c.Status(http.StatusOK)
+		return
+	}
+	if errors.Is(err, ErrEventNoUser) {
+		h.log.WithFields(logrus.Fields{
+			"event": event.ID,
+			"type":  event.Type,
+			"uid":   event.UserID,
+			"sub":   event.SubscriptionID,
+		}).Warn("Billing event of unknown user is ignored")
+		c.Status(http.StatusOK)
+		return
+	}
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err":   err,
+			"event": event.ID,
+		}).Error("Failed to process billing event")
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"event": event.ID,
+		"type":  event.Type,
+		"uid":   event.UserID,
+		"plan":  event.Plan,
+		"sub":   event.SubscriptionID,
+	}).Info("Billing event processed")
+
+	c.Status(http.StatusOK)
+}
+
+func (h *Handler) fakeCheckoutRoute(c *gin.Context) {
+	plan, ok := FindPlan(c.Query("plan"))
+	if !ok {
+		h.errorPage(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgUnknownPlan"),
+		)
+		return
+	}
+
+	h.execHTML(c, http.StatusOK, "page_billing_fake.html", gin.H{
+		"Title":    h.localize(c, "TitleFakeCheckout"),
+		"PlanID":   plan.ID,
+		"PlanName": h.planTitle(c, plan),
+	})
+}
+
+// Simulates provider events for current user: payment on fake checkout
+// page and renewal, failure or cancellation of subscription
+func (h *Handler) fakeBillingEventRoute(c *gin.Context) {
+	user := getUser(c)
+	fake := h.billing.(*FakeBilling)
+
+	typ := c.PostForm("type")
+	plan := c.PostForm("plan")
+	switch typ {
+	case EventSubscriptionCreated:
+		if _, ok := FindPlan(plan); !ok {
+			h.errorBlock(
+				c,
+				http.StatusBadRequest,
+				h.localize(c, "ErrMsgUnknownPlan"),
+			)
+			return
+		}
+	case EventSubscriptionRenewed, EventSubscriptionFailed, EventSubscriptionCancelled:
+		if user.Subscription.ID == "" {
+			h.errorBlock(c, http.StatusNotFound, "")
+			return
+		}
+	default:
+		h.errorBlock(c, http.StatusBadRequest, "")
+		return
+	}
+
+	if err := fake.Send(typ, *user, plan); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err":  err,
+			"type": typ,
+		}).Error("Failed to send fake billing event")
+		h.errorBlock(c, http.StatusInternalServerError, "")
+		return
+	}
+
+	redirect(c, "/billing")
+}
+
+// cards billing sign -type <event> -user <id> -sub <id> [-plan id] [-period-end time]
+//
+// Prints webhook payload and its signature made with BILLING_WEBHOOK_SECRET,
+// so fake provider events can be sent with curl.
+func billingCommand(args []string) int {
+	usage := "usage: cards billing sign -type <event> -user <id> -sub <id> [-plan id] [-period-end RFC3339]"
+	if len(args) < 1 || args[0] != "sign" {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	godotenv.Load()
+	flags := flag.NewFlagSet("billing sign", flag.ContinueOnError)
+	event := BillingEvent{ID: randomID("evt_")}
+	flags.StringVar(&event.Type, "type", "", "event type, e.g. "+EventSubscriptionRenewed)
+	uid := flags.Uint("user", 0, "user ID")
+	flags.StringVar(&event.SubscriptionID, "sub", "", "subscription ID")
+	flags.StringVar(&event.Plan, "plan", "", "plan ID")
+	periodEnd := flags.String("period-end", time.Now().AddDate(0, 1, 0).Format(time.RFC3339), "end of paid period")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	event.UserID = *uid
+
+	var err error
+	event.PeriodEnd, err = time.Parse(time.RFC3339, *periodEnd)
+	if err == nil {
+		err = event.validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	cfg, _ := LoadConfig(os.Getenv("CONFIG_FILE"))
+	if cfg.Billing.WebhookSecret == "" {
+		fmt.Fprintln(os.Stderr, "BILLING_WEBHOOK_SECRET is not set")
+		return 1
+	}
+	signer := WebhookSigner{Secret: []byte(cfg.Billing.WebhookSecret)}
+
+	payload, _ := json.Marshal(event)
+	fmt.Printf("%s: %s\n", fakeSignatureHeader, signer.Sign(payload, time.Now()))
+	fmt.Println(string(payload))
+	return 0
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWebhookSigner(t *testing.T) {
+	s := &WebhookSigner{Secret: []byte("secret"), Tolerance: 5 * time.Minute}
+	now := time.Unix(1700000000, 0)
+	payload := []byte(`{"id":"evt_1"}`)
+	header := s.Sign(payload, now)
+
+	if err := s.Verify(payload, header, now.Add(time.Minute)); err != nil {
+		t.Errorf("valid signature rejected: %v", err)
+	}
+
+	other := &WebhookSigner{Secret: []byte("other"), Tolerance: 5 * time.Minute}
+	tests := []struct {
+		name    string
+		payload []byte
+		header  string
+		now     time.Time
+	}{
+		{"wrong secret", payload, other.Sign(payload, now), now},
+		{"changed payload", []byte(`{"id":"evt_2"}`), header, now},
+		{"too old", payload, header, now.Add(6 * time.Minute)},
+		{"from future", payload, header, now.Add(-6 * time.Minute)},
+		{"bad hex", payload, fmt.Sprintf("t=%d,v1=zz", now.Unix()), now},
+		{"no signature", payload, fmt.Sprintf("t=%d", now.Unix()), now},
+		{"no timestamp", payload, "v1=00", now},
+		{"empty", payload, "", now},
+	}
+	for _, tt := range tests {
+		if err := s.Verify(tt.payload, tt.header, tt.now); err == nil {
+			t.Errorf("%s: signature accepted", tt.name)
+		}
+	}
+
+	// Old and new secrets are both sent while secret is rotated
+	rotated := other.Sign(payload, now) + "," + header[len(fmt.Sprintf("t=%d,", now.Unix())):]
+	if err := s.Verify(payload, rotated, now); err != nil {
+		t.Errorf("rotated signatures rejected: %v", err)
+	}
+}
+
+func TestSubscriptionApply(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	month := 30 * 24 * time.Hour
+	created := BillingEvent{
+		Type:           EventSubscriptionCreated,
+		Plan:           "pro",
+		SubscriptionID: "sub_1",
+		PeriodEnd:      start.Add(month),
+	}
+
+	s := Subscription{}
+	s.Apply(created)
+	if s.ID != "sub_1" || s.Plan != "pro" || s.Status != SubscriptionActive || !s.PeriodEnd.Equal(start.Add(month)) {
+		t.Fatalf("after created: %+v", s)
+	}
+
+	s.Apply(BillingEvent{Type: EventSubscriptionFailed, SubscriptionID: "sub_1"})
+	if s.Status != SubscriptionPastDue || !s.Active(start) {
+		t.Errorf("after failed: %+v", s)
+	}
+
+	s.Apply(BillingEvent{
+		Type:           EventSubscriptionRenewed,
+		Plan:           "pro",
+		SubscriptionID: "sub_1",
+		PeriodEnd:      start.Add(2 * month),
+	})
+	if s.Status != SubscriptionActive || !s.PeriodEnd.Equal(start.Add(2*month)) {
+		t.Errorf("after renewed: %+v", s)
+	}
+
+	// Late delivered event doesn't shorten period
+	s.Apply(BillingEvent{
+		Type:           EventSubscriptionRenewed,
+		Plan:           "pro",
+		SubscriptionID: "sub_1",
+		PeriodEnd:      start.Add(month),
+	})
+	if !s.PeriodEnd.Equal(start.Add(2 * month)) {
+		t.Errorf("period shortened: %+v", s)
+	}
+
+	// Events of other subscriptions are ignored
+	s.Apply(BillingEvent{Type: EventSubscriptionCancelled, SubscriptionID: "sub_0"})
+	s.Apply(BillingEvent{Type: EventSubscriptionFailed, SubscriptionID: "sub_0"})
+	if s.Status != SubscriptionActive {
+		t.Errorf("changed by other subscription: %+v", s)
+	}
+
+	s.Apply(BillingEvent{Type: EventSubscriptionCancelled, SubscriptionID: "sub_1"})
+	if s.Status != SubscriptionCancelled || !s.Active(start.Add(month)) || s.Active(start.Add(3*month)) {
+		t.Errorf("after cancelled: %+v", s)
+	}
+	s.Apply(BillingEvent{Type: EventSubscriptionFailed, SubscriptionID: "sub_1"})
+	if s.Status != SubscriptionCancelled {
+		t.Errorf("cancelled subscription became %s", s.Status)
+	}
+
+	// New subscription replaces old one
+	s.Apply(BillingEvent{
+		Type:           EventSubscriptionCreated,
+		Plan:           "business",
+		SubscriptionID: "sub_2",
+		PeriodEnd:      start.Add(month),
+	})
+	if s.ID != "sub_2" || s.Plan != "business" || s.Status != SubscriptionActive || !s.PeriodEnd.Equal(start.Add(month)) {
+		t.Errorf("after new subscription: %+v", s)
+	}
+}
+
+func TestProcessBillingEventOnce(t *testing.T) {
+	db, _ := newTestRamDB(t)
+	id, err := db.SignUser("test::1", "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := User{}
+	fmt.Sscan(id, &user.ID)
+
+	end := time.Now().Add(time.Hour).Truncate(time.Second)
+	event := BillingEvent{
+		ID:             "evt_1",
+		Type:           EventSubscriptionRenewed,
+		UserID:         user.ID,
+		Plan:           "pro",
+		SubscriptionID: "sub_1",
+		PeriodEnd:      end,
+	}
+	if err := db.ProcessBillingEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	// Redelivered event with changed period must not extend it again
+	event.PeriodEnd = end.Add(time.Hour)
+	if err := db.ProcessBillingEvent(event); !errors.Is(err, ErrEventProcessed) {
+		t.Errorf("second delivery: err = %v, want ErrEventProcessed", err)
+	}
+
+	if err := db.GetUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Subscription.ID != "sub_1" || !user.Subscription.PeriodEnd.Equal(end) {
+		t.Errorf("subscription = %+v", user.Subscription)
+	}
+
+	// Event of erased user is recorded, so redelivery is acknowledged
+	gone := BillingEvent{ID: "evt_2", Type: EventSubscriptionCancelled, UserID: 999}
+	if err := db.ProcessBillingEvent(gone); !errors.Is(err, ErrEventNoUser) {
+		t.Errorf("event of unknown user: err = %v, want ErrEventNoUser", err)
+	}
+	if err := db.ProcessBillingEvent(gone); !errors.Is(err, ErrEventProcessed) {
+		t.Errorf("redelivered event of unknown user: err = %v, want ErrEventProcessed", err)
+	}
+}
+
+func TestFakeBillingCheckout(t *testing.T) {
+	plan, _ := FindPlan("pro")
+	if _, err := (&FakeBilling{}).Checkout(User{}, plan); err == nil {
+		t.Error("checkout allowed without fake routes")
+	}
+	target, err := (&FakeBilling{routes: true}).Checkout(User{}, plan)
+	if err != nil || target != "/billing/fake/checkout?plan=pro" {
+		t.Errorf("Checkout = %q, %v", target, err)
+	}
+}
@@ -15,9 +15,29 @@ type Cache struct {
 	ring    []*entry // circular buffer
 	hand    int      // clock hand
 	memUsed int64    // current memory used
+	hits    int64
+	misses  int64
 	log     *logrus.Logger
 }
 
+// Counters of cache usage since start
+type CacheStats struct {
+	Entries  int
+	Capacity int
+	MemUsed  int64
+	MemLimit int64
+	Hits     int64
+	Misses   int64
+}
+
+// Share of lookups served from cache; 0 if there were none
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
 type entry struct {
 	key   string
 	value []byte
@@ -49,13 +69,29 @@ func (c *Cache) Get(key string) ([]byte, bool) {
 	defer c.mu.Unlock()
 	if e, ok := c.items[key]; ok {
 		e.ref = true
+		c.hits++
 		c.log.Trace("Cache hit " + key)
 		return e.value, true
 	}
+	c.misses++
 	c.log.Trace("Cache miss " + key)
 	return nil, false
 }
 
+// Stats returns current usage of the cache.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Entries:  len(c.items),
+		Capacity: c.capacity,
+		MemUsed:  c.memUsed,
+		MemLimit: c.memLimit,
+		Hits:     c.hits,
+		Misses:   c.misses,
+	}
+}
+
 // Set adds or updates a key-value pair in the cache.
 func (c *Cache) Set(key string, value []byte) {
 	c.mu.Lock()
@@ -85,21 +121,40 @@ func (c *Cache) Set(key string, value []byte) {
 		c.evictOne()
 	}
 
-	// Find a free slot in ring for initial fill
-	if len(c.items) < c.capacity {
-		// first len(items) slots are used
-		slot := len(c.items)
-		c.ring[slot] = e
-		e.ref = true
-		c.items[key] = e
-		c.memUsed += sz
-		c.log.Tracef("Cache memUsed %d", c.memUsed)
-		return
+	// Find a free slot in ring; evicted and deleted entries leave holes
+	for slot, old := range c.ring {
+		if old == nil {
+			c.ring[slot] = e
+			e.ref = true
+			c.items[key] = e
+			c.memUsed += sz
+			c.log.Tracef("Cache memUsed %d", c.memUsed)
+			return
+		}
 	}
 
 	// Should not reach here; capacity check above handles full
 }
 
+// Delete removes key from the cache if it is present.
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.log.Trace("Cache delete " + key)
+	delete(c.items, key)
+	c.memUsed -= e.size
+	for slot, old := range c.ring {
+		if old == e {
+			c.ring[slot] = nil
+			break
+		}
+	}
+}
+
 // evictOne evicts a single entry using CLOCK algorithm
 func (c *Cache) evictOne() {
 	n := c.capacity
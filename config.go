@@ -0,0 +1,574 @@
+package main
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Service configuration.
+//
+// Every setting is read from env var named in its `env` tag (alternative
+// names are comma separated). If env var is empty, value from optional
+// config file is used, then `default`. Config file is set with CONFIG_FILE
+// and may be YAML or TOML with the same keys as env vars.
+//
+// Other tags:
+//   - prefix: prepended to env names of nested struct settings
+//   - sep: separators of list items (comma by default)
+//   - min: minimal value of integer setting
+//   - secret: value is redacted when printed
+//
+// Durations must be positive.
+type Config struct {
+	Env       string `env:"GO_ENV" default:"production"` // debug or production
+	LogLevel  string `env:"LOG_LEVEL" default:"info"`
+	PublicURL string `env:"PUBLIC_URL"` // Required for email login and passkeys
+	GeoIPDB   string `env:"GEOIP_DB"`   // Offline MaxMind-format DB for locale detection
+
+	DefaultPlan string `env:"DEFAULT_PLAN" default:"free"` // Plan of users that have none assigned
+
+	Server     ServerConfig
+	Sessions   SessionConfig
+	DB         DBConfig
+	S3         S3Config
+	OAuth      OAuthConfig
+	OIDC       []OIDCConfig `env:"OIDC_PROVIDERS" prefix:"OIDC_"`
+	Mail       MailConfig
+	Proxy      ProxyConfig
+	RateLimits RateLimitConfig
+	Security   SecurityConfig
+	Billing    BillingConfig
+	Export     ExportConfig
+	Deletion   DeletionConfig
+	Audit      AuditConfig
+	Analytics  AnalyticsConfig
+	Gallery    GalleryConfig
+
+	// Admins have admin rights only in sessions started with passkey
+	PasskeyRequiredForAdmin bool `env:"PASSKEY_REQUIRED_FOR_ADMIN"`
+
+	sources map[string]string // Env name -> where value comes from
+}
+
+type ServerConfig struct {
+	Host          string `env:"GIN_HOST" default:"0.0.0.0"`
+	Port          int    `env:"GIN_PORT,PORT" default:"8080" min:"1"` // PORT is set by Heroku
+	SessionSecret string `env:"SESSION_SECRET" secret:"true"`         // Signs cookies
+	CookieTTL     int    `env:"COOKIE_TTL" default:"24" min:"1"`      // Hours
+	MaxUploadSize int64  `env:"MAX_UPLOAD_SIZE" default:"5242880" min:"1"`
+}
+
+type DBConfig struct {
+	DefaultRole Role     `env:"DEFAULT_ROLE,DEFAULT_USER_TYPE" default:"viewer"` // Role of new users
+	Admins      []string `env:"ADMINS" sep:";"`                                  // Provider IDs of users that sign up as admins
+	Host        string   `env:"PG_HOST"`                                         // RamDB is used if empty
+	Port        int      `env:"PG_PORT" default:"5432" min:"1"`
+	User        string   `env:"PG_USER"`
+	Password    string   `env:"PG_PASSWORD" secret:"true"`
+	Name        string   `env:"PG_NAME"`
+	SSLMode     string   `env:"PG_SSLMODE" default:"prefer"`
+	TimeZone    string   `env:"PG_TIMEZONE"`
+}
+
+type S3Config struct {
+	Endpoint    string `env:"S3_ENDPOINT"`
+	AccessKey   string `env:"S3_ACCESS_KEY"`
+	SecretKey   string `env:"S3_SECRET_KEY" secret:"true"`
+	Token       string `env:"S3_TOKEN" secret:"true"`
+	Bucket      string `env:"S3_BUCKET"`
+	UseSSL      bool   `env:"S3_USE_SSL"`
+	Prefix      string `env:"S3_PREFIX"`
+	CacheCount  int    `env:"S3_CACHE_COUNT" default:"100" min:"1"`
+	CacheMemory int64  `env:"S3_CACHE_MEMORY" default:"5242880" min:"1"` // Bytes
+}
+
+// Provider is enabled if all of its settings are set
+type OAuthClient struct {
+	ID          string `env:"CLIENT_ID"`
+	Secret      string `env:"CLIENT_SECRET" secret:"true"`
+	CallbackURL string `env:"CLIENT_CALLBACK_URL"`
+}
+
+func (c OAuthClient) Enabled() bool {
+	return c.ID != "" && c.Secret != "" && c.CallbackURL != ""
+}
+
+type OAuthConfig struct {
+	GitHub   OAuthClient `prefix:"GITHUB_"`
+	Google   OAuthClient `prefix:"GOOGLE_"`
+	Discord  OAuthClient `prefix:"DISCORD_"`
+	Yandex   OAuthClient `prefix:"YANDEX_"`
+	Telegram OAuthClient `prefix:"TG_"` // Client ID is bot name, secret is bot token
+
+	VKClientID    string `env:"VK_CLIENT_ID"`
+	VKCallbackURL string `env:"VK_CLIENT_CALLBACK_URL"`
+}
+
+// Generic OpenID Connect provider configured with OIDC_<ID>_* settings
+type OIDCConfig struct {
+	ID             string   // As listed in OIDC_PROVIDERS, lowercased
+	DiscoveryURL   string   `env:"DISCOVERY_URL"`
+	ClientID       string   `env:"CLIENT_ID"`
+	ClientSecret   string   `env:"CLIENT_SECRET" secret:"true"`
+	CallbackURL    string   `env:"CALLBACK_URL"` // Should point to /auth/<id>-oidc/callback
+	Scopes         []string `env:"SCOPES" sep:", " default:"openid profile email"`
+	Title          string   `env:"TITLE"` // ID if empty
+	Icon           string   `env:"ICON" default:"/static/oidc-logo.svg"`
+	AdminClaim     string   `env:"ADMIN_CLAIM"`     // <claim>=<value>
+	ModeratorClaim string   `env:"MODERATOR_CLAIM"` // <claim>=<value>
+	LimitedClaim   string   `env:"LIMITED_CLAIM"`   // <claim>=<value>; maps to viewer role
+}
+
+type MailConfig struct {
+	Sender       string        `env:"MAIL_SENDER"` // smtp, log or file; email login is disabled if empty
+	From         string        `env:"MAIL_FROM" default:"cards@localhost"`
+	Dir          string        `env:"MAIL_DIR" default:"mail"` // For file sender
+	SMTPHost     string        `env:"SMTP_HOST"`
+	SMTPPort     int           `env:"SMTP_PORT" default:"587" min:"1"`
+	SMTPUser     string        `env:"SMTP_USER"`
+	SMTPPassword string        `env:"SMTP_PASSWORD" secret:"true"`
+	LinkTTL      time.Duration `env:"EMAIL_LINK_TTL" default:"15m"`
+	LinkSecret   string        `env:"EMAIL_LINK_SECRET" secret:"true"` // SESSION_SECRET if empty
+}
+
+type BillingConfig struct {
+	Provider      string        `env:"BILLING_PROVIDER"` // fake; subscriptions are disabled if empty
+	WebhookSecret string        `env:"BILLING_WEBHOOK_SECRET" secret:"true"`
+	Period        time.Duration `env:"BILLING_FAKE_PERIOD" default:"720h"` // Subscription period of fake provider
+	FakeRoutes    bool          `env:"BILLING_FAKE_ROUTES"`                // Fake checkout and event pages; anyone gets paid plans for free
+}
+
+type ExportConfig struct {
+	LinkTTL time.Duration `env:"EXPORT_LINK_TTL" default:"24h"` // Lifetime of personal data download links
+}
+
+type DeletionConfig struct {
+	GracePeriod   time.Duration `env:"DELETION_GRACE_PERIOD" default:"720h"` // Deleted accounts can be restored by login meanwhile
+	CheckInterval time.Duration `env:"DELETION_CHECK_INTERVAL" default:"1h"`
+}
+
+type AuditConfig struct {
+	Retention time.Duration `env:"AUDIT_RETENTION" default:"8760h"` // Older entries are deleted
+}
+
+type AnalyticsConfig struct {
+	Enabled       bool          `env:"ANALYTICS_ENABLED" default:"true"`
+	FlushInterval time.Duration `env:"ANALYTICS_FLUSH_INTERVAL" default:"1m"` // Counters are kept in memory meanwhile
+}
+
+type GalleryConfig struct {
+	CacheTTL time.Duration `env:"GALLERY_CACHE_TTL" default:"5m"` // Rendered pages of public directory are reused meanwhile
+}
+
+// Policies as <requests>/<duration>, or "off"
+type RateLimitConfig struct {
+	Auth   string `env:"RATE_LIMIT_AUTH" default:"20/1m"`
+	Upload string `env:"RATE_LIMIT_UPLOAD" default:"30/10m"`
+	Media  string `env:"RATE_LIMIT_MEDIA" default:"300/1m"`
+	Card   string `env:"RATE_LIMIT_CARD" default:"60/1m"`
+	Report string `env:"RATE_LIMIT_REPORT" default:"60/1m"`
+	Email  string `env:"RATE_LIMIT_EMAIL" default:"3/15m"`
+}
+
+func (cfg *Config) Debug() bool {
+	return cfg.Env == "debug"
+}
+
+// Env var name of setting from OIDC provider or list item ID
+func configKey(id string) string {
+	return strings.ToUpper(strings.ReplaceAll(id, "-", "_"))
+}
+
+// Calls fn for every setting of struct v with its env names
+func walkConfig(v reflect.Value, prefix string, fn func(names []string, field reflect.StructField, value reflect.Value)) {
+	t := v.Type()
+	for i := range t.NumField() {
+		field, value := t.Field(i), v.Field(i)
+		env, ok := field.Tag.Lookup("env")
+		switch {
+		case !field.IsExported():
+		case !ok && field.Type.Kind() == reflect.Struct:
+			walkConfig(value, prefix+field.Tag.Get("prefix"), fn)
+		case ok:
+			names := strings.Split(env, ",")
+			for j := range names {
+				names[j] = prefix + names[j]
+			}
+			fn(names, field, value)
+			// List of nested configs is known only after fn loaded it
+			if field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct {
+				for j := range value.Len() {
+					item := value.Index(j)
+					itemPrefix := prefix + field.Tag.Get("prefix") + configKey(item.FieldByName("ID").String()) + "_"
+					walkConfig(item, itemPrefix, fn)
+				}
+			}
+		}
+	}
+}
+
+func splitConfigList(str, sep string) []string {
+	if sep == "" {
+		sep = ","
+	}
+	items := strings.FieldsFunc(str, func(r rune) bool {
+		return strings.ContainsRune(sep, r)
+	})
+	list := []string{}
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Sets setting from env string or config file value
+func setConfigValue(v reflect.Value, field reflect.StructField, raw any) error {
+	var list []string
+	switch val := raw.(type) {
+	case map[string]any:
+		return errors.New("expected value, got table")
+	case []any:
+		for _, item := range val {
+			list = append(list, fmt.Sprint(item))
+		}
+	default:
+		list = splitConfigList(fmt.Sprint(val), field.Tag.Get("sep"))
+	}
+
+	if v.Kind() == reflect.Slice {
+		if v.Type().Elem().Kind() != reflect.Struct {
+			v.Set(reflect.ValueOf(list))
+			return nil
+		}
+		items := reflect.MakeSlice(v.Type(), len(list), len(list))
+		for i, id := range list {
+			items.Index(i).FieldByName("ID").SetString(strings.ToLower(id))
+		}
+		v.Set(items)
+		return nil
+	}
+
+	str := strings.TrimSpace(fmt.Sprint(raw))
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(str))
+	}
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		dur, err := time.ParseDuration(str)
+		if err != nil || dur <= 0 {
+			return fmt.Errorf("expected positive duration, got %q", str)
+		}
+		v.SetInt(int64(dur))
+	case v.Kind() == reflect.String:
+		v.SetString(str)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", str)
+		}
+		v.SetBool(b)
+	case v.CanInt():
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected integer, got %q", str)
+		}
+		if min, ok := field.Tag.Lookup("min"); ok {
+			if m, _ := strconv.ParseInt(min, 10, 64); n < m {
+				return fmt.Errorf("expected at least %d, got %d", m, n)
+			}
+		}
+		v.SetInt(n)
+	case v.CanUint():
+		n, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected non-negative integer, got %q", str)
+		}
+		v.SetUint(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+func readConfigFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q; use .yaml, .yml or .toml", ext)
+	}
+	return values, err
+}
+
+// Loads config from env and optional file. Config is returned even if
+// there are errors, with defaults in place of invalid settings, so it is
+// possible to report all of them at once.
+func LoadConfig(path string) (*Config, []error) {
+	cfg := &Config{sources: map[string]string{}}
+	errs := []error{}
+
+	file := map[string]any{}
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("CONFIG_FILE: %w", err))
+		} else {
+			file = values
+		}
+	}
+
+	known := map[string]bool{}
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", func(names []string, field reflect.StructField, value reflect.Value) {
+		var raw any
+		source := ""
+		for _, name := range names {
+			known[name] = true
+		}
+		for _, name := range names {
+			if str := os.Getenv(name); str != "" && source == "" {
+				raw, source = str, "env"
+			}
+		}
+		for _, name := range names {
+			if val, ok := file[name]; ok && source == "" {
+				raw, source = val, "file"
+			}
+		}
+		if def, ok := field.Tag.Lookup("default"); ok && source == "" {
+			raw, source = def, "default"
+		}
+		if source == "" {
+			return
+		}
+		if err := setConfigValue(value, field, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", names[0], err))
+			cfg.sources[names[0]] = "invalid"
+			// Fall back to default, so the rest of config can be checked
+			if def, ok := field.Tag.Lookup("default"); ok && source != "default" {
+				setConfigValue(value, field, def)
+			}
+			return
+		}
+		cfg.sources[names[0]] = source
+	})
+
+	for key := range file {
+		if !known[key] {
+			errs = append(errs, fmt.Errorf("%s: unknown setting in config file", key))
+		}
+	}
+
+	cfg.applyDefaults()
+	return cfg, append(errs, cfg.validate()...)
+}
+
+// Defaults that depend on other settings
+func (cfg *Config) applyDefaults() {
+	// HSTS makes no sense for plain http dev setups
+	if cfg.Debug() && cfg.sources["HSTS_MAX_AGE"] == "default" {
+		cfg.Security.HSTSMaxAge = 0
+	}
+	for i := range cfg.OIDC {
+		if cfg.OIDC[i].Title == "" {
+			cfg.OIDC[i].Title = cfg.OIDC[i].ID
+		}
+	}
+	cfg.PublicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+}
+
+// Checks settings that depend on each other or have fixed set of values
+func (cfg *Config) validate() []error {
+	errs := []error{}
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	oneOf := func(name, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		fail("%s: expected one of %s, got %q", name, strings.Join(allowed, ", "), value)
+	}
+
+	oneOf("GO_ENV", cfg.Env, "debug", "production")
+	if _, err := logrus.ParseLevel(cfg.LogLevel); err != nil {
+		fail("LOG_LEVEL: expected trace, debug, info, warn or error, got %q", cfg.LogLevel)
+	}
+	if cfg.PublicURL != "" {
+		if u, err := url.Parse(cfg.PublicURL); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("PUBLIC_URL: expected absolute URL, got %q", cfg.PublicURL)
+		}
+	}
+
+	if _, ok := FindPlan(cfg.DefaultPlan); !ok {
+		ids := []string{}
+		for _, plan := range Plans {
+			ids = append(ids, plan.ID)
+		}
+		fail("DEFAULT_PLAN: expected one of %s, got %q", strings.Join(ids, ", "), cfg.DefaultPlan)
+	}
+	if cfg.Server.SessionSecret == "" {
+		fail("SESSION_SECRET: required")
+	}
+	if cfg.S3.Endpoint == "" {
+		fail("S3_ENDPOINT: required")
+	}
+	if cfg.S3.Bucket == "" {
+		fail("S3_BUCKET: required")
+	}
+
+	for _, p := range cfg.OIDC {
+		prefix := "OIDC_" + configKey(p.ID) + "_"
+		if p.DiscoveryURL == "" {
+			fail("%sDISCOVERY_URL: required", prefix)
+		}
+		if p.ClientID == "" {
+			fail("%sCLIENT_ID: required", prefix)
+		}
+		if p.CallbackURL == "" {
+			fail("%sCALLBACK_URL: required", prefix)
+		}
+		if _, err := parseClaimMatch(p.AdminClaim); err != nil {
+			fail("%sADMIN_CLAIM: %s", prefix, err)
+		}
+		if _, err := parseClaimMatch(p.ModeratorClaim); err != nil {
+			fail("%sMODERATOR_CLAIM: %s", prefix, err)
+		}
+		if _, err := parseClaimMatch(p.LimitedClaim); err != nil {
+			fail("%sLIMITED_CLAIM: %s", prefix, err)
+		}
+	}
+
+	if cfg.Mail.Sender != "" {
+		oneOf("MAIL_SENDER", cfg.Mail.Sender, "smtp", "log", "file")
+	}
+	if cfg.Mail.Sender == "smtp" && cfg.Mail.SMTPHost == "" {
+		fail("SMTP_HOST: required for smtp MAIL_SENDER")
+	}
+	if cfg.Mail.Sender != "" && cfg.PublicURL == "" {
+		fail("PUBLIC_URL: required for email login")
+	}
+	if cfg.PasskeyRequiredForAdmin && cfg.PublicURL == "" {
+		fail("PUBLIC_URL: required for PASSKEY_REQUIRED_FOR_ADMIN")
+	}
+
+	if cfg.Billing.Provider != "" {
+		oneOf("BILLING_PROVIDER", cfg.Billing.Provider, "fake")
+		if cfg.Billing.WebhookSecret == "" {
+			fail("BILLING_WEBHOOK_SECRET: required for billing")
+		}
+		if cfg.PublicURL == "" {
+			fail("PUBLIC_URL: required for billing")
+		}
+	}
+	if cfg.Billing.FakeRoutes && cfg.Billing.Provider != "fake" {
+		fail("BILLING_FAKE_ROUTES: requires fake BILLING_PROVIDER")
+	}
+
+	for _, str := range cfg.Proxy.TrustedProxies {
+		if _, err := parseTrustedProxy(str); err != nil {
+			fail("TRUSTED_PROXIES: invalid entry %q", str)
+		}
+	}
+
+	limits := reflect.ValueOf(cfg.RateLimits)
+	for i := range limits.NumField() {
+		str := limits.Field(i).String()
+		if _, _, err := parseRateLimit(str); err != nil && str != "off" {
+			fail("%s: %s", limits.Type().Field(i).Tag.Get("env"), err)
+		}
+	}
+
+	oneOf("CSP_MODE", cfg.Security.CSPMode, CSPModeEnforce, CSPModeReportOnly, CSPModeOff)
+
+	return errs
+}
+
+// Writes settings with their sources; secrets are redacted
+func (cfg *Config) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", func(names []string, field reflect.StructField, value reflect.Value) {
+		var str string
+		switch {
+		case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Struct:
+			ids := []string{}
+			for i := range value.Len() {
+				ids = append(ids, value.Index(i).FieldByName("ID").String())
+			}
+			str = strings.Join(ids, ",")
+		case value.Kind() == reflect.Slice:
+			sep := field.Tag.Get("sep")
+			if sep == "" {
+				sep = ","
+			}
+			str = strings.Join(value.Interface().([]string), sep[:1])
+		default:
+			str = fmt.Sprint(value.Interface())
+		}
+		if field.Tag.Get("secret") == "true" && str != "" {
+			str = "[redacted]"
+		}
+		source := cfg.sources[names[0]]
+		if source == "" {
+			source = "unset"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", names[0], str, source)
+	})
+	tw.Flush()
+}
+
+// cards config check [-file path]
+func configCommand(args []string) int {
+	if len(args) < 1 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: cards config check [-file path]")
+		return 2
+	}
+
+	envErr := godotenv.Load()
+	flags := flag.NewFlagSet("config check", flag.ContinueOnError)
+	path := flags.String("file", os.Getenv("CONFIG_FILE"), "YAML or TOML config file")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if envErr == nil {
+		fmt.Println("Loaded .env file")
+	}
+
+	cfg, errs := LoadConfig(*path)
+	cfg.Print(os.Stdout)
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "\n%d config errors:\n", len(errs))
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "  "+err.Error())
+		}
+		return 1
+	}
+	fmt.Println("\nConfig is valid")
+	return 0
+}
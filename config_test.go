@@ -0,0 +1,226 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Clears env vars of all settings, so tests don't depend on environment,
+// and sets required ones
+func setupConfigEnv(t *testing.T) {
+	t.Helper()
+	walkConfig(reflect.ValueOf(&Config{}).Elem(), "", func(names []string, _ reflect.StructField, _ reflect.Value) {
+		for _, name := range names {
+			t.Setenv(name, "")
+		}
+	})
+	t.Setenv("SESSION_SECRET", "session-secret")
+	t.Setenv("S3_ENDPOINT", "minio:9000")
+	t.Setenv("S3_BUCKET", "cards")
+}
+
+func writeConfigFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	setupConfigEnv(t)
+	cfg, errs := LoadConfig("")
+	if len(errs) > 0 {
+		t.Fatalf("errors: %v", errs)
+	}
+	if cfg.Server.Port != 8080 || cfg.DB.DefaultRole != RoleViewer || cfg.Export.LinkTTL != 24*time.Hour {
+		t.Errorf("defaults not applied: %+v", cfg)
+	}
+	if cfg.Server.SessionSecret != "session-secret" {
+		t.Errorf("SESSION_SECRET = %q", cfg.Server.SessionSecret)
+	}
+	sources := map[string]string{"GIN_PORT": "default", "SESSION_SECRET": "env", "PG_HOST": ""}
+	for name, want := range sources {
+		if got := cfg.sources[name]; got != want {
+			t.Errorf("source of %s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+GIN_PORT: 9000
+COOKIE_TTL: 48
+ADMINS: ["github::1", "google::2"]
+DELETION_GRACE_PERIOD: 48h
+S3_USE_SSL: true
+`,
+		"config.toml": `
+GIN_PORT = 9000
+COOKIE_TTL = 48
+ADMINS = ["github::1", "google::2"]
+DELETION_GRACE_PERIOD = "48h"
+S3_USE_SSL = true
+`,
+	}
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			setupConfigEnv(t)
+			// Env takes precedence over file
+			t.Setenv("COOKIE_TTL", "12")
+			cfg, errs := LoadConfig(writeConfigFile(t, name, data))
+			if len(errs) > 0 {
+				t.Fatalf("errors: %v", errs)
+			}
+			if cfg.Server.Port != 9000 || cfg.sources["GIN_PORT"] != "file" {
+				t.Errorf("GIN_PORT = %d from %s", cfg.Server.Port, cfg.sources["GIN_PORT"])
+			}
+			if cfg.Server.CookieTTL != 12 || cfg.sources["COOKIE_TTL"] != "env" {
+				t.Errorf("COOKIE_TTL = %d from %s", cfg.Server.CookieTTL, cfg.sources["COOKIE_TTL"])
+			}
+			if !slices.Equal(cfg.DB.Admins, []string{"github::1", "google::2"}) {
+				t.Errorf("ADMINS = %q", cfg.DB.Admins)
+			}
+			if cfg.Deletion.GracePeriod != 48*time.Hour || !cfg.S3.UseSSL {
+				t.Errorf("file values not applied: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	setupConfigEnv(t)
+	// Alternative name is used if the first one is empty
+	t.Setenv("PORT", "5000")
+	t.Setenv("ADMINS", "github::1; google::2;")
+	t.Setenv("DEFAULT_USER_TYPE", "2")
+	t.Setenv("OIDC_PROVIDERS", "Corp")
+	t.Setenv("OIDC_CORP_DISCOVERY_URL", "https://sso.example.com/.well-known/openid-configuration")
+	t.Setenv("OIDC_CORP_CLIENT_ID", "cards")
+	t.Setenv("OIDC_CORP_CALLBACK_URL", "https://cards.example.com/auth/corp-oidc/callback")
+	t.Setenv("OIDC_CORP_SCOPES", "openid, groups")
+
+	cfg, errs := LoadConfig("")
+	if len(errs) > 0 {
+		t.Fatalf("errors: %v", errs)
+	}
+	if cfg.Server.Port != 5000 || cfg.sources["GIN_PORT"] != "env" {
+		t.Errorf("GIN_PORT = %d from %s", cfg.Server.Port, cfg.sources["GIN_PORT"])
+	}
+	if !slices.Equal(cfg.DB.Admins, []string{"github::1", "google::2"}) {
+		t.Errorf("ADMINS = %q", cfg.DB.Admins)
+	}
+	if cfg.DB.DefaultRole != RoleViewer {
+		t.Errorf("DEFAULT_ROLE = %v", cfg.DB.DefaultRole)
+	}
+	if len(cfg.OIDC) != 1 {
+		t.Fatalf("%d OIDC providers", len(cfg.OIDC))
+	}
+	p := cfg.OIDC[0]
+	if p.ID != "corp" || p.ClientID != "cards" || p.Title != "corp" || !slices.Equal(p.Scopes, []string{"openid", "groups"}) {
+		t.Errorf("OIDC provider = %+v", p)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		env   map[string]string
+		error string // Setting in error
+	}{
+		{map[string]string{"GIN_PORT": "0"}, "GIN_PORT"},
+		{map[string]string{"GIN_PORT": "http"}, "GIN_PORT"},
+		{map[string]string{"EXPORT_LINK_TTL": "0s"}, "EXPORT_LINK_TTL"},
+		{map[string]string{"EXPORT_LINK_TTL": "-1h"}, "EXPORT_LINK_TTL"},
+		{map[string]string{"EXPORT_LINK_TTL": "day"}, "EXPORT_LINK_TTL"},
+		{map[string]string{"S3_USE_SSL": "maybe"}, "S3_USE_SSL"},
+		{map[string]string{"DEFAULT_ROLE": "owner"}, "DEFAULT_ROLE"},
+		{map[string]string{"GO_ENV": "staging"}, "GO_ENV"},
+		{map[string]string{"RATE_LIMIT_AUTH": "20"}, "RATE_LIMIT_AUTH"},
+		{map[string]string{"SESSION_SECRET": ""}, "SESSION_SECRET"},
+		{map[string]string{"PUBLIC_URL": "cards.example.com"}, "PUBLIC_URL"},
+		{map[string]string{"BILLING_FAKE_ROUTES": "true"}, "BILLING_FAKE_ROUTES"},
+		{map[string]string{"OIDC_PROVIDERS": "corp"}, "OIDC_CORP_DISCOVERY_URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.error, func(t *testing.T) {
+			setupConfigEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			_, errs := LoadConfig("")
+			found := false
+			for _, err := range errs {
+				found = found || strings.HasPrefix(err.Error(), tt.error+":")
+			}
+			if !found {
+				t.Errorf("no %s error in %v", tt.error, errs)
+			}
+		})
+	}
+
+	// Invalid value is replaced with default, so other checks still work
+	setupConfigEnv(t)
+	t.Setenv("GIN_PORT", "0")
+	t.Setenv("COOKIE_TTL", "-1")
+	cfg, errs := LoadConfig("")
+	if len(errs) != 2 {
+		t.Errorf("errors: %v, want 2", errs)
+	}
+	if cfg.Server.Port != 8080 || cfg.Server.CookieTTL != 24 || cfg.sources["GIN_PORT"] != "invalid" {
+		t.Errorf("invalid values kept: %+v", cfg.Server)
+	}
+
+	t.Setenv("GIN_PORT", "")
+	t.Setenv("COOKIE_TTL", "")
+	path := writeConfigFile(t, "config.yaml", "UNKNOWN_SETTING: 1\nS3_CACHE_COUNT: {a: 1}\n")
+	_, errs = LoadConfig(path)
+	if len(errs) != 2 {
+		t.Errorf("file errors: %v, want unknown setting and table value", errs)
+	}
+	if _, errs := LoadConfig(writeConfigFile(t, "config.json", "{}")); len(errs) != 1 {
+		t.Errorf("unsupported file format: %v", errs)
+	}
+}
+
+func TestConfigPrint(t *testing.T) {
+	setupConfigEnv(t)
+	t.Setenv("PG_PASSWORD", "pg-secret")
+	t.Setenv("OIDC_PROVIDERS", "corp")
+	t.Setenv("OIDC_CORP_CLIENT_SECRET", "oidc-secret")
+	cfg, _ := LoadConfig("")
+
+	out := &strings.Builder{}
+	cfg.Print(out)
+	for _, secret := range []string{"session-secret", "pg-secret", "oidc-secret"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("secret %q printed", secret)
+		}
+	}
+
+	lines := map[string][]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			lines[fields[0]] = fields[1:]
+		}
+	}
+	tests := map[string][]string{
+		"SESSION_SECRET":          {"[redacted]", "env"},
+		"OIDC_CORP_CLIENT_SECRET": {"[redacted]", "env"},
+		"S3_TOKEN":                {"unset"}, // Empty secret is not redacted
+		"S3_BUCKET":               {"cards", "env"},
+		"GIN_PORT":                {"8080", "default"},
+		"OIDC_PROVIDERS":          {"corp", "env"},
+	}
+	for name, want := range tests {
+		if got := lines[name]; !slices.Equal(got, want) {
+			t.Errorf("%s printed as %q, want %q", name, got, want)
+		}
+	}
+}
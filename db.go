@@ -4,21 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
 	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/sirupsen/logrus"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-)
-
-const (
-	UserTypeUsual   uint = 0
-	UserTypeAdmin   uint = 1
-	UserTypeLimited uint = 2
+	"gorm.io/gorm/clause"
 )
 
 type CardFields struct {
@@ -32,34 +28,362 @@ type CardFields struct {
 	Whatsapp    string `form:"whatsapp"`
 	VK          string `form:"vk"`
 	IsHidden    bool   `form:"hidden"`
+	Listed      bool   `form:"listed"` // Shown in public directory unless hidden
+	// Locale -> translated text fields
+	Translations map[string]CardTranslation `form:"-" gorm:"serializer:json"`
+}
+
+// Translatable subset of CardFields.
+// Empty values fall back to the ones from CardFields.
+type CardTranslation struct {
+	Name        string `json:",omitempty"`
+	Company     string `json:",omitempty"`
+	Position    string `json:",omitempty"`
+	Description string `json:",omitempty"`
+}
+
+func (t CardTranslation) IsEmpty() bool {
+	return t == CardTranslation{}
 }
 
 type Card struct {
-	ID     uint `gorm:"primaryKey"`
-	Owner  uint
-	Fields CardFields `gorm:"embedded"`
-	Avatar string
-	Logo   string
+	ID         uint `gorm:"primaryKey"`
+	Owner      uint
+	Fields     CardFields `gorm:"embedded"`
+	Avatar     string
+	Logo       string
+	AvatarSize int64 // Bytes; counted against plan quota
+	LogoSize   int64
+	OrgID      uint      `gorm:"index"` // 0 for personal cards
+	CreatedAt  time.Time `gorm:"index"` // Zero for cards created before it was tracked
+}
+
+// Localized returns copy of card with text fields replaced by translation
+// for given locale. If there is no translation for exact locale, translation
+// for its base language (e.g. "ru" for "ru-RU") is used.
+func (card Card) Localized(lang string) Card {
+	tr, ok := card.Fields.Translations[lang]
+	if !ok {
+		base, _, _ := strings.Cut(lang, "-")
+		tr, ok = card.Fields.Translations[base]
+	}
+	if !ok {
+		return card
+	}
+	if tr.Name != "" {
+		card.Fields.Name = tr.Name
+	}
+	if tr.Company != "" {
+		card.Fields.Company = tr.Company
+	}
+	if tr.Position != "" {
+		card.Fields.Position = tr.Position
+	}
+	if tr.Description != "" {
+		card.Fields.Description = tr.Description
+	}
+	return card
+}
+
+// Branded returns copy of card with empty company and logo taken from
+// organization the card belongs to
+func (card Card) Branded(org Org) Card {
+	if card.Fields.Company == "" {
+		card.Fields.Company = org.Name
+	}
+	if card.Logo == "" {
+		card.Logo = org.Logo
+	}
+	return card
 }
 
 type User struct {
+	ID         uint   `gorm:"primaryKey"`
+	ProviderID string // Provider ID user signed up with
+	Name       string
+	Role       Role   `gorm:"column:type" json:"Type"` // Stored as former user type
+	Lang       string // Preferred locale; empty if not selected yet
+	Plan       string // Plan ID; default plan is used if empty
+
+	Subscription Subscription `gorm:"embedded;embeddedPrefix:subscription_"`
+
+	// Account is erased after this time unless user logs in; nil if
+	// deletion is not scheduled
+	DeleteAt *time.Time `gorm:"index"`
+}
+
+func (u User) DeletionScheduled() bool {
+	return u.DeleteAt != nil
+}
+
+// Append-only record of security relevant action. Target is "<kind>:<id>",
+// e.g. "user:5"; Diff is JSON with changed values.
+type AuditEntry struct {
+	ID        uint   `gorm:"primaryKey"`
+	ActorID   uint   `gorm:"index"` // 0 for actions done by service itself
+	Action    string `gorm:"index"`
+	Target    string `gorm:"index"`
+	Diff      string
+	IP        string
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// Public directory query. Only listed visible cards of owners whose
+// accounts are not being deleted are returned, newest first.
+type DirectoryQuery struct {
+	Company  string // Case-insensitive part of company; org name for org cards without one
+	Position string // Case-insensitive part of position
+	BeforeID uint   // Cursor; 0 for first page
+	Limit    int
+}
+
+// Reports whether card with given company (after org branding) matches
+// filters, not taking cursor and listing flags into account
+func (q DirectoryQuery) Match(card Card, company string) bool {
+	return strings.Contains(strings.ToLower(company), strings.ToLower(q.Company)) &&
+		strings.Contains(strings.ToLower(card.Fields.Position), strings.ToLower(q.Position))
+}
+
+// Counters of card for one UTC day. Nothing about visitors is stored;
+// unique visitors are counted in memory by salted hashes that change daily.
+type CardStat struct {
+	CardID   uint      `gorm:"primaryKey"`
+	Day      time.Time `gorm:"primaryKey;type:date"`
+	Views    int64
+	Visitors int64 // Unique views
+	Scans    int64 // Views from QR code
+	VCards   int64 // Contact downloads
+	Installs int64 // Card added as app
+}
+
+// Sums counters; card and day are kept
+func (s CardStat) Add(other CardStat) CardStat {
+	s.Views += other.Views
+	s.Visitors += other.Visitors
+	s.Scans += other.Scans
+	s.VCards += other.VCards
+	s.Installs += other.Installs
+	return s
+}
+
+func (s CardStat) Empty() bool {
+	return s.Views == 0 && s.Visitors == 0 && s.Scans == 0 && s.VCards == 0 && s.Installs == 0
+}
+
+// Audit log query; zero fields don't filter. Entries are returned newest
+// first.
+type AuditFilter struct {
+	ActorID  uint
+	Action   string
+	Target   string
+	From     time.Time
+	To       time.Time
+	BeforeID uint // Pagination cursor; only older entries are returned
+	Limit    int  // 0 for all entries
+}
+
+func (f AuditFilter) Match(e AuditEntry) bool {
+	return (f.ActorID == 0 || e.ActorID == f.ActorID) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Target == "" || e.Target == f.Target) &&
+		(f.From.IsZero() || !e.CreatedAt.Before(f.From)) &&
+		(f.To.IsZero() || e.CreatedAt.Before(f.To)) &&
+		(f.BeforeID == 0 || e.ID < f.BeforeID)
+}
+
+// Organization with branding shared by cards of its members
+type Org struct {
 	ID         uint `gorm:"primaryKey"`
-	ProviderID string
 	Name       string
-	Type       uint
+	Logo       string
+	Theme      string // One of Themes
+	InviteCode string `gorm:"index"` // Users join org with it
+	CreatedAt  time.Time
+}
+
+type Membership struct {
+	OrgID     uint `gorm:"primaryKey"`
+	UserID    uint `gorm:"primaryKey;index"`
+	Role      OrgRole
+	CreatedAt time.Time
+}
+
+// Login provider account linked to user.
+// ProviderID looks like "github::123", "tg:123" or "vk:123".
+type Identity struct {
+	ProviderID string `gorm:"primaryKey"`
+	UserID     uint   `gorm:"index"`
+	Name       string // User name reported by provider
+	CreatedAt  time.Time
+}
+
+// Provider returns name of login provider as used in /auth/:provider routes
+func (i Identity) Provider() string {
+	if name, _, ok := strings.Cut(i.ProviderID, "::"); ok {
+		return name
+	}
+	name, _, _ := strings.Cut(i.ProviderID, ":")
+	if name == "tg" {
+		return "telegram"
+	}
+	return name
+}
+
+// Number of cards created in a day
+type DayCount struct {
+	Day   time.Time
+	Count int64
+}
+
+// Aggregated numbers shown on admin dashboard
+type Stats struct {
+	Users           int64
+	UsersByRole     map[Role]int64
+	UsersByProvider map[string]int64 // Users with identity of provider
+	Cards           int64
+	HiddenCards     int64
+	MediaObjects    int64 // Avatars and logos of cards
+	MediaBytes      int64
+	CardsPerDay     []DayCount // Only days with new cards, oldest first
+}
+
+// Prefix of provider IDs of identities of login provider
+func IdentityPrefix(provider string) string {
+	switch provider {
+	case "telegram":
+		return "tg:"
+	case "vk":
+		return "vk:"
+	}
+	return provider + "::"
+}
+
+// Pending email login link.
+// ID is a hash of the nonce from the link.
+type LoginToken struct {
+	ID        string `gorm:"primaryKey"`
+	Email     string
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// Billing event that was applied to user subscription
+type ProcessedEvent struct {
+	ID        string `gorm:"primaryKey"` // Provider event ID
+	UserID    uint
+	Type      string
+	CreatedAt time.Time
+}
+
+var (
+	ErrIdentityTaken  = errors.New("identity is linked to another user")
+	ErrLastIdentity   = errors.New("can't unlink the only identity of user")
+	ErrEventProcessed = errors.New("billing event is already processed")
+	ErrEventNoUser    = errors.New("user of billing event not found")
+	ErrSubscribed     = errors.New("user has active subscription")
+)
+
+// Server side login session.
+// ID is a hash of the token stored in user cookie.
+type Session struct {
+	ID        string `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index"`
+	UserAgent string
+	IP        string
+	CreatedAt time.Time
+	LastSeen  time.Time
+	Passkey   bool // Signed in with passkey
+}
+
+// WebAuthn credential of user.
+// ID is base64url encoded credential ID.
+type Passkey struct {
+	ID         string `gorm:"primaryKey"`
+	UserID     uint   `gorm:"index"`
+	Name       string
+	Credential webauthn.Credential `gorm:"serializer:json"`
+	CreatedAt  time.Time
+	LastUsed   time.Time
 }
 
 type Database interface {
+	// Returns ID of user with given identity, creating new user if none
 	SignUser(pid, name string) (string, error)
 	GetUser(user *User) error
+	// Deletes user with cards, their blobs and all other user rows. User
+	// row goes last, so failed deletion can be retried.
 	DeleteUser(id uint) error
 	CreateCard(owner uint, fields CardFields) (Card, error)
 	UpdateCard(card Card) error
 	GetCard(id uint) (Card, error)
 	DeleteCard(id uint) error
 	ListCards(uid uint) ([]Card, error)
-	ListUsers() ([]User, error)
+	// Page of users matching query, with number of cards of each
+	SearchUsers(q UserQuery) ([]UserSummary, error)
+	// Totals for admin dashboard; cards per day are counted since given time
+	Stats(since time.Time) (Stats, error)
+	// Users whose deletion was scheduled before now
+	ListUsersDueForDeletion(now time.Time) ([]User, error)
+	// Sets only deletion time of user; nil cancels deletion
+	ScheduleDeletion(uid uint, at *time.Time) error
 	UpdateUser(user User) error
+	// Links identity to user; fails with ErrIdentityTaken if it is linked
+	// to another one
+	LinkIdentity(uid uint, pid, name string) error
+	// Fails with ErrLastIdentity if user has no other identities
+	UnlinkIdentity(uid uint, pid string) error
+	ListIdentities(uid uint) ([]Identity, error)
+	// Moves identities and cards of src user to dst one and deletes src.
+	// Better of assigned plans is kept. Fails with ErrSubscribed if src
+	// has active subscription, as provider events would be lost.
+	MergeUsers(dst, src uint) error
+	CreateSession(sess Session) error
+	GetSession(id string) (Session, error)
+	UpdateSession(sess Session) error
+	ListSessions(uid uint) ([]Session, error)
+	DeleteSession(id string) error
+	DeleteUserSessions(uid uint) error
+	// Deletes sessions last seen before idle or created before created
+	DeleteExpiredSessions(idle, created time.Time) error
+	CreatePasskey(key Passkey) error
+	GetPasskey(id string) (Passkey, error)
+	UpdatePasskey(key Passkey) error
+	ListPasskeys(uid uint) ([]Passkey, error)
+	DeletePasskey(uid uint, id string) error
+	CreateLoginToken(token LoginToken) error
+	// Deletes token and returns it, so each one can be used only once
+	UseLoginToken(id string) (LoginToken, error)
+	DeleteExpiredLoginTokens(now time.Time) error
+	// Applies event to user subscription; fails with ErrEventProcessed if
+	// event with the same ID was applied before. Events of unknown (e.g.
+	// erased) users are recorded as processed and fail with ErrEventNoUser.
+	ProcessBillingEvent(event BillingEvent) error
+	// Creates org with admin member
+	CreateOrg(org Org, admin uint) (Org, error)
+	GetOrg(id uint) (Org, error)
+	UpdateOrg(org Org) error
+	// Deletes org with its memberships; its cards become personal
+	DeleteOrg(id uint) error
+	FindOrgByInvite(code string) (Org, error)
+	// Orgs user is a member of
+	ListOrgs(uid uint) ([]Org, error)
+	GetMembership(org, uid uint) (Membership, error)
+	ListMembers(org uint) ([]Membership, error)
+	// Creates or updates membership
+	SaveMembership(m Membership) error
+	// Removes user from org; their org cards become personal
+	DeleteMembership(org, uid uint) error
+	ListOrgCards(org uint) ([]Card, error)
+	AppendAudit(entry AuditEntry) error
+	ListAudit(filter AuditFilter) ([]AuditEntry, error)
+	// Deletes entries created before given time; the only way entries are
+	// removed
+	DeleteAuditBefore(t time.Time) (int64, error)
+	// Adds counters to the stored ones of the same card and day
+	AddCardStats(stats []CardStat) error
+	// Counters of card since given day, oldest first
+	ListCardStats(cid uint, from time.Time) ([]CardStat, error)
+	// Page of public directory
+	ListDirectory(q DirectoryQuery) ([]Card, error)
 }
 
 type ByID []Card
@@ -69,32 +393,48 @@ func (a ByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
 
 type PGDB struct {
-	DB              *gorm.DB
-	Storage         *BlobStorage
-	DefaultUserType uint
-	admins          []string
+	DB          *gorm.DB
+	Storage     *BlobStorage
+	DefaultRole Role
+	admins      []string
 }
 
 func (db *PGDB) SignUser(pid, name string) (string, error) {
-	var user User
+	var uid uint
 
-	result := db.DB.Where("provider_id = ?", pid).First(&user)
-	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			typ := db.DefaultUserType
-			if slices.Contains(db.admins, pid) {
-				typ = UserTypeAdmin
-			}
-			user = User{ProviderID: pid, Name: name, Type: typ}
-			result = db.DB.Create(&user)
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		identity := Identity{}
+		result := tx.Where("provider_id = ?", pid).First(&identity)
+		if result.Error == nil {
+			uid = identity.UserID
+			return nil
+		}
+		if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return result.Error
 		}
-	}
 
-	if result.Error != nil {
-		return "", result.Error
+		role := db.DefaultRole
+		if slices.Contains(db.admins, pid) {
+			role = RoleAdmin
+		}
+		user := User{ProviderID: pid, Name: name, Role: role}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		uid = user.ID
+		return tx.Create(&Identity{
+			ProviderID: pid,
+			UserID:     user.ID,
+			Name:       name,
+			CreatedAt:  time.Now(),
+		}).Error
+	})
+
+	if err != nil {
+		return "", err
 	}
 
-	return strconv.FormatUint(uint64(user.ID), 10), nil
+	return strconv.FormatUint(uint64(uid), 10), nil
 }
 
 func (db *PGDB) GetUser(user *User) error {
@@ -103,24 +443,36 @@ func (db *PGDB) GetUser(user *User) error {
 }
 
 func (db *PGDB) DeleteUser(id uint) error {
-	user := User{ID: uint(id)}
-
-	result := db.DB.Delete(&user)
-	if result.Error != nil {
-		return result.Error
-	}
-
 	cards, err := db.ListCards(id)
 	if err != nil {
 		return err
 	}
 	for _, card := range cards {
-		e := db.DeleteCard(card.ID)
-		if e != nil {
-			err = e
+		if err := db.DeleteCard(card.ID); err != nil {
+			return err
 		}
 	}
-	return err
+
+	if err := db.DeleteUserSessions(id); err != nil {
+		return err
+	}
+
+	result := db.DB.Where("user_id = ?", id).Delete(&Identity{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	result = db.DB.Where("user_id = ?", id).Delete(&Passkey{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	result = db.DB.Where("user_id = ?", id).Delete(&Membership{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return db.DB.Delete(&User{ID: id}).Error
 }
 
 func (db *PGDB) CreateCard(owner uint, fields CardFields) (Card, error) {
@@ -149,13 +501,22 @@ func (db *PGDB) GetCard(id uint) (Card, error) {
 }
 
 func (db *PGDB) DeleteCard(id uint) error {
-	card := Card{ID: uint(id)}
-	result := db.DB.Delete(&card)
+	card := Card{}
+	if err := db.DB.First(&card, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
 
-	db.Storage.DelKey(context.Background(), card.Avatar)
-	db.Storage.DelKey(context.Background(), card.Logo)
+	if err := deleteCardMedia(db.Storage, card); err != nil {
+		return err
+	}
+	if err := db.DB.Where("card_id = ?", id).Delete(&CardStat{}).Error; err != nil {
+		return err
+	}
 
-	return result.Error
+	return db.DB.Delete(&card).Error
 }
 
 func (db *PGDB) ListCards(uid uint) ([]Card, error) {
@@ -166,37 +527,475 @@ func (db *PGDB) ListCards(uid uint) ([]Card, error) {
 	return cards, result.Error
 }
 
-func (db *PGDB) ListUsers() ([]User, error) {
+func (db *PGDB) ListUsersDueForDeletion(now time.Time) ([]User, error) {
 	users := []User{}
+	result := db.DB.Where("delete_at <= ?", now).Order("delete_at").Find(&users)
+	return users, result.Error
+}
+
+func (db *PGDB) ScheduleDeletion(uid uint, at *time.Time) error {
+	result := db.DB.Model(&User{ID: uid}).Update("delete_at", at)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+func (db *PGDB) Stats(since time.Time) (Stats, error) {
+	stats := Stats{
+		UsersByRole:     map[Role]int64{},
+		UsersByProvider: map[string]int64{},
+	}
 
-	result := db.DB.Find(&users)
+	roles := []struct {
+		Role  Role `gorm:"column:type"`
+		Count int64
+	}{}
+	result := db.DB.Model(&User{}).Select("type, COUNT(*) AS count").Group("type").Scan(&roles)
+	if result.Error != nil {
+		return stats, result.Error
+	}
+	for _, row := range roles {
+		stats.UsersByRole[row.Role] = row.Count
+		stats.Users += row.Count
+	}
+
+	// Same as Identity.Provider
+	providers := []struct {
+		Provider string
+		Count    int64
+	}{}
+	result = db.DB.Model(&Identity{}).Select(`CASE
+		WHEN provider_id LIKE '%::%' THEN split_part(provider_id, '::', 1)
+		WHEN provider_id LIKE 'tg:%' THEN 'telegram'
+		ELSE split_part(provider_id, ':', 1)
+	END AS provider, COUNT(DISTINCT user_id) AS count`).Group("provider").Scan(&providers)
+	if result.Error != nil {
+		return stats, result.Error
+	}
+	for _, row := range providers {
+		stats.UsersByProvider[row.Provider] = row.Count
+	}
+
+	cards := struct {
+		Cards        int64
+		HiddenCards  int64
+		MediaObjects int64
+		MediaBytes   int64
+	}{}
+	result = db.DB.Model(&Card{}).Select(`COUNT(*) AS cards,
+		COUNT(*) FILTER (WHERE is_hidden) AS hidden_cards,
+		COUNT(NULLIF(avatar, '')) + COUNT(NULLIF(logo, '')) AS media_objects,
+		COALESCE(SUM(avatar_size + logo_size), 0) AS media_bytes`).Scan(&cards)
+	if result.Error != nil {
+		return stats, result.Error
+	}
+	stats.Cards = cards.Cards
+	stats.HiddenCards = cards.HiddenCards
+	stats.MediaObjects = cards.MediaObjects
+	stats.MediaBytes = cards.MediaBytes
+
+	result = db.DB.Model(&Card{}).
+		Select("date_trunc('day', created_at) AS day, COUNT(*) AS count").
+		Where("created_at >= ?", since).
+		Group("day").
+		Order("day").
+		Scan(&stats.CardsPerDay)
+	return stats, result.Error
+}
+
+func (db *PGDB) ListDirectory(q DirectoryQuery) ([]Card, error) {
+	tx := db.DB.Model(&Card{}).
+		Select("cards.*").
+		Joins("JOIN users ON users.id = cards.owner AND users.delete_at IS NULL").
+		Joins("LEFT JOIN orgs ON orgs.id = cards.org_id").
+		Where("cards.listed AND NOT cards.is_hidden")
+	if q.Company != "" {
+		tx = tx.Where(
+			"COALESCE(NULLIF(cards.company, ''), orgs.name, '') ILIKE ?",
+			"%"+escapeLike(q.Company)+"%",
+		)
+	}
+	if q.Position != "" {
+		tx = tx.Where("cards.position ILIKE ?", "%"+escapeLike(q.Position)+"%")
+	}
+	if q.BeforeID != 0 {
+		tx = tx.Where("cards.id < ?", q.BeforeID)
+	}
+	if q.Limit > 0 {
+		tx = tx.Limit(q.Limit)
+	}
+
+	cards := []Card{}
+	result := tx.Order("cards.id DESC").Find(&cards)
+	return cards, result.Error
+}
+
+// Escapes LIKE pattern wildcards
+func escapeLike(str string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(str)
+}
+
+func (db *PGDB) SearchUsers(q UserQuery) ([]UserSummary, error) {
+	counted := db.DB.Model(&User{}).
+		Select("users.*, (SELECT COUNT(*) FROM cards WHERE cards.owner = users.id) AS cards")
+	tx := db.DB.Table("(?) AS u", counted)
+
+	if q.Search != "" {
+		tx = tx.Where("u.name ILIKE ?", "%"+escapeLike(q.Search)+"%")
+	}
+	if q.Role != nil {
+		tx = tx.Where("u.type = ?", *q.Role)
+	}
+	if q.Provider != "" {
+		tx = tx.Where(
+			"EXISTS (SELECT 1 FROM identities WHERE identities.user_id = u.id AND identities.provider_id LIKE ?)",
+			escapeLike(IdentityPrefix(q.Provider))+"%",
+		)
+	}
+
+	op, dir := ">", "ASC"
+	if q.Desc {
+		op, dir = "<", "DESC"
+	}
+	col, value := "u.id", any(nil)
+	switch q.Sort {
+	case "name":
+		col = "u.name"
+		if q.After != nil {
+			value = q.After.Name
+		}
+	case "cards":
+		col = "u.cards"
+		if q.After != nil {
+			value = q.After.Cards
+		}
+	}
+	if q.After != nil {
+		if value == nil {
+			tx = tx.Where("u.id "+op+" ?", q.After.ID)
+		} else {
+			tx = tx.Where(fmt.Sprintf("(%s, u.id) %s (?, ?)", col, op), value, q.After.ID)
+		}
+	}
+	if q.Limit > 0 {
+		tx = tx.Limit(q.Limit)
+	}
+
+	users := []UserSummary{}
+	result := tx.Order(col + " " + dir).Order("u.id " + dir).Find(&users)
 	return users, result.Error
 }
 
-func SetupDB(ctx context.Context, store *BlobStorage, log *logrus.Logger) Database {
-	dut_str := os.Getenv("DEFAULT_USER_TYPE")
-	var dut uint = UserTypeLimited
-	if dut_str != "" {
-		d, err := strconv.Atoi(dut_str)
-		dut = uint(d)
-		if err != nil {
-			log.Fatalf("Failed to parse DEFAULT_USER_TYPE: %s", dut_str)
+func (db *PGDB) LinkIdentity(uid uint, pid, name string) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		identity := Identity{}
+		result := tx.Where("provider_id = ?", pid).First(&identity)
+		if result.Error == nil {
+			if identity.UserID != uid {
+				return ErrIdentityTaken
+			}
+			return nil
+		}
+		if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return result.Error
+		}
+		return tx.Create(&Identity{
+			ProviderID: pid,
+			UserID:     uid,
+			Name:       name,
+			CreatedAt:  time.Now(),
+		}).Error
+	})
+}
+
+func (db *PGDB) UnlinkIdentity(uid uint, pid string) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		identities := []Identity{}
+		result := tx.Where("user_id = ?", uid).Order("created_at").Find(&identities)
+		if result.Error != nil {
+			return result.Error
+		}
+		rest := slices.DeleteFunc(identities, func(i Identity) bool {
+			return i.ProviderID == pid
+		})
+		if len(rest) == 0 {
+			return ErrLastIdentity
 		}
+		result = tx.Where("user_id = ? AND provider_id = ?", uid, pid).Delete(&Identity{})
+		if result.Error != nil {
+			return result.Error
+		}
+		// Keep User.ProviderID pointing to linked identity
+		return tx.Model(&User{}).
+			Where("id = ? AND provider_id = ?", uid, pid).
+			Update("provider_id", rest[0].ProviderID).Error
+	})
+}
+
+func (db *PGDB) ListIdentities(uid uint) ([]Identity, error) {
+	identities := []Identity{}
+	result := db.DB.Where("user_id = ?", uid).Order("created_at").Find(&identities)
+	return identities, result.Error
+}
+
+func (db *PGDB) MergeUsers(dst, src uint) error {
+	if dst == src {
+		return fmt.Errorf("can't merge user %d with itself", dst)
+	}
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		into := User{ID: dst}
+		if err := tx.First(&into).Error; err != nil {
+			return err
+		}
+		from := User{ID: src}
+		if err := tx.First(&from).Error; err != nil {
+			return err
+		}
+		if from.Subscription.Active(time.Now()) {
+			return ErrSubscribed
+		}
+		result := tx.Model(&Identity{}).Where("user_id = ?", src).Update("user_id", dst)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Model(&Card{}).Where("owner = ?", src).Update("owner", dst)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Model(&Passkey{}).Where("user_id = ?", src).Update("user_id", dst)
+		if result.Error != nil {
+			return result.Error
+		}
+		// Orgs both users are members of keep membership of dst
+		result = tx.Model(&Membership{}).
+			Where("user_id = ? AND org_id NOT IN (?)", src,
+				tx.Model(&Membership{}).Select("org_id").Where("user_id = ?", dst)).
+			Update("user_id", dst)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Where("user_id = ?", src).Delete(&Membership{})
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Where("user_id = ?", src).Delete(&Session{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if into.Lang == "" {
+			into.Lang = from.Lang
+		}
+		into.Plan = betterPlan(into.Plan, from.Plan)
+		if err := tx.Save(&into).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&from).Error
+	})
+}
+
+func (db *PGDB) CreateSession(sess Session) error {
+	return db.DB.Create(&sess).Error
+}
+
+func (db *PGDB) GetSession(id string) (Session, error) {
+	sess := Session{}
+	result := db.DB.Where("id = ?", id).First(&sess)
+	return sess, result.Error
+}
+
+func (db *PGDB) UpdateSession(sess Session) error {
+	return db.DB.Save(&sess).Error
+}
+
+func (db *PGDB) ListSessions(uid uint) ([]Session, error) {
+	list := []Session{}
+	result := db.DB.Where("user_id = ?", uid).Order("last_seen desc").Find(&list)
+	return list, result.Error
+}
+
+func (db *PGDB) DeleteSession(id string) error {
+	return db.DB.Where("id = ?", id).Delete(&Session{}).Error
+}
+
+func (db *PGDB) DeleteUserSessions(uid uint) error {
+	return db.DB.Where("user_id = ?", uid).Delete(&Session{}).Error
+}
+
+func (db *PGDB) DeleteExpiredSessions(idle, created time.Time) error {
+	return db.DB.Where("last_seen < ? OR created_at < ?", idle, created).Delete(&Session{}).Error
+}
+
+func (db *PGDB) CreatePasskey(key Passkey) error {
+	return db.DB.Create(&key).Error
+}
+
+func (db *PGDB) GetPasskey(id string) (Passkey, error) {
+	key := Passkey{}
+	result := db.DB.Where("id = ?", id).First(&key)
+	return key, result.Error
+}
+
+func (db *PGDB) UpdatePasskey(key Passkey) error {
+	return db.DB.Save(&key).Error
+}
+
+func (db *PGDB) ListPasskeys(uid uint) ([]Passkey, error) {
+	keys := []Passkey{}
+	result := db.DB.Where("user_id = ?", uid).Order("created_at").Find(&keys)
+	return keys, result.Error
+}
+
+func (db *PGDB) DeletePasskey(uid uint, id string) error {
+	result := db.DB.Where("user_id = ? AND id = ?", uid, id).Delete(&Passkey{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
 	}
+	return nil
+}
 
-	admins := strings.Split(os.Getenv("ADMINS"), ";")
+func (db *PGDB) CreateLoginToken(token LoginToken) error {
+	return db.DB.Create(&token).Error
+}
 
-	host := os.Getenv("PG_HOST")
-	port := os.Getenv("PG_PORT")
-	user := os.Getenv("PG_USER")
-	password := os.Getenv("PG_PASSWORD")
-	dbname := os.Getenv("PG_NAME")
-	sslmode := os.Getenv("PG_SSLMODE")
-	timezone := os.Getenv("PG_TIMEZONE")
+func (db *PGDB) UseLoginToken(id string) (LoginToken, error) {
+	token := LoginToken{}
+	result := db.DB.Clauses(clause.Returning{}).Where("id = ?", id).Delete(&token)
+	if result.Error != nil {
+		return token, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return token, gorm.ErrRecordNotFound
+	}
+	return token, nil
+}
+
+func (db *PGDB) DeleteExpiredLoginTokens(now time.Time) error {
+	return db.DB.Where("expires_at < ?", now).Delete(&LoginToken{}).Error
+}
+
+func (db *PGDB) ProcessBillingEvent(event BillingEvent) error {
+	found := true
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ProcessedEvent{
+			ID:     event.ID,
+			UserID: event.UserID,
+			Type:   event.Type,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrEventProcessed
+		}
+
+		user := User{ID: event.UserID}
+		result = tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			// Keep event recorded, so redelivery is acknowledged too
+			found = false
+			return nil
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+		user.Subscription.Apply(event)
+		return tx.Save(&user).Error
+	})
+	if err == nil && !found {
+		return ErrEventNoUser
+	}
+	return err
+}
+
+func (db *PGDB) CreateOrg(org Org, admin uint) (Org, error) {
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&org).Error; err != nil {
+			return err
+		}
+		return tx.Create(&Membership{OrgID: org.ID, UserID: admin, Role: OrgAdmin}).Error
+	})
+	return org, err
+}
+
+func (db *PGDB) GetOrg(id uint) (Org, error) {
+	org := Org{ID: id}
+	result := db.DB.First(&org)
+	return org, result.Error
+}
+
+func (db *PGDB) UpdateOrg(org Org) error {
+	return db.DB.Save(&org).Error
+}
+
+func (db *PGDB) DeleteOrg(id uint) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Card{}).Where("org_id = ?", id).Update("org_id", 0)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Where("org_id = ?", id).Delete(&Membership{})
+		if result.Error != nil {
+			return result.Error
+		}
+		return tx.Delete(&Org{ID: id}).Error
+	})
+}
+
+func (db *PGDB) FindOrgByInvite(code string) (Org, error) {
+	org := Org{}
+	result := db.DB.Where("invite_code = ?", code).First(&org)
+	return org, result.Error
+}
+
+func (db *PGDB) ListOrgs(uid uint) ([]Org, error) {
+	orgs := []Org{}
+	result := db.DB.
+		Where("id IN (?)", db.DB.Model(&Membership{}).Select("org_id").Where("user_id = ?", uid)).
+		Order("name").
+		Find(&orgs)
+	return orgs, result.Error
+}
 
-	if host == "" {
+func (db *PGDB) GetMembership(org, uid uint) (Membership, error) {
+	m := Membership{}
+	result := db.DB.Where("org_id = ? AND user_id = ?", org, uid).First(&m)
+	return m, result.Error
+}
+
+func (db *PGDB) ListMembers(org uint) ([]Membership, error) {
+	members := []Membership{}
+	result := db.DB.Where("org_id = ?", org).Order("created_at").Find(&members)
+	return members, result.Error
+}
+
+func (db *PGDB) SaveMembership(m Membership) error {
+	return db.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&m).Error
+}
+
+func (db *PGDB) DeleteMembership(org, uid uint) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Card{}).Where("org_id = ? AND owner = ?", org, uid).Update("org_id", 0)
+		if result.Error != nil {
+			return result.Error
+		}
+		return tx.Where("org_id = ? AND user_id = ?", org, uid).Delete(&Membership{}).Error
+	})
+}
+
+func (db *PGDB) ListOrgCards(org uint) ([]Card, error) {
+	cards := []Card{}
+	result := db.DB.Where("org_id = ?", org).Order("id").Find(&cards)
+	return cards, result.Error
+}
+
+func SetupDB(ctx context.Context, store *BlobStorage, log *logrus.Logger, cfg DBConfig) Database {
+	if cfg.Host == "" {
 		log.Warn("No config SQL DB; Using ramdb.")
-		db, err := LoadRamDb(ctx, log, store, "DB.json", dut, admins)
+		db, err := LoadRamDb(ctx, log, store, "DB.json", cfg.DefaultRole, cfg.Admins)
 		if err != nil {
 			log.WithFields(logrus.Fields{
 				"err": err,
@@ -206,13 +1005,14 @@ func SetupDB(ctx context.Context, store *BlobStorage, log *logrus.Logger) Databa
 		return db
 	}
 
-	if timezone != "" {
-		timezone = "TimeZone=" + timezone
+	timezone := ""
+	if cfg.TimeZone != "" {
+		timezone = "TimeZone=" + cfg.TimeZone
 	}
 
 	dsn := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s %s",
-		host, port, user, password, dbname, sslmode, timezone,
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s %s",
+		cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.Name, cfg.SSLMode, timezone,
 	)
 
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
@@ -237,11 +1037,142 @@ func SetupDB(ctx context.Context, store *BlobStorage, log *logrus.Logger) Databa
 			"err": err,
 		}).Fatal("Failed to setup DB client")
 	}
+	err = db.AutoMigrate(&Session{})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatal("Failed to setup DB client")
+	}
+	err = db.AutoMigrate(&Identity{})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatal("Failed to setup DB client")
+	}
+	err = db.AutoMigrate(&LoginToken{})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatal("Failed to setup DB client")
+	}
+	err = db.AutoMigrate(&Passkey{})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatal("Failed to setup DB client")
+	}
+	err = db.AutoMigrate(&ProcessedEvent{})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatal("Failed to setup DB client")
+	}
+	err = db.AutoMigrate(&Org{}, &Membership{})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatal("Failed to setup DB client")
+	}
+	err = db.AutoMigrate(&AuditEntry{})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatal("Failed to setup DB client")
+	}
+	err = db.AutoMigrate(&CardStat{})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatal("Failed to setup DB client")
+	}
+	// Users created before identities were introduced
+	err = db.Exec(`
+		INSERT INTO identities (provider_id, user_id, name, created_at)
+		SELECT provider_id, id, name, NOW() FROM users WHERE provider_id <> ''
+		ON CONFLICT DO NOTHING
+	`).Error
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatal("Failed to migrate user identities")
+	}
 
 	return &PGDB{
-		DB:              db,
-		Storage:         store,
-		DefaultUserType: dut,
-		admins:          admins,
+		DB:          db,
+		Storage:     store,
+		DefaultRole: cfg.DefaultRole,
+		admins:      cfg.Admins,
+	}
+}
+
+func (db *PGDB) AppendAudit(entry AuditEntry) error {
+	return db.DB.Create(&entry).Error
+}
+
+func (db *PGDB) ListAudit(f AuditFilter) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	q := db.DB.Order("id DESC")
+	if f.ActorID != 0 {
+		q = q.Where("actor_id = ?", f.ActorID)
+	}
+	if f.Action != "" {
+		q = q.Where("action = ?", f.Action)
+	}
+	if f.Target != "" {
+		q = q.Where("target = ?", f.Target)
+	}
+	if !f.From.IsZero() {
+		q = q.Where("created_at >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		q = q.Where("created_at < ?", f.To)
+	}
+	if f.BeforeID != 0 {
+		q = q.Where("id < ?", f.BeforeID)
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+	result := q.Find(&entries)
+	return entries, result.Error
+}
+
+func (db *PGDB) DeleteAuditBefore(t time.Time) (int64, error) {
+	result := db.DB.Where("created_at < ?", t).Delete(&AuditEntry{})
+	return result.RowsAffected, result.Error
+}
+
+func (db *PGDB) AddCardStats(stats []CardStat) error {
+	if len(stats) == 0 {
+		return nil
+	}
+	return db.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "card_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"views":    gorm.Expr("card_stats.views + excluded.views"),
+			"visitors": gorm.Expr("card_stats.visitors + excluded.visitors"),
+			"scans":    gorm.Expr("card_stats.scans + excluded.scans"),
+			"v_cards":  gorm.Expr("card_stats.v_cards + excluded.v_cards"),
+			"installs": gorm.Expr("card_stats.installs + excluded.installs"),
+		}),
+	}).Create(&stats).Error
+}
+
+func (db *PGDB) ListCardStats(cid uint, from time.Time) ([]CardStat, error) {
+	stats := []CardStat{}
+	result := db.DB.Where("card_id = ? AND day >= ?", cid, from).Order("day").Find(&stats)
+	return stats, result.Error
+}
+
+// Deletes avatar and logo of card from storage
+func deleteCardMedia(storage *BlobStorage, card Card) error {
+	for _, key := range []string{card.Avatar, card.Logo} {
+		if key == "" {
+			continue
+		}
+		if err := storage.DelKey(context.Background(), key); err != nil {
+			return fmt.Errorf("delete %s: %w", key, err)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Schedules erasure of own account after grace period and signs user out
+// everywhere. Logging in again cancels the deletion.
+func (h *Handler) userDelRoute(c *gin.Context) {
+	user := getUser(c)
+
+	deleteAt := time.Now().Add(h.cfg.Deletion.GracePeriod).Truncate(time.Second)
+	// User from context may have restricted role, so only deletion time
+	// is saved
+	if err := h.db.ScheduleDeletion(user.ID, &deleteAt); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"uid": user.ID,
+		}).Error("Failed to schedule user deletion")
+		h.errorBlock(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedTODeleteUser"),
+		)
+		return
+	}
+	h.audit(c, user.ID, AuditDeletionScheduled, auditTarget("user", user.ID), map[string]any{
+		"delete_at": deleteAt,
+	})
+	h.gallery.purge()
+
+	if err := h.db.DeleteUserSessions(user.ID); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"uid": user.ID,
+		}).Error("Failed to revoke sessions")
+	}
+	h.endSession(c)
+	redirect(c, "/")
+}
+
+// Cancels scheduled deletion of user that logged in
+func (h *Handler) cancelDeletion(c *gin.Context, user *User) {
+	if !user.DeletionScheduled() {
+		return
+	}
+	deleteAt := *user.DeleteAt
+	if err := h.db.ScheduleDeletion(user.ID, nil); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"uid": user.ID,
+		}).Error("Failed to cancel user deletion")
+		return
+	}
+	user.DeleteAt = nil
+	h.gallery.purge()
+	h.audit(c, user.ID, AuditDeletionCancelled, auditTarget("user", user.ID), map[string]any{
+		"delete_at": deleteAt,
+	})
+	h.log.WithFields(logrus.Fields{
+		"uid": user.ID,
+	}).Info("User deletion cancelled by login")
+}
+
+// Hard deletes user with all their rows and blobs, checks that nothing is
+// left and writes erasure receipt to audit log. Actor is 0 when erasure
+// is done after grace period.
+func (h *Handler) eraseUser(uid, actor uint, ip string) error {
+	user := User{ID: uid}
+	if err := h.db.GetUser(&user); err != nil {
+		return err
+	}
+	cards, err := h.db.ListCards(uid)
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for _, card := range cards {
+		for _, key := range []string{card.Avatar, card.Logo} {
+			if key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	if h.billing != nil && user.Subscription.Active(time.Now()) {
+		if err := h.billing.Cancel(user); err != nil {
+			return fmt.Errorf("cancel subscription: %w", err)
+		}
+	}
+	if job, ok := h.exports.get(uid); ok && job.Status == exportPending {
+		return fmt.Errorf("export of user %d is in progress", uid)
+	}
+	// Older archives may be left from previous jobs or before restart
+	exports, err := h.deleteExports(uid)
+	keys = append(keys, exports...)
+	if err != nil {
+		return err
+	}
+	h.exports.remove(uid)
+
+	err = h.db.DeleteUser(uid)
+	h.gallery.purge()
+	if err != nil {
+		return err
+	}
+	if err := h.verifyErased(uid, keys); err != nil {
+		return err
+	}
+
+	// Receipt holds no personal data, only what was erased
+	return h.appendAudit(AuditEntry{
+		ActorID: actor,
+		Action:  AuditUserErased,
+		Target:  auditTarget("user", uid),
+		IP:      ip,
+	}, map[string]any{
+		"cards":     len(cards),
+		"blobs":     len(keys),
+		"delete_at": user.DeleteAt,
+		"verified":  true,
+	})
+}
+
+// Checks that user rows and blobs are gone
+func (h *Handler) verifyErased(uid uint, keys []string) error {
+	if err := h.db.GetUser(&User{ID: uid}); err == nil {
+		return fmt.Errorf("user %d still exists", uid)
+	}
+	left := map[string]int{}
+	cards, err := h.db.ListCards(uid)
+	left["cards"] = len(cards)
+	if err == nil {
+		var identities []Identity
+		identities, err = h.db.ListIdentities(uid)
+		left["identities"] = len(identities)
+	}
+	if err == nil {
+		var list []Session
+		list, err = h.db.ListSessions(uid)
+		left["sessions"] = len(list)
+	}
+	if err == nil {
+		var passkeys []Passkey
+		passkeys, err = h.db.ListPasskeys(uid)
+		left["passkeys"] = len(passkeys)
+	}
+	if err == nil {
+		var orgs []Org
+		orgs, err = h.db.ListOrgs(uid)
+		left["memberships"] = len(orgs)
+	}
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		exists, err := h.storage.Exists(h.ctx, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			left["blobs"]++
+		}
+	}
+	for kind, n := range left {
+		if n > 0 {
+			return fmt.Errorf("user %d erasure incomplete: %d %s left", uid, n, kind)
+		}
+	}
+	return nil
+}
+
+// Periodically erases accounts whose grace period has passed. Failed
+// erasures are retried on next run.
+func (h *Handler) runDeletions() {
+	go func() {
+		ticker := time.NewTicker(h.cfg.Deletion.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.ctx.Done():
+				return
+			case now := <-ticker.C:
+				users, err := h.db.ListUsersDueForDeletion(now)
+				if err != nil {
+					h.log.WithFields(logrus.Fields{
+						"err": err,
+					}).Error("Failed to list users due for deletion")
+					continue
+				}
+				for _, user := range users {
+					if err := h.eraseUser(user.ID, 0, ""); err != nil {
+						h.log.WithFields(logrus.Fields{
+							"err": err,
+							"uid": user.ID,
+						}).Error("Failed to erase user")
+						continue
+					}
+					h.log.WithFields(logrus.Fields{
+						"uid": user.ID,
+					}).Info("User erased")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const emailProviderPrefix = "email::"
+
+// Passwordless login with links sent by email
+type EmailLoginConfig struct {
+	Secret    []byte
+	TTL       time.Duration
+	PublicURL string // Links are built from it, never from request Host
+}
+
+func SetupEmailLogin(cfg *Config, mailer Mailer) *EmailLoginConfig {
+	if mailer == nil {
+		return nil
+	}
+
+	secret := cfg.Mail.LinkSecret
+	if secret == "" {
+		secret = cfg.Server.SessionSecret
+	}
+
+	return &EmailLoginConfig{
+		Secret:    []byte(secret),
+		TTL:       cfg.Mail.LinkTTL,
+		PublicURL: cfg.PublicURL,
+	}
+}
+
+func (cfg *EmailLoginConfig) sign(nonce, email string, expires time.Time) []byte {
+	mac := hmac.New(sha256.New, cfg.Secret)
+	fmt.Fprintf(mac, "%s|%s|%d", nonce, email, expires.Unix())
+	return mac.Sum(nil)
+}
+
+// Creates login token for email. Returned token is "<nonce>.<signature>";
+// only hash of the nonce is stored in DB.
+func (cfg *EmailLoginConfig) newToken(email string) (string, LoginToken, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", LoginToken{}, err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(buf)
+	stored := LoginToken{
+		ID:        hashSessionToken(nonce),
+		Email:     email,
+		ExpiresAt: time.Now().Add(cfg.TTL).Truncate(time.Second),
+	}
+	sig := base64.RawURLEncoding.EncodeToString(cfg.sign(nonce, email, stored.ExpiresAt))
+	return nonce + "." + sig, stored, nil
+}
+
+func splitLoginToken(token string) (nonce string, sig []byte, err error) {
+	nonce, sigStr, ok := strings.Cut(token, ".")
+	if !ok || nonce == "" {
+		return "", nil, errors.New("malformed login token")
+	}
+	sig, err = base64.RawURLEncoding.DecodeString(sigStr)
+	return nonce, sig, err
+}
+
+// Normalizes bare email address; addresses with display names are rejected
+func parseEmail(str string) (string, bool) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	addr, err := mail.ParseAddress(str)
+	if err != nil || addr.Address != str || addr.Name != "" {
+		return "", false
+	}
+	return str, true
+}
+
+// Periodically removes expired login tokens from DB
+func (h *Handler) runLoginTokenCleanup() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := h.db.DeleteExpiredLoginTokens(now); err != nil {
+					h.log.WithFields(logrus.Fields{
+						"err": err,
+					}).Error("Failed to delete expired login tokens")
+				}
+			}
+		}
+	}()
+}
+
+func (h *Handler) loginEmailRoute(c *gin.Context) {
+	h.execHTML(c, http.StatusOK, "page_login_email.html", gin.H{
+		"Title": h.localize(c, "TitleEmailLogin"),
+	})
+}
+
+// Sends login link. Response is the same whether account exists or not.
+func (h *Handler) sendLoginEmailRoute(c *gin.Context) {
+	email, ok := parseEmail(c.PostForm("email"))
+	if !ok {
+		h.errorPage(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgInvalidEmail"),
+		)
+		return
+	}
+
+	if policy := h.limits.Email; policy != nil {
+		ok, wait := h.limiter.Take("email:addr:"+email, policy.Rate, policy.Burst)
+		if !ok {
+			h.log.WithFields(logrus.Fields{
+				"email": email,
+			}).Warn("Email login rate limit exceeded")
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			h.errorPage(c, http.StatusTooManyRequests, "")
+			return
+		}
+	}
+
+	token, stored, err := h.emailLogin.newToken(email)
+	if err == nil {
+		err = h.db.CreateLoginToken(stored)
+	}
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to create login token")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToSendEmail"),
+		)
+		return
+	}
+
+	lang := c.MustGet("Lang").(string)
+	link := h.emailLogin.PublicURL + "/auth-email?token=" + url.QueryEscape(token)
+	err = h.mailer.Send(
+		email,
+		h.localizer("EmailLoginSubject", lang),
+		h.localizer(
+			"EmailLoginBody", lang,
+			"Link", link,
+			"Minutes", int(h.emailLogin.TTL.Minutes()),
+		),
+	)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to send login email")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToSendEmail"),
+		)
+		return
+	}
+
+	h.execHTML(c, http.StatusOK, "page_login_email.html", gin.H{
+		"Title": h.localize(c, "TitleEmailLogin"),
+		"Sent":  email,
+	})
+}
+
+// Asks to confirm login instead of signing in right away, because
+// mail scanners may follow links and burn single use tokens
+func (h *Handler) confirmEmailLoginRoute(c *gin.Context) {
+	h.execHTML(c, http.StatusOK, "page_login_email.html", gin.H{
+		"Title": h.localize(c, "TitleEmailLogin"),
+		"Token": c.Query("token"),
+	})
+}
+
+func (h *Handler) authEmailRoute(c *gin.Context) {
+	invalid := func() {
+		h.errorPage(
+			c,
+			http.StatusUnauthorized,
+			h.localize(c, "ErrMsgInvalidLoginLink"),
+		)
+	}
+
+	nonce, sig, err := splitLoginToken(c.PostForm("token"))
+	if err != nil {
+		invalid()
+		return
+	}
+
+	stored, err := h.db.UseLoginToken(hashSessionToken(nonce))
+	if err != nil {
+		invalid()
+		return
+	}
+	expected := h.emailLogin.sign(nonce, stored.Email, stored.ExpiresAt)
+	if !hmac.Equal(sig, expected) || time.Now().After(stored.ExpiresAt) {
+		h.log.WithFields(logrus.Fields{
+			"email": stored.Email,
+		}).Warn("Invalid or expired login link")
+		invalid()
+		return
+	}
+
+	name, _, _ := strings.Cut(stored.Email, "@")
+	h.signIn(c, emailProviderPrefix+stored.Email, name, nil)
+}
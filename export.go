@@ -0,0 +1,392 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+// Personal data archive of user. Jobs are tracked in memory; archives are
+// kept in BlobStorage until download link expires and then swept by
+// runExportCleanup, which doesn't depend on jobs, so archives left by
+// restart are removed too.
+type exportJob struct {
+	ID      string
+	Status  string
+	Created time.Time
+	Expires time.Time // Of download link; set when archive is ready
+}
+
+func exportKey(uid uint, id string) string {
+	return fmt.Sprintf("exports/%d-%s.zip", uid, id)
+}
+
+// Prefix of all archives of user
+func exportPrefix(uid uint) string {
+	return fmt.Sprintf("exports/%d-", uid)
+}
+
+type exportStore struct {
+	mu   sync.Mutex
+	jobs map[uint]exportJob // User ID -> latest export
+}
+
+func newExportStore() *exportStore {
+	return &exportStore{jobs: map[uint]exportJob{}}
+}
+
+func (s *exportStore) get(uid uint) (exportJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[uid]
+	return job, ok
+}
+
+func (s *exportStore) set(uid uint, job exportJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[uid] = job
+}
+
+func (s *exportStore) remove(uid uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, uid)
+}
+
+// Registers new job unless user already has pending one
+func (s *exportStore) start(uid uint) (exportJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[uid]; ok && job.Status == exportPending {
+		return job, false
+	}
+	job := exportJob{
+		ID:      uuid.New().String(),
+		Status:  exportPending,
+		Created: time.Now(),
+	}
+	s.jobs[uid] = job
+	return job, true
+}
+
+func escapeVCard(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`).Replace(value)
+}
+
+// vCard 3.0 of card, same as the one generated in browser with extra fields
+func cardVCard(card Card, publicURL string) string {
+	b := &strings.Builder{}
+	line := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(b, "%s:%s\r\n", name, value)
+		}
+	}
+	f := card.Fields
+	line("BEGIN", "VCARD")
+	line("VERSION", "3.0")
+	line("FN", escapeVCard(f.Name))
+	line("ORG", escapeVCard(f.Company))
+	line("TITLE", escapeVCard(f.Position))
+	line("NOTE", escapeVCard(f.Description))
+	line("TEL", escapeVCard(f.Phone))
+	line("EMAIL", escapeVCard(f.Email))
+	if f.Telegram != "" {
+		line("URL", "https://t.me/"+escapeVCard(f.Telegram))
+	}
+	line("URL", escapeVCard(f.Whatsapp))
+	line("URL", escapeVCard(f.VK))
+	if publicURL != "" {
+		line("URL", fmt.Sprintf("%s/c/%d", strings.TrimSuffix(publicURL, "/"), card.ID))
+	}
+	line("END", "VCARD")
+	return b.String()
+}
+
+// Writes archive with user record, identities, cards as JSON and vCards,
+// and original avatar and logo files
+func (h *Handler) writeExport(w io.Writer, uid uint) error {
+	user := User{ID: uid}
+	if err := h.db.GetUser(&user); err != nil {
+		return err
+	}
+	identities, err := h.db.ListIdentities(uid)
+	if err != nil {
+		return err
+	}
+	cards, err := h.db.ListCards(uid)
+	if err != nil {
+		return err
+	}
+
+	z := zip.NewWriter(w)
+	writeJSON := func(name string, value any) error {
+		f, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(value)
+	}
+
+	if err := writeJSON("user.json", user); err != nil {
+		return err
+	}
+	if err := writeJSON("identities.json", identities); err != nil {
+		return err
+	}
+	if err := writeJSON("cards.json", cards); err != nil {
+		return err
+	}
+	for _, card := range cards {
+		f, err := z.Create(fmt.Sprintf("vcards/%d.vcf", card.ID))
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, cardVCard(card, h.cfg.PublicURL)); err != nil {
+			return err
+		}
+		for _, key := range []string{card.Avatar, card.Logo} {
+			if key == "" {
+				continue
+			}
+			if err := h.exportBlob(z, key); err != nil {
+				return err
+			}
+		}
+	}
+	return z.Close()
+}
+
+func (h *Handler) exportBlob(z *zip.Writer, key string) error {
+	_, reader, err := h.storage.GetKey(h.ctx, key, false)
+	if reader != nil {
+		defer reader.Close()
+	}
+	if err != nil {
+		return err
+	}
+	f, err := z.Create(path.Join("media", path.Base(key)))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, reader)
+	return err
+}
+
+// Builds archive in temp file, so large accounts don't eat memory, and
+// uploads it to BlobStorage
+func (h *Handler) runExport(uid uint, job exportJob) {
+	log := h.log.WithFields(logrus.Fields{
+		"uid":    uid,
+		"export": job.ID,
+	})
+
+	err := func() error {
+		tmp, err := os.CreateTemp("", "cards-export-*.zip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if err := h.writeExport(tmp, uid); err != nil {
+			return err
+		}
+		size, err := tmp.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return h.storage.WriteKey(h.ctx, exportKey(uid, job.ID), tmp, size, false)
+	}()
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("Failed to export user data")
+		job.Status = exportFailed
+		h.exports.set(uid, job)
+		return
+	}
+
+	job.Status = exportReady
+	job.Expires = time.Now().Add(h.cfg.Export.LinkTTL).Truncate(time.Second)
+	h.exports.set(uid, job)
+	log.Info("User data exported")
+}
+
+// Deletes all archives of user and returns their keys
+func (h *Handler) deleteExports(uid uint) ([]string, error) {
+	list, err := h.storage.ListKeys(h.ctx, exportPrefix(uid))
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, blob := range list {
+		if err := h.storage.DelKey(h.ctx, blob.Key); err != nil {
+			return keys, err
+		}
+		keys = append(keys, blob.Key)
+	}
+	return keys, nil
+}
+
+// Deletes archives whose download links have expired; returns their count
+func (h *Handler) deleteExpiredExports(now time.Time) (int, error) {
+	list, err := h.storage.ListKeys(h.ctx, "exports/")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, blob := range list {
+		// Link expires LinkTTL after upload is finished
+		if now.Sub(blob.Modified) <= h.cfg.Export.LinkTTL {
+			continue
+		}
+		if err := h.storage.DelKey(h.ctx, blob.Key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Periodically deletes expired archives
+func (h *Handler) runExportCleanup() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.ctx.Done():
+				return
+			case now := <-ticker.C:
+				n, err := h.deleteExpiredExports(now)
+				if err != nil {
+					h.log.WithFields(logrus.Fields{
+						"err": err,
+					}).Error("Failed to delete expired exports")
+				} else if n > 0 {
+					h.log.WithFields(logrus.Fields{
+						"count": n,
+					}).Info("Expired exports deleted")
+				}
+			}
+		}
+	}()
+}
+
+func (h *Handler) signExport(uid uint, id string, expires int64) []byte {
+	mac := hmac.New(sha256.New, []byte(h.cfg.Server.SessionSecret))
+	fmt.Fprintf(mac, "export|%d|%s|%d", uid, id, expires)
+	return mac.Sum(nil)
+}
+
+// Download link that works without session until job expires
+func (h *Handler) exportLink(uid uint, job exportJob) string {
+	expires := job.Expires.Unix()
+	q := url.Values{}
+	q.Set("uid", fmt.Sprint(uid))
+	q.Set("exp", fmt.Sprint(expires))
+	q.Set("sig", base64.RawURLEncoding.EncodeToString(h.signExport(uid, job.ID, expires)))
+	return "/export/download/" + job.ID + "?" + q.Encode()
+}
+
+func (h *Handler) exportRoute(c *gin.Context) {
+	user := getUser(c)
+
+	job, ok := h.exports.get(user.ID)
+	link := ""
+	if ok && job.Status == exportReady {
+		if time.Now().After(job.Expires) {
+			ok = false
+		} else {
+			link = h.exportLink(user.ID, job)
+		}
+	}
+
+	h.execHTML(c, http.StatusOK, "page_export.html", gin.H{
+		"Title":  h.localize(c, "TitleExport"),
+		"Export": job,
+		"Exists": ok,
+		"Link":   link,
+	})
+}
+
+func (h *Handler) requestExportRoute(c *gin.Context) {
+	user := getUser(c)
+
+	if job, ok := h.exports.start(user.ID); ok {
+		go h.runExport(user.ID, job)
+	}
+
+	redirect(c, "/export")
+}
+
+// Serves archive by signed link
+func (h *Handler) downloadExportRoute(c *gin.Context) {
+	id := c.Param("id")
+	uid, err := strconv.ParseUint(c.Query("uid"), 10, 64)
+	var expires int64
+	if err == nil {
+		expires, err = strconv.ParseInt(c.Query("exp"), 10, 64)
+	}
+	var sig []byte
+	if err == nil {
+		sig, err = base64.RawURLEncoding.DecodeString(c.Query("sig"))
+	}
+	if err != nil ||
+		!hmac.Equal(sig, h.signExport(uint(uid), id, expires)) ||
+		time.Now().After(time.Unix(expires, 0)) {
+		h.errorPage(
+			c,
+			http.StatusForbidden,
+			h.localize(c, "ErrMsgExportLinkExpired"),
+		)
+		return
+	}
+
+	size, reader, err := h.storage.GetKey(h.ctx, exportKey(uint(uid), id), false)
+	if reader != nil {
+		defer reader.Close()
+	}
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"uid": uid,
+		}).Error("Failed to fetch export")
+		h.errorPage(
+			c,
+			http.StatusNotFound,
+			h.localize(c, "ErrMsgExportLinkExpired"),
+		)
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="cards-export.zip"`)
+	c.Header("Cache-Control", "private, no-store")
+	c.DataFromReader(http.StatusOK, size, "application/zip", reader, nil)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestExportHandler(t *testing.T) (*Handler, *fakeS3) {
+	t.Helper()
+	storage, s3 := newTestStorage(t)
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	h := &Handler{
+		cfg:     &Config{Export: ExportConfig{LinkTTL: time.Hour}},
+		log:     log,
+		ctx:     context.Background(),
+		storage: storage,
+	}
+	return h, s3
+}
+
+func writeTestBlob(t *testing.T, storage *BlobStorage, key string) {
+	t.Helper()
+	if err := storage.WriteKey(context.Background(), key, strings.NewReader("data"), 4, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteExports(t *testing.T) {
+	h, s3 := newTestExportHandler(t)
+	for _, key := range []string{
+		exportKey(1, "old"),
+		exportKey(1, "new"),
+		exportKey(12, "other"),
+		"media/avatar/1-photo.webp",
+	} {
+		writeTestBlob(t, h.storage, key)
+	}
+
+	keys, err := h.deleteExports(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(keys)
+	if want := []string{exportKey(1, "new"), exportKey(1, "old")}; !slices.Equal(keys, want) {
+		t.Errorf("deleted %v, want %v", keys, want)
+	}
+	for _, key := range []string{exportKey(12, "other"), "media/avatar/1-photo.webp"} {
+		if _, ok := s3.objects["/cards/"+key]; !ok {
+			t.Errorf("%s deleted", key)
+		}
+	}
+}
+
+func TestDeleteExpiredExports(t *testing.T) {
+	h, s3 := newTestExportHandler(t)
+	writeTestBlob(t, h.storage, exportKey(1, "fresh"))
+	writeTestBlob(t, h.storage, exportKey(2, "expired"))
+	writeTestBlob(t, h.storage, "media/avatar/1-photo.webp")
+	now := time.Now()
+	s3.modified["/cards/"+exportKey(2, "expired")] = now.Add(-2 * time.Hour)
+	s3.modified["/cards/media/avatar/1-photo.webp"] = now.Add(-2 * time.Hour)
+
+	n, err := h.deleteExpiredExports(now)
+	if err != nil || n != 1 {
+		t.Fatalf("deleteExpiredExports = %d, %v, want 1", n, err)
+	}
+	if _, ok := s3.objects["/cards/"+exportKey(2, "expired")]; ok {
+		t.Error("expired export kept")
+	}
+	for _, key := range []string{exportKey(1, "fresh"), "media/avatar/1-photo.webp"} {
+		if _, ok := s3.objects["/cards/"+key]; !ok {
+			t.Errorf("%s deleted", key)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	galleryPageSize = 24
+	maxFragments    = 1000 // Cached gallery pages
+)
+
+type fragment struct {
+	html    []byte
+	expires time.Time
+}
+
+// Rendered HTML shared by all visitors; entries live for TTL or until purge
+type fragmentCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	items map[string]fragment
+}
+
+func newFragmentCache(ttl time.Duration) *fragmentCache {
+	return &fragmentCache{ttl: ttl, items: map[string]fragment{}}
+}
+
+func (fc *fragmentCache) get(key string) ([]byte, bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	item, ok := fc.items[key]
+	if !ok || time.Now().After(item.expires) {
+		return nil, false
+	}
+	return item.html, true
+}
+
+func (fc *fragmentCache) set(key string, html []byte) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	now := time.Now()
+	if len(fc.items) >= maxFragments {
+		for key, item := range fc.items {
+			if now.After(item.expires) {
+				delete(fc.items, key)
+			}
+		}
+	}
+	if len(fc.items) >= maxFragments {
+		fc.items = map[string]fragment{}
+	}
+	fc.items[key] = fragment{html: html, expires: now.Add(fc.ttl)}
+}
+
+// Drops all entries; called when cards change, so hidden or deleted ones
+// don't stay public until TTL passes
+func (fc *fragmentCache) purge() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.items = map[string]fragment{}
+}
+
+// Renders template to bytes, e.g. to cache it. Unlike execHTML no request
+// data like user or CSRF token is added.
+func (h *Handler) renderHTML(name string, data any) ([]byte, error) {
+	html, ok := h.g.HTMLRender.(render.HTMLProduction)
+	if !ok {
+		return nil, fmt.Errorf("unexpected HTML renderer %T", h.g.HTMLRender)
+	}
+	buf := bytes.Buffer{}
+	err := html.Template.ExecuteTemplate(&buf, name, data)
+	return buf.Bytes(), err
+}
+
+// Builds query from params: company, position and before cursor
+func parseDirectoryQuery(c *gin.Context) (DirectoryQuery, error) {
+	q := DirectoryQuery{
+		Company:  strings.TrimSpace(c.Query("company")),
+		Position: strings.TrimSpace(c.Query("position")),
+	}
+	if str := c.Query("before"); str != "" {
+		before, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			return q, err
+		}
+		q.BeforeID = uint(before)
+	}
+	return q, nil
+}
+
+// Query params of directory URL; also the cache key
+func (q DirectoryQuery) values() url.Values {
+	v := url.Values{}
+	if q.Company != "" {
+		v.Set("company", q.Company)
+	}
+	if q.Position != "" {
+		v.Set("position", q.Position)
+	}
+	if q.BeforeID != 0 {
+		v.Set("before", fmt.Sprint(q.BeforeID))
+	}
+	return v
+}
+
+// Rendered page of gallery, from cache if possible
+func (h *Handler) galleryPage(c *gin.Context, q DirectoryQuery) ([]byte, error) {
+	lang := c.MustGet("Lang").(string)
+	key := lang + "?" + q.values().Encode()
+	if html, ok := h.gallery.get(key); ok {
+		return html, nil
+	}
+
+	q.Limit = galleryPageSize + 1 // One more to know if there is next page
+	cards, err := h.db.ListDirectory(q)
+	if err != nil {
+		return nil, err
+	}
+	next := ""
+	if len(cards) > galleryPageSize {
+		cards = cards[:galleryPageSize]
+		nq := q
+		nq.BeforeID = cards[len(cards)-1].ID
+		next = "/directory?" + nq.values().Encode()
+	}
+	for i, card := range cards {
+		cards[i], _ = h.brandCard(card.Localized(lang))
+	}
+
+	html, err := h.renderHTML("comp_gallery.html", gin.H{
+		"Lang":  lang,
+		"Cards": cards,
+		"Next":  next,
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.gallery.set(key, html)
+	return html, nil
+}
+
+func (h *Handler) indexRoute(c *gin.Context) {
+	html, err := h.galleryPage(c, DirectoryQuery{})
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to render gallery")
+	}
+
+	h.execHTML(c, http.StatusOK, "page_index.html", gin.H{
+		"Title":   h.localize(c, "TitleMain"),
+		"Gallery": template.HTML(html),
+	})
+}
+
+// Full page or, for HTMX requests, cards of the next page or of search
+// results
+func (h *Handler) directoryRoute(c *gin.Context) {
+	partial := c.GetHeader("HX-Request") == "true"
+	fail := h.errorPage
+	if partial {
+		fail = h.errorBlock
+	}
+
+	q, err := parseDirectoryQuery(c)
+	if err != nil {
+		fail(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgInvalidDirectoryQuery"),
+		)
+		return
+	}
+
+	html, err := h.galleryPage(c, q)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to render gallery")
+		fail(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToListDirectory"),
+		)
+		return
+	}
+
+	if partial {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", html)
+		return
+	}
+	h.execHTML(c, http.StatusOK, "page_directory.html", gin.H{
+		"Title":   h.localize(c, "TitleDirectory"),
+		"Gallery": template.HTML(html),
+		"Query":   c.Request.URL.Query(),
+	})
+}
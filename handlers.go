@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"maps"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/url"
@@ -21,6 +22,7 @@ import (
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 	"github.com/markbates/goth/gothic"
 	"github.com/sirupsen/logrus"
@@ -48,6 +50,14 @@ func isFileInForm(form *multipart.Form, input string) bool {
 	return len(files) > 0 && files[0] != nil
 }
 
+// Returns 0 if there is no such file in form
+func formFileSize(form *multipart.Form, input string) int64 {
+	if !isFileInForm(form, input) {
+		return 0
+	}
+	return form.File[input][0].Size
+}
+
 func redirect(c *gin.Context, target string) {
 	if c.GetHeader("HX-Request") == "true" {
 		c.Header("HX-Redirect", target)
@@ -58,15 +68,35 @@ func redirect(c *gin.Context, target string) {
 }
 
 type Handler struct {
+	cfg           *Config
 	log           *logrus.Logger
 	ctx           context.Context
 	g             *gin.Engine
 	storage       *BlobStorage
 	db            Database
-	providers     []string
+	providers     []LoginProvider
+	oidc          map[string]*OIDCProvider // Provider name -> user type mapping
 	locales       []string
-	localizer     func(string, string) string
+	localizer     func(string, string, ...any) string
 	maxUploadSize int64
+	negotiator    *LocaleNegotiator
+	proxy         *ProxyConfig
+	limiter       RateLimitStore
+	limits        RateLimits
+	csrfExempt    map[string]bool // Route paths not checked for CSRF token
+	security      *SecurityConfig
+	sessionCfg    SessionConfig
+	webauthn      *webauthn.WebAuthn // nil if passkeys are disabled
+	adminPasskey  bool               // Admin rights need passkey session
+	mailer        Mailer
+	emailLogin    *EmailLoginConfig // nil if email login is disabled
+	billing       BillingProvider   // nil if subscriptions are disabled
+	imports       *importStore      // Uploaded files waiting for confirmation
+	exports       *exportStore      // Personal data archives
+	errors        *ErrorHook        // Recent errors for admin dashboard
+	analytics     *analytics        // Card counters not saved yet
+	gallery       *fragmentCache    // Rendered public directory pages
+	ceremonies    *ceremonyStore    // Passkey ceremonies in progress
 }
 
 func SetupHandler(
@@ -75,35 +105,83 @@ func SetupHandler(
 	storage *BlobStorage,
 	db Database,
 	log *logrus.Logger,
-	providers []string,
+	providers []LoginProvider,
+	oidc map[string]*OIDCProvider,
 	locales []string,
-	localizer func(string, string) string,
+	localizer func(string, string, ...any) string,
+	negotiator *LocaleNegotiator,
+	mailer Mailer,
+	cfg *Config,
 ) {
-	smus := os.Getenv("MAX_UPLOAD_SIZE")
-	maxUploadSize, err := strconv.ParseInt(smus, 10, 64)
-	if err != nil {
-		log.Fatalf("Failed to conf max upload size: %s", smus)
-	}
-	handler := Handler{log, ctx, g, storage, db, providers, locales, localizer, maxUploadSize}
+	handler := Handler{
+		cfg:           cfg,
+		log:           log,
+		ctx:           ctx,
+		g:             g,
+		storage:       storage,
+		db:            db,
+		providers:     providers,
+		oidc:          oidc,
+		locales:       locales,
+		localizer:     localizer,
+		maxUploadSize: cfg.Server.MaxUploadSize,
+		negotiator:    negotiator,
+		proxy:         SetupProxyConfig(log, cfg.Proxy),
+		limiter:       NewMemoryRateLimitStore(ctx, 10*time.Minute),
+		limits:        SetupRateLimits(log, cfg.RateLimits),
+		csrfExempt:    map[string]bool{"/csp-report": true, "/billing/webhook": true, "/c/:id/event/:event": true},
+		security:      SetupSecurity(log, cfg.Security),
+		sessionCfg:    cfg.Sessions,
+		mailer:        mailer,
+		emailLogin:    SetupEmailLogin(cfg, mailer),
+		billing:       SetupBilling(log, cfg),
+		imports:       newImportStore(),
+		exports:       newExportStore(),
+		errors:        NewErrorHook(recentErrors),
+		analytics:     newAnalytics(),
+		gallery:       newFragmentCache(cfg.Gallery.CacheTTL),
+		ceremonies:    newCeremonyStore(),
+	}
+	log.AddHook(handler.errors)
+	handler.webauthn, handler.adminPasskey = SetupPasskeys(log, cfg)
 	g.Use(handler.headersMiddleware)
 	g.Use(handler.sessionMiddleware)
 	g.Use(handler.langMiddleware)
+	g.Use(handler.csrfMiddleware)
 	g.NoRoute(func(c *gin.Context) {
 		handler.errorPage(c, http.StatusNotFound, "")
 	})
 	handler.setupStatic()
 	handler.setupRoutes()
+	handler.runSessionCleanup()
+	handler.runDeletions()
+	handler.runAuditRetention()
+	handler.runExportCleanup()
+	if cfg.Analytics.Enabled {
+		handler.runAnalytics()
+	}
+	if handler.emailLogin != nil {
+		handler.runLoginTokenCleanup()
+	}
 }
 
 func (h *Handler) setupRoutes() {
 	h.g.GET("/", h.indexRoute)
+	h.g.GET("/directory", h.rateLimit(h.limits.Card), h.directoryRoute)
 	h.g.GET("/faq", h.faqRoute)
 	h.g.GET("/tutorial", h.tutorialRoute)
-	h.g.GET("/c/:id", h.cardRoute)
-	h.g.GET("/media/:kind/:id", h.mediaRoute)
+	h.g.GET("/c/:id", h.rateLimit(h.limits.Card), h.cardRoute)
+	h.g.POST("/c/:id/event/:event", h.rateLimit(h.limits.Card), h.cardEventRoute)
+	h.g.GET("/media/:kind/:id", h.rateLimit(h.limits.Media), h.mediaRoute)
+	h.g.POST("/csp-report", h.rateLimit(h.limits.Report), h.cspReportRoute)
+	h.g.GET("/export/download/:id", h.rateLimit(h.limits.Media), h.downloadExportRoute)
+	if h.billing != nil {
+		h.g.POST("/billing/webhook", h.billingWebhookRoute)
+	}
 	// OAuth related routes
 	{
 		oauth := h.g.Group("/")
+		oauth.Use(h.rateLimit(h.limits.Auth))
 		oauth.GET("/auth/:provider", h.authProviderRoute)
 		oauth.GET("/auth/:provider/callback", h.authCallbackRoute)
 		// Telegram is not supported by goth so we handling it individually
@@ -111,6 +189,17 @@ func (h *Handler) setupRoutes() {
 		// Vk is tecnically supported by goth, but seems like it support
 		// only old Vk OAuth system
 		oauth.POST("/auth-vk", h.authVkRoute)
+		if h.webauthn != nil {
+			oauth.POST("/auth-passkey/login/begin", h.beginPasskeyLoginRoute)
+			oauth.POST("/auth-passkey/login/finish", h.finishPasskeyLoginRoute)
+			oauth.POST("/auth-passkey/register/begin", h.beginPasskeyRegistrationRoute)
+			oauth.POST("/auth-passkey/register/finish", h.finishPasskeyRegistrationRoute)
+		}
+		if h.emailLogin != nil {
+			oauth.POST("/login/email", h.sendLoginEmailRoute)
+			oauth.GET("/auth-email", h.confirmEmailLoginRoute)
+			oauth.POST("/auth-email", h.authEmailRoute)
+		}
 	}
 	// PWA related routes
 	{
@@ -124,14 +213,34 @@ func (h *Handler) setupRoutes() {
 		us.GET("/login", h.loginRoute)
 		us.GET("/login/vk", h.loginVkRoute)
 		us.GET("/login/tg", h.loginTgRoute)
-		us.GET("/logout", h.logoutRoute)
+		if h.emailLogin != nil {
+			us.GET("/login/email", h.loginEmailRoute)
+		}
 		us.POST("/logout", h.logoutRoute)
+		us.POST("/setlocale", h.setLocaleRoute)
+	}
+	// Account self-service, available for any role
+	{
+		account := h.g.Group("/")
+		account.Use(h.loginMiddleware)
+		account.POST("/userdel", h.userDelRoute)
+		account.GET("/sessions", h.sessionsRoute)
+		account.POST("/sessions/revoke", h.revokeOtherSessionsRoute)
+		account.POST("/sessions/revoke/:id", h.revokeSessionRoute)
+		account.GET("/identities", h.identitiesRoute)
+		account.POST("/identities/link/:provider", h.linkIdentityRoute)
+		account.POST("/identities/unlink", h.unlinkIdentityRoute)
+		account.GET("/export", h.exportRoute)
+		account.POST("/export", h.requestExportRoute)
+		if h.webauthn != nil {
+			account.GET("/passkeys", h.passkeysRoute)
+			account.POST("/passkeys/delete/:id", h.deletePasskeyRoute)
+		}
 	}
 	// Other routes
 	{
 		authorized := h.g.Group("/")
 		authorized.Use(h.authMiddleware)
-		authorized.POST("/userdel", h.userDelRoute)
 		authorized.POST("/userdel/:id", h.userDelAdminRoute)
 		authorized.GET("/cards", func(c *gin.Context) {
 			user := getUser(c)
@@ -141,16 +250,62 @@ func (h *Handler) setupRoutes() {
 		authorized.POST("/delcard/:id", h.delCardRoute)
 		authorized.GET("/editor", h.newCardRoute)
 		authorized.GET("/editor/:id", h.editCardRoute)
-		authorized.POST("/new", h.createCardRoute)
-		authorized.POST("/update/:id", h.updateCardRoute)
+		authorized.POST("/new", h.rateLimit(h.limits.Upload), h.createCardRoute)
+		authorized.POST("/update/:id", h.rateLimit(h.limits.Upload), h.updateCardRoute)
 		authorized.POST("/visibility/:id", h.changeCardVisibilityRoute)
+		authorized.GET("/stats/:id", h.cardStatsRoute)
+		authorized.GET("/stats/:id/chart", h.cardStatsChartRoute)
 		authorized.GET("/users", h.listUsersRoute)
-		authorized.POST("/setlocale", h.setLocaleRoute)
-		authorized.POST("/changeUserType/:id/:typ", h.changeUserTypeRoute)
+		authorized.POST("/changeUserRole/:id/:role", h.changeUserRoleRoute)
+		authorized.POST("/changeUserPlan/:id/:plan", h.changeUserPlanRoute)
+		authorized.POST("/revokeUserSessions/:id", h.revokeUserSessionsRoute)
+		authorized.POST("/mergeUser/:id", h.mergeUserRoute)
+		authorized.GET("/orgs", h.orgsRoute)
+		authorized.POST("/orgs", h.createOrgRoute)
+		authorized.POST("/orgs/join", h.joinOrgRoute)
+		authorized.GET("/orgs/:id", h.orgRoute)
+		authorized.POST("/orgs/:id", h.updateOrgRoute)
+		authorized.POST("/orgs/:id/invite", h.resetOrgInviteRoute)
+		authorized.POST("/orgs/:id/delete", h.deleteOrgRoute)
+		authorized.POST("/orgs/:id/members/:uid/role/:role", h.changeOrgRoleRoute)
+		authorized.POST("/orgs/:id/members/:uid/remove", h.removeOrgMemberRoute)
+		authorized.GET("/import", h.importRoute)
+		authorized.POST("/import", h.rateLimit(h.limits.Upload), h.uploadImportRoute)
+		authorized.GET("/import/:id", h.importPreviewRoute)
+		authorized.POST("/import/:id", h.confirmImportRoute)
+		authorized.POST("/import/:id/mapping", h.importMappingRoute)
+		authorized.GET("/import/:id/report", h.importReportRoute)
+		authorized.GET("/admin", h.adminRoute)
+		authorized.GET("/admin/audit", h.auditRoute)
+		authorized.GET("/admin/audit.csv", h.auditCSVRoute)
+		if h.billing != nil {
+			authorized.GET("/billing", h.billingRoute)
+			authorized.POST("/billing/checkout/:plan", h.checkoutRoute)
+			authorized.POST("/billing/cancel", h.cancelSubscriptionRoute)
+		}
+		if fake, ok := h.billing.(*FakeBilling); ok && fake.routes {
+			authorized.GET("/billing/fake/checkout", h.fakeCheckoutRoute)
+			authorized.POST("/billing/fake/event", h.fakeBillingEventRoute)
+		}
 	}
 }
 
+// Third-party libraries fetched by vendor-static.sh
+var vendoredStatic = []string{
+	"js/htmx.min.js",
+	"js/response-targets.js",
+	"js/qrcode.min.js",
+	"js/dom-to-image.min.js",
+	"js/cropper.min.js",
+	"css/cropper.min.css",
+}
+
 func (h *Handler) setupStatic() {
+	for _, file := range vendoredStatic {
+		if _, err := os.Stat(filepath.Join("./static", file)); err != nil {
+			h.log.Fatalf("Static file %s is missing; run ./vendor-static.sh", file)
+		}
+	}
 	etag := fmt.Sprintf(`W/"%d"`, time.Now().Unix())
 	h.g.GET("/static/:file", func(c *gin.Context) {
 		filename := c.Param("file")
@@ -166,7 +321,7 @@ func (h *Handler) setupStatic() {
 		}
 
 		// Check If-None-Match header
-		if match := c.GetHeader("If-None-Match"); match != "" && os.Getenv("GO_ENV") != "debug" {
+		if match := c.GetHeader("If-None-Match"); match != "" && !h.cfg.Debug() {
 			if match == etag {
 				// Client already has the latest version
 				c.Status(http.StatusNotModified)
@@ -185,7 +340,7 @@ func (h *Handler) setupStatic() {
 
 		fullPath := filepath.Join("./static", filename)
 
-		if os.Getenv("GO_ENV") != "debug" {
+		if !h.cfg.Debug() {
 			// Set caching headers
 			c.Header("Etag", etag)
 		}
@@ -197,10 +352,15 @@ func (h *Handler) setupStatic() {
 
 // Helpers
 
-func (h *Handler) localize(c *gin.Context, key string) string {
+func (h *Handler) clientIP(c *gin.Context) string {
+	return h.proxy.ClientIP(c.Request)
+}
+
+func (h *Handler) localize(c *gin.Context, key string, args ...any) string {
 	return h.localizer(
 		key,
 		c.MustGet("Lang").(string),
+		args...,
 	)
 }
 
@@ -209,6 +369,14 @@ func (h *Handler) execHTML(c *gin.Context, status int, card string, add gin.H) {
 		"User":    getUser(c),
 		"Lang":    c.MustGet("Lang").(string),
 		"Locales": h.locales,
+		"CSRF":    h.csrfToken(c),
+		"Nonce":   c.GetString("CSPNonce"),
+		// Passkeys are enabled
+		"Passkeys": h.webauthn != nil,
+		// Subscriptions are enabled
+		"Billing": h.billing != nil,
+		// Grace period of account deletion
+		"DeletionDays": int(h.cfg.Deletion.GracePeriod.Hours() / 24),
 	}
 	maps.Copy(dst, add)
 	c.HTML(status, card, dst)
@@ -290,6 +458,66 @@ func (h *Handler) uploadFormFile(c *gin.Context, form *multipart.Form, input, ke
 	return true
 }
 
+// Collects card translations from "tr-<locale>-<field>" form inputs
+func (h *Handler) bindTranslations(c *gin.Context) map[string]CardTranslation {
+	translations := map[string]CardTranslation{}
+	for _, locale := range h.locales {
+		prefix := "tr-" + locale + "-"
+		tr := CardTranslation{
+			Name:        strings.TrimSpace(c.PostForm(prefix + "name")),
+			Company:     strings.TrimSpace(c.PostForm(prefix + "company")),
+			Position:    strings.TrimSpace(c.PostForm(prefix + "position")),
+			Description: strings.TrimSpace(c.PostForm(prefix + "description")),
+		}
+		if !tr.IsEmpty() {
+			translations[locale] = tr
+		}
+	}
+	return translations
+}
+
+// Binds new server side session to signed in user and applies language
+// saved in account. If account has no language yet, the one selected
+// before login is saved. Passkey marks sessions started with passkey.
+func (h *Handler) startSession(c *gin.Context, id string, passkey bool) error {
+	uid, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return err
+	}
+	user := User{ID: uint(uid)}
+	if err := h.db.GetUser(&user); err != nil {
+		return err
+	}
+	h.cancelDeletion(c, &user)
+	h.audit(c, user.ID, AuditLogin, auditTarget("user", user.ID), map[string]any{
+		"passkey": passkey,
+	})
+
+	sess := sessions.Default(c)
+	// Drop previous session if any to prevent session fixation
+	if token, ok := sess.Get(sessionTokenKey).(string); ok && token != "" {
+		h.db.DeleteSession(hashSessionToken(token))
+	}
+	if err := h.createSession(c, user.ID, passkey); err != nil {
+		return err
+	}
+	// Rotate CSRF token on privilege change
+	sess.Set(csrfSessionKey, newCSRFToken())
+
+	if lang := h.negotiator.Find(user.Lang); lang != "" {
+		sess.Set("Lang", lang)
+	} else if lang, ok := sess.Get("Lang").(string); ok && h.negotiator.Find(lang) != "" {
+		user.Lang = lang
+		if err := h.db.UpdateUser(user); err != nil {
+			h.log.WithFields(logrus.Fields{
+				"uid": user.ID,
+				"err": err,
+			}).Error("Failed to save user language")
+		}
+	}
+	return sess.Save()
+}
+
 func (h *Handler) fetchMedia(c *gin.Context, key string) {
 
 	size, reader, err := h.storage.GetKey(h.ctx, key, true)
@@ -305,7 +533,12 @@ func (h *Handler) fetchMedia(c *gin.Context, key string) {
 	}
 	//c.Header("ETag", etag)
 	c.Header("Content-Length", fmt.Sprintf("%d", size))
-	c.Header("Content-Type", "image/webp")
+	// Uploads are converted to webp; imported photos keep their format
+	contentType := mime.TypeByExtension(filepath.Ext(key))
+	if contentType == "" {
+		contentType = "image/webp"
+	}
+	c.Header("Content-Type", contentType)
 	c.Header("Cache-Control", "public, max-age=31536000, immutable") // one year
 	if _, err := io.Copy(c.Writer, reader); err != nil {
 		h.log.WithFields(logrus.Fields{
@@ -324,77 +557,108 @@ func (h *Handler) fetchMedia(c *gin.Context, key string) {
 
 func (h *Handler) headersMiddleware(c *gin.Context) {
 	c.Header("Service-Worker-Allowed", "/")
+	h.securityHeaders(c)
 	c.Next()
 }
 
 func (h *Handler) sessionMiddleware(c *gin.Context) {
 	c.Set("User", nil)
-	user := User{
-		ID:         0,
-		ProviderID: "",
-		Name:       "",
-	}
 	sess := sessions.Default(c)
-	str_uid := sess.Get("user_id")
-	if str_uid == nil {
+	if sess.Get("user_id") != nil {
+		// Legacy cookie-only session; it can't be revoked so drop it
+		sess.Delete("user_id")
+		sess.Save()
+	}
+	if sess.Get(sessionTokenKey) == nil {
 		c.Next()
 		return
 	}
-	uid, err := strconv.ParseUint(str_uid.(string), 10, 64)
-	if err != nil {
-		h.log.Error("Request with broken uid; failed to convert to uint")
-		sess.Clear()
+	server, ok := h.currentSession(c)
+	if !ok {
+		// Expired or revoked
+		sess.Delete(sessionTokenKey)
 		sess.Save()
-		c.Redirect(http.StatusTemporaryRedirect, "/")
+		c.Next()
 		return
 	}
-	user.ID = uint(uid)
-	err = h.db.GetUser(&user)
+	user := User{ID: server.UserID}
+	err := h.db.GetUser(&user)
 	if err != nil {
 		h.log.WithFields(logrus.Fields{
 			"uid": user.ID,
 		}).Error("Broken user session")
+		h.db.DeleteSession(server.ID)
 		sess.Clear()
 		sess.Save()
 		c.Redirect(http.StatusTemporaryRedirect, "/")
 		return
 	}
+	if h.adminPasskey && user.Role == RoleAdmin && !server.Passkey {
+		// Admin rights are granted only in sessions started with passkey
+		user.Role = RoleMember
+		c.Set("PasskeyRequired", true)
+	}
 	c.Set("User", &user)
+	c.Set("SessionID", server.ID)
+	c.Set("PasskeySession", server.Passkey)
 	c.Next()
 }
 
-func (h *Handler) authMiddleware(c *gin.Context) {
-	user := getUser(c)
-	if user == nil {
+// Returning without c.Next() doesn't stop the chain, so rejected requests
+// are aborted
+func (h *Handler) loginMiddleware(c *gin.Context) {
+	if getUser(c) == nil {
 		redirect(c, "/")
+		c.Abort()
 		return
 	}
-	if user.Type == UserTypeLimited {
+	c.Next()
+}
+
+func (h *Handler) authMiddleware(c *gin.Context) {
+	user := getUser(c)
+	if user == nil || !user.Can(PermCardsEditOwn, 0) {
 		redirect(c, "/")
+		c.Abort()
 		return
 	}
 	c.Next()
 }
 
+// Locale priority: explicit ?lang= query param, then the one saved in
+// user account, then the one saved in session, then negotiated by
+// Accept-Language header and GeoIP. Query param is kept in session only,
+// so shared links don't change account preference; it is saved on
+// account by POST /setlocale.
 func (h *Handler) langMiddleware(c *gin.Context) {
 	sess := sessions.Default(c)
-	lang := sess.Get("Lang")
-	if lang == nil {
-		c.Set("Lang", "en")
-	} else {
-		c.Set("Lang", lang.(string))
+	if lang := h.negotiator.Find(c.Query("lang")); lang != "" {
+		sess.Set("Lang", lang)
+		sess.Save()
+		c.Set("Lang", lang)
+		c.Header("Content-Language", lang)
+		c.Next()
+		return
+	}
+	lang := ""
+	if user := getUser(c); user != nil {
+		lang = h.negotiator.Find(user.Lang)
+	}
+	if lang == "" {
+		lang, _ = sess.Get("Lang").(string)
+		lang = h.negotiator.Find(lang)
+	}
+	if lang == "" {
+		lang = h.negotiator.Negotiate(c.GetHeader("Accept-Language"), h.clientIP(c))
+		c.Header("Vary", "Accept-Language")
 	}
+	c.Set("Lang", lang)
+	c.Header("Content-Language", lang)
 	c.Next()
 }
 
 // Routes
 
-func (h *Handler) indexRoute(c *gin.Context) {
-	h.execHTML(c, http.StatusOK, "page_index.html", gin.H{
-		"Title": h.localize(c, "TitleMain"),
-	})
-}
-
 func (h *Handler) faqRoute(c *gin.Context) {
 	h.execHTML(c, http.StatusOK, "page_faq.html", gin.H{
 		"Title": h.localize(c, "TitleFaq"),
@@ -407,6 +671,22 @@ func (h *Handler) tutorialRoute(c *gin.Context) {
 	})
 }
 
+// Hidden cards and cards of accounts scheduled for deletion are shown only
+// to those who manage them
+func (h *Handler) cardVisible(user *User, card Card) bool {
+	if h.canManageCard(user, card, PermCardsViewAny) {
+		return true
+	}
+	if card.Fields.IsHidden {
+		return false
+	}
+	owner := User{ID: card.Owner}
+	if err := h.db.GetUser(&owner); err != nil {
+		return false
+	}
+	return !owner.DeletionScheduled()
+}
+
 func (h *Handler) cardRoute(c *gin.Context) {
 	cid, err := getUintParam(c, "id")
 	if err != nil {
@@ -426,20 +706,28 @@ func (h *Handler) cardRoute(c *gin.Context) {
 		return
 	}
 
-	is_owner := false
-
-	if user != nil {
-		is_owner = card.Owner == user.ID || user.Type == UserTypeAdmin
-	}
-	if !is_owner && card.Fields.IsHidden {
+	if !h.cardVisible(user, card) {
 		h.execHTML(c, http.StatusNotFound, "page_cardNotFound.html", gin.H{})
 		return
 	}
 
+	// Owners looking at own cards are not counted
+	owner := h.canManageCard(user, card, PermCardsEditAny)
+	if !owner {
+		if c.Query("src") == qrSource {
+			h.trackCard(c, cid, EventView, EventScan)
+		} else {
+			h.trackCard(c, cid, EventView)
+		}
+	}
+
+	card, theme := h.brandCard(card.Localized(c.MustGet("Lang").(string)))
+
 	h.execHTML(c, http.StatusOK, "page_card.html", gin.H{
 		"Title":   card.Fields.Name,
 		"Card":    card,
-		"Owner":   is_owner,
+		"Theme":   theme,
+		"Owner":   owner,
 		"EditUrl": fmt.Sprintf("/editor/%d", cid),
 	})
 }
@@ -497,33 +785,17 @@ func (h *Handler) authCallbackRoute(c *gin.Context) {
 
 	pid, name := UserCreds(user)
 
-	id, err := h.db.SignUser(pid, name)
-
-	if err != nil {
-		h.log.WithFields(logrus.Fields{
-			"err": err,
-		}).Error("Failed to complete auth")
-		h.errorPage(
-			c,
-			http.StatusInternalServerError,
-			h.localize(c, "ErrMsgFailedAuth500"),
-		)
-		return
+	var role func(Role) Role
+	if mapping, ok := h.oidc[user.Provider]; ok {
+		role = func(current Role) Role {
+			return mapping.Role(user.RawData, current)
+		}
 	}
 
-	h.log.WithFields(logrus.Fields{
-		"pid":  pid,
-		"uid":  id,
-		"name": name,
-	}).Info("Logged in")
-	sess := sessions.Default(c)
-	sess.Set("user_id", id)
-	sess.Save()
-
-	redirect(c, "/cards")
+	h.signIn(c, pid, name, role)
 }
 
-func checkTelegramAuthorization(params map[string]string) (map[string]string, error) {
+func checkTelegramAuthorization(params map[string]string, botToken string) (map[string]string, error) {
 	// Extract and remove hash
 	checkHash, ok := params["hash"]
 	if !ok {
@@ -540,7 +812,7 @@ func checkTelegramAuthorization(params map[string]string) (map[string]string, er
 	dataCheckString := strings.Join(dataCheckArr, "\n")
 
 	// Compute secret key
-	secretKey := sha256.Sum256([]byte(os.Getenv("TG_CLIENT_SECRET")))
+	secretKey := sha256.Sum256([]byte(botToken))
 
 	// Compute HMAC-SHA256 of data_check_string
 	h := hmac.New(sha256.New, secretKey[:])
@@ -580,7 +852,7 @@ func (h *Handler) authTgRoute(c *gin.Context) {
 	}
 
 	// Verify Telegram authorization data
-	authData, err := checkTelegramAuthorization(params)
+	authData, err := checkTelegramAuthorization(params, h.cfg.OAuth.Telegram.Secret)
 	if err != nil {
 		h.log.WithFields(logrus.Fields{
 			"err": err,
@@ -596,30 +868,7 @@ func (h *Handler) authTgRoute(c *gin.Context) {
 	pid := "tg:" + authData["id"]
 	name := authData["first_name"]
 
-	id, err := h.db.SignUser(pid, name)
-
-	if err != nil {
-		h.log.WithFields(logrus.Fields{
-			"err": err,
-		}).Error("Failed to complete auth")
-		h.errorPage(
-			c,
-			http.StatusInternalServerError,
-			h.localize(c, "ErrMsgFailedAuth500"),
-		)
-		return
-	}
-
-	h.log.WithFields(logrus.Fields{
-		"pid":  pid,
-		"uid":  id,
-		"name": name,
-	}).Info("Logged in")
-	sess := sessions.Default(c)
-	sess.Set("user_id", id)
-	sess.Save()
-
-	redirect(c, "/cards")
+	h.signIn(c, pid, name, nil)
 }
 
 func (h *Handler) authVkRoute(c *gin.Context) {
@@ -638,7 +887,7 @@ func (h *Handler) authVkRoute(c *gin.Context) {
 	}
 
 	form := url.Values{}
-	form.Set("client_id", os.Getenv("VK_CLIENT_ID"))
+	form.Set("client_id", h.cfg.OAuth.VKClientID)
 	form.Set("access_token", accessToken)
 
 	resp, err := http.PostForm("https://id.vk.com/oauth2/user_info", form)
@@ -690,30 +939,7 @@ func (h *Handler) authVkRoute(c *gin.Context) {
 	}
 	name += info.User.LastName
 
-	id, err := h.db.SignUser(pid, name)
-
-	if err != nil {
-		h.log.WithFields(logrus.Fields{
-			"err": err,
-		}).Error("Failed to complete auth")
-		h.errorPage(
-			c,
-			http.StatusInternalServerError,
-			h.localize(c, "ErrMsgFailedAuth500"),
-		)
-		return
-	}
-
-	h.log.WithFields(logrus.Fields{
-		"pid":  pid,
-		"uid":  id,
-		"name": name,
-	}).Info("Logged in")
-	sess := sessions.Default(c)
-	sess.Set("user_id", id)
-	sess.Save()
-
-	redirect(c, "/cards")
+	h.signIn(c, pid, name, nil)
 }
 
 func (h *Handler) cardManifestRoute(c *gin.Context) {
@@ -735,15 +961,11 @@ func (h *Handler) cardManifestRoute(c *gin.Context) {
 		return
 	}
 
-	is_owner := false
-
-	if user != nil {
-		is_owner = card.Owner == user.ID || user.Type == UserTypeAdmin
-	}
-	if !is_owner && card.Fields.IsHidden {
+	if !h.cardVisible(user, card) {
 		h.execHTML(c, http.StatusNotFound, "page_cardNotFound.html", gin.H{})
 		return
 	}
+	card = card.Localized(c.MustGet("Lang").(string))
 	manifest := map[string]any{
 		"name":       card.Fields.Name,
 		"short_name": card.Fields.Name,
@@ -785,12 +1007,7 @@ func (h *Handler) cardWorkerRoute(c *gin.Context) {
 		return
 	}
 
-	is_owner := false
-
-	if user != nil {
-		is_owner = card.Owner == user.ID || user.Type == UserTypeAdmin
-	}
-	if !is_owner && card.Fields.IsHidden {
+	if !h.cardVisible(user, card) {
 		h.execHTML(c, http.StatusNotFound, "page_cardNotFound.html", gin.H{})
 		return
 	}
@@ -808,7 +1025,12 @@ func (h *Handler) cardWorkerRoute(c *gin.Context) {
 				  "/static/card.css",
 				  "/static/card.js",
 				  "/static/collapse.js",
+				  "/static/htmx.min.js",
+				  "/static/response-targets.js",
+				  "/static/qrcode.min.js",
+				  "/static/dom-to-image.min.js",
 				  "/static/copy.js",
+				  "/static/csrf.js",
 				  "/static/preview.js",
 				  "/static/airplane.svg",
 				  "/static/burger.svg",
@@ -830,9 +1052,7 @@ func (h *Handler) cardWorkerRoute(c *gin.Context) {
 				  "/static/view.svg",
 				  "/static/vk-logo.svg",
 				  "/static/yandex-logo.svg",
-			      "/%s",
-				  "https://cdnjs.cloudflare.com/ajax/libs/qrcodejs/1.0.0/qrcode.js",
-				  "https://cdnjs.cloudflare.com/ajax/libs/dom-to-image/2.6.0/dom-to-image.min.js"
+			      "/%s"
 			    ];
 			    self.addEventListener("install", e => {
 			      e.waitUntil(caches.open(CACHE).then(c => c.addAll(toCache)));
@@ -861,6 +1081,7 @@ func (h *Handler) cardWorkerRoute(c *gin.Context) {
 }
 
 func (h *Handler) loginRoute(c *gin.Context) {
+	h.allowProviderIcons(c)
 	h.execHTML(c, http.StatusOK, "page_login.html", gin.H{
 		"Title":     h.localize(c, "TitleLogin"),
 		"Providers": h.providers,
@@ -868,43 +1089,35 @@ func (h *Handler) loginRoute(c *gin.Context) {
 }
 
 func (h *Handler) loginVkRoute(c *gin.Context) {
+	h.allowCSP(c, "script-src", "https://unpkg.com")
+	h.allowCSP(c, "frame-src", "https://id.vk.com")
+	h.allowCSP(c, "connect-src", "https://id.vk.com")
 	h.execHTML(c, http.StatusOK, "page_login_vk.html", gin.H{
 		"Title":      "VK login",
-		"vkapp":      os.Getenv("VK_CLIENT_ID"),
-		"vkredirect": os.Getenv("VK_CLIENT_CALLBACK_URL"),
+		"vkapp":      h.cfg.OAuth.VKClientID,
+		"vkredirect": h.cfg.OAuth.VKCallbackURL,
 	})
 }
 
 func (h *Handler) loginTgRoute(c *gin.Context) {
+	h.allowCSP(c, "script-src", "https://telegram.org")
+	h.allowCSP(c, "frame-src", "https://oauth.telegram.org")
 	h.execHTML(c, http.StatusOK, "page_login_tg.html", gin.H{
 		"Title":    "VK login",
-		"botname":  os.Getenv("TG_CLIENT_ID"),
-		"callback": os.Getenv("TG_CLIENT_CALLBACK_URL"),
+		"botname":  h.cfg.OAuth.Telegram.ID,
+		"callback": h.cfg.OAuth.Telegram.CallbackURL,
 	})
 }
 
 func (h *Handler) logoutRoute(c *gin.Context) {
-	sess := sessions.Default(c)
-	sess.Clear()
-	sess.Save()
-	redirect(c, "/")
-}
-
-func (h *Handler) userDelRoute(c *gin.Context) {
-	user := getUser(c)
-
-	h.db.DeleteUser(user.ID)
-
-	sess := sessions.Default(c)
-	sess.Clear()
-	sess.Save()
+	h.endSession(c)
 	redirect(c, "/")
 }
 
 func (h *Handler) userDelAdminRoute(c *gin.Context) {
 	user := getUser(c)
 
-	if user.Type != UserTypeAdmin {
+	if !user.Can(PermUsersManage, 0) {
 		h.errorPage(c, http.StatusNotFound, "")
 		return
 	}
@@ -923,11 +1136,12 @@ func (h *Handler) userDelAdminRoute(c *gin.Context) {
 		return
 	}
 
-	err = h.db.DeleteUser(uid)
+	err = h.eraseUser(uid, user.ID, h.clientIP(c))
 
 	if err != nil {
 		h.log.WithFields(logrus.Fields{
 			"err": err,
+			"uid": uid,
 		}).Error("Failed to delete user")
 		h.errorPage(
 			c,
@@ -950,11 +1164,17 @@ func (h *Handler) cardsRoute(c *gin.Context) {
 		return
 	}
 
-	if user.Type != UserTypeAdmin && uid != user.ID {
+	if uid != user.ID && !user.Can(PermUsersView, 0) {
 		redirect(c, fmt.Sprintf("/cards/%d", user.ID))
+		return
 	}
 
-	cards, err := h.db.ListCards(uid)
+	owner := User{ID: uid}
+	err = h.db.GetUser(&owner)
+	var cards []Card
+	if err == nil {
+		cards, err = h.db.ListCards(uid)
+	}
 
 	if err != nil {
 		h.log.WithFields(logrus.Fields{
@@ -971,6 +1191,7 @@ func (h *Handler) cardsRoute(c *gin.Context) {
 	h.execHTML(c, http.StatusOK, "page_cards.html", gin.H{
 		"Title": h.localize(c, "TitleCards"),
 		"Cards": cards,
+		"Usage": h.planUsage(c, h.userPlan(&owner), cardsUsage(cards)),
 	})
 }
 
@@ -995,7 +1216,7 @@ func (h *Handler) delCardRoute(c *gin.Context) {
 		return
 	}
 
-	if card.Owner != user.ID && user.Type != UserTypeAdmin {
+	if !h.canManageCard(user, card, PermCardsEditAny) {
 		h.errorPage(
 			c,
 			http.StatusForbidden,
@@ -1005,23 +1226,39 @@ func (h *Handler) delCardRoute(c *gin.Context) {
 	}
 
 	err = h.db.DeleteCard(cid)
+	h.gallery.purge()
 
 	if err != nil {
 		h.log.WithFields(logrus.Fields{
 			"cid": cid,
 			"err": err,
 		}).Error("Failed to delete a card")
+	} else {
+		h.audit(c, user.ID, AuditCardDeleted, auditTarget("card", cid), map[string]any{
+			"owner": card.Owner,
+		})
 	}
 
-	redirect(c, fmt.Sprintf("/cards/%d", card.Owner))
+	redirect(c, h.cardsPage(user, card))
 }
 
+// Org cards are created with "org" and optional "owner" query params
 func (h *Handler) newCardRoute(c *gin.Context) {
+	_, org, ok := h.newCardTarget(c, getUser(c))
+	if !ok {
+		return
+	}
+
+	editURL := "/new"
+	if org != 0 {
+		editURL += "?" + url.Values{"org": {c.Query("org")}, "owner": {c.Query("owner")}}.Encode()
+	}
+
 	h.execHTML(c, http.StatusOK, "page_editor.html", gin.H{
 		"Title":        h.localize(c, "TitleCreateNewCard"),
-		"EditUrl":      "/new",
+		"EditUrl":      editURL,
 		"SubmitButton": "CreateCard",
-		"Card":         Card{},
+		"Card":         Card{OrgID: org},
 	})
 }
 
@@ -1041,7 +1278,7 @@ func (h *Handler) editCardRoute(c *gin.Context) {
 		return
 	}
 
-	if card.Owner != user.ID && user.Type != UserTypeAdmin {
+	if !h.canManageCard(user, card, PermCardsEditAny) {
 		redirect(c, "/cards")
 		return
 	}
@@ -1058,6 +1295,11 @@ func (h *Handler) editCardRoute(c *gin.Context) {
 func (h *Handler) createCardRoute(c *gin.Context) {
 	user := getUser(c)
 
+	owner, org, ok := h.newCardTarget(c, user)
+	if !ok {
+		return
+	}
+
 	var fields CardFields
 
 	if err := c.Bind(&fields); err != nil {
@@ -1071,6 +1313,7 @@ func (h *Handler) createCardRoute(c *gin.Context) {
 		)
 		return
 	}
+	fields.Translations = h.bindTranslations(c)
 
 	form, err := c.MultipartForm()
 	if err != nil {
@@ -1085,7 +1328,16 @@ func (h *Handler) createCardRoute(c *gin.Context) {
 		return
 	}
 
-	card, err := h.db.CreateCard(user.ID, fields)
+	avatarSize, logoSize := formFileSize(form, "avatar"), formFileSize(form, "logo")
+	if !h.checkQuota(c, owner, 1, mediaDelta(Card{}, form)) {
+		return
+	}
+
+	card, err := h.db.CreateCard(owner, fields)
+	if err == nil && org != 0 {
+		card.OrgID = org
+		err = h.db.UpdateCard(card)
+	}
 
 	if err != nil {
 		h.log.WithFields(logrus.Fields{
@@ -1105,6 +1357,7 @@ func (h *Handler) createCardRoute(c *gin.Context) {
 			return
 		}
 		card.Avatar = avatar
+		card.AvatarSize = avatarSize
 		err = h.db.UpdateCard(card)
 		if err != nil {
 			h.log.WithFields(logrus.Fields{
@@ -1125,6 +1378,7 @@ func (h *Handler) createCardRoute(c *gin.Context) {
 			return
 		}
 		card.Logo = logo
+		card.LogoSize = logoSize
 		err = h.db.UpdateCard(card)
 		if err != nil {
 			h.log.WithFields(logrus.Fields{
@@ -1139,7 +1393,10 @@ func (h *Handler) createCardRoute(c *gin.Context) {
 		}
 	}
 
-	redirect(c, "/cards")
+	if card.Fields.Listed {
+		h.gallery.purge()
+	}
+	redirect(c, h.cardsPage(user, card))
 }
 
 func (h *Handler) updateCardRoute(c *gin.Context) {
@@ -1158,10 +1415,11 @@ func (h *Handler) updateCardRoute(c *gin.Context) {
 		return
 	}
 
-	if card.Owner != user.ID && user.Type != UserTypeAdmin {
+	if !h.canManageCard(user, card, PermCardsEditAny) {
 		redirect(c, "/cards")
 		return
 	}
+	before := card
 
 	var fields CardFields
 
@@ -1176,6 +1434,7 @@ func (h *Handler) updateCardRoute(c *gin.Context) {
 		)
 		return
 	}
+	fields.Translations = h.bindTranslations(c)
 
 	form, err := c.MultipartForm()
 	if err != nil {
@@ -1190,6 +1449,11 @@ func (h *Handler) updateCardRoute(c *gin.Context) {
 		return
 	}
 
+	avatarSize, logoSize := formFileSize(form, "avatar"), formFileSize(form, "logo")
+	if !h.checkQuota(c, card.Owner, 0, mediaDelta(card, form)) {
+		return
+	}
+
 	fields.IsHidden = card.Fields.IsHidden // TODO: Make it less ugly
 	card.Fields = fields
 	err = h.db.UpdateCard(card)
@@ -1209,6 +1473,7 @@ func (h *Handler) updateCardRoute(c *gin.Context) {
 		}
 		old_avatar := card.Avatar
 		card.Avatar = avatar
+		card.AvatarSize = avatarSize
 		err = h.db.UpdateCard(card)
 		if err != nil {
 			h.log.WithFields(logrus.Fields{
@@ -1235,6 +1500,7 @@ func (h *Handler) updateCardRoute(c *gin.Context) {
 		}
 		old_logo := card.Logo
 		card.Logo = logo
+		card.LogoSize = logoSize
 		err = h.db.UpdateCard(card)
 		if err != nil {
 			h.log.WithFields(logrus.Fields{
@@ -1254,7 +1520,20 @@ func (h *Handler) updateCardRoute(c *gin.Context) {
 		}
 	}
 
-	redirect(c, fmt.Sprintf("/cards/%d", card.Owner))
+	// Only edits of others' cards are audited; card fields are personal
+	// data, so only names of changed ones are kept
+	diff := structDiff(before.Fields, card.Fields).
+		Add("Avatar", before.Avatar, card.Avatar).
+		Add("Logo", before.Logo, card.Logo)
+	if user.ID != card.Owner && len(diff) > 0 {
+		h.audit(c, user.ID, AuditCardUpdated, auditTarget("card", card.ID), map[string]any{
+			"owner":  card.Owner,
+			"fields": diff.Fields(),
+		})
+	}
+	h.gallery.purge()
+
+	redirect(c, h.cardsPage(user, card))
 }
 
 func (h *Handler) changeCardVisibilityRoute(c *gin.Context) {
@@ -1277,7 +1556,7 @@ func (h *Handler) changeCardVisibilityRoute(c *gin.Context) {
 		return
 	}
 
-	if card.Owner != user.ID && user.Type != UserTypeAdmin {
+	if !h.canManageCard(user, card, PermCardsHideAny) {
 		h.errorBlock(
 			c,
 			http.StatusForbidden,
@@ -1286,6 +1565,7 @@ func (h *Handler) changeCardVisibilityRoute(c *gin.Context) {
 		return
 	}
 
+	hidden := card.Fields.IsHidden
 	switch c.Query("visible") {
 	case "true":
 		card.Fields.IsHidden = false
@@ -1294,55 +1574,63 @@ func (h *Handler) changeCardVisibilityRoute(c *gin.Context) {
 		card.Fields.IsHidden = true
 		err = h.db.UpdateCard(card)
 	}
+	h.gallery.purge()
 
 	if err != nil {
 		h.log.WithFields(logrus.Fields{
 			"err": err,
 		}).Error("Failed to update card visibility")
+	} else if hidden != card.Fields.IsHidden {
+		h.audit(c, user.ID, AuditCardVisibility, auditTarget("card", card.ID), AuditDiff{}.Add(
+			"hidden", hidden, card.Fields.IsHidden,
+		))
 	}
 
 	h.execHTML(c, http.StatusOK, "comp_cardElement.html", gin.H{
-		"Card": card,
+		"Card":   card,
+		"Manage": h.canManageCard(user, card, PermCardsEditAny),
 	})
 }
 
-func (h *Handler) listUsersRoute(c *gin.Context) {
-	user := getUser(c)
+// Stores valid locale in session and, for logged in user, on account
+func (h *Handler) saveLocale(c *gin.Context, locale string) {
+	sess := sessions.Default(c)
+	sess.Set("Lang", locale)
+	sess.Save()
 
-	if user.Type != UserTypeAdmin {
-		h.errorPage(c, http.StatusNotFound, "")
+	user := getUser(c)
+	if user == nil || user.Lang == locale {
 		return
 	}
-
-	users, err := h.db.ListUsers()
-
+	// User from context may have restricted type, so save stored one
+	stored := User{ID: user.ID}
+	err := h.db.GetUser(&stored)
+	if err == nil {
+		stored.Lang = locale
+		err = h.db.UpdateUser(stored)
+	}
 	if err != nil {
 		h.log.WithFields(logrus.Fields{
+			"uid": user.ID,
 			"err": err,
-		}).Error("Failed to list users")
-		h.errorPage(
-			c,
-			http.StatusInternalServerError,
-			h.localize(c, "ErrMsgFailedToListUsers"),
-		)
+		}).Error("Failed to save user language")
 		return
 	}
-
-	h.execHTML(c, http.StatusOK, "page_users.html", gin.H{
-		"Title": h.localize(c, "TitleUsers"),
-		"Users": users,
-	})
+	user.Lang = locale
 }
 
 func (h *Handler) setLocaleRoute(c *gin.Context) {
-	locale := c.PostForm("lang")
-	sess := sessions.Default(c)
+	locale := h.negotiator.Find(c.PostForm("lang"))
 	if locale == "" {
-		sess.Set("Lang", "en")
-	} else {
-		sess.Set("Lang", locale)
+		h.errorBlock(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgUnknownLocale"),
+		)
+		return
 	}
-	sess.Save()
+	h.saveLocale(c, locale)
+
 	referrer := c.Request.Referer()
 	if referrer == "" {
 		referrer = "/"
@@ -1350,10 +1638,11 @@ func (h *Handler) setLocaleRoute(c *gin.Context) {
 	redirect(c, referrer)
 }
 
-func (h *Handler) changeUserTypeRoute(c *gin.Context) {
+// Assigns role from :role param (role name) to user from :id param
+func (h *Handler) changeUserRoleRoute(c *gin.Context) {
 	user := getUser(c)
 
-	if user.Type != UserTypeAdmin {
+	if !user.Can(PermUsersManage, 0) {
 		h.errorPage(c, http.StatusNotFound, "")
 		return
 	}
@@ -1364,7 +1653,7 @@ func (h *Handler) changeUserTypeRoute(c *gin.Context) {
 		h.log.WithFields(logrus.Fields{
 			"err": err,
 		}).Error("Wrong user id")
-		h.errorPage(
+		h.errorBlock(
 			c,
 			http.StatusBadRequest,
 			h.localize(c, "ErrMsgBrokenUserID"),
@@ -1372,16 +1661,23 @@ func (h *Handler) changeUserTypeRoute(c *gin.Context) {
 		return
 	}
 
-	typ, err := getUintParam(c, "typ")
+	role, err := ParseRole(c.Param("role"))
 
 	if err != nil {
-		h.log.WithFields(logrus.Fields{
-			"err": err,
-		}).Error("Failed get user type param")
-		h.errorPage(
+		h.errorBlock(
 			c,
-			http.StatusInternalServerError,
-			"",
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgUnknownRole"),
+		)
+		return
+	}
+
+	// Admin could lock themselves out otherwise
+	if uid == user.ID {
+		h.errorBlock(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgCantChangeOwnRole"),
 		)
 		return
 	}
@@ -1393,7 +1689,7 @@ func (h *Handler) changeUserTypeRoute(c *gin.Context) {
 	if err != nil {
 		h.log.WithFields(logrus.Fields{
 			"err": err,
-		}).Error("Failed to delete user")
+		}).Error("Failed to get user")
 		h.errorPage(
 			c,
 			http.StatusNotFound,
@@ -1402,7 +1698,18 @@ func (h *Handler) changeUserTypeRoute(c *gin.Context) {
 		return
 	}
 
-	target.Type = typ
+	// Demoted user should log in again
+	demoted := !role.Includes(target.Role)
+
+	h.log.WithFields(logrus.Fields{
+		"admin": user.ID,
+		"uid":   target.ID,
+		"from":  target.Role,
+		"to":    role,
+	}).Info("User role changed")
+
+	before := target.Role
+	target.Role = role
 
 	err = h.db.UpdateUser(target)
 
@@ -1417,6 +1724,17 @@ func (h *Handler) changeUserTypeRoute(c *gin.Context) {
 		)
 		return
 	}
+	h.audit(c, user.ID, AuditRoleChanged, auditTarget("user", target.ID), AuditDiff{}.Add(
+		"role", before.String(), role.String(),
+	))
+
+	if demoted {
+		if err := h.db.DeleteUserSessions(target.ID); err != nil {
+			h.log.WithFields(logrus.Fields{
+				"err": err,
+			}).Error("Failed to delete user sessions")
+		}
+	}
 
 	redirect(c, "/users")
 }
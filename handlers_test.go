@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAccessMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := &Handler{}
+	tests := []struct {
+		name       string
+		user       *User
+		middleware gin.HandlerFunc
+		want       bool
+	}{
+		{"anonymous account", nil, h.loginMiddleware, false},
+		{"viewer account", &User{Role: RoleViewer}, h.loginMiddleware, true},
+		{"anonymous authorized", nil, h.authMiddleware, false},
+		{"viewer authorized", &User{Role: RoleViewer}, h.authMiddleware, false},
+		{"member authorized", &User{Role: RoleMember}, h.authMiddleware, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := gin.New()
+			reached := false
+			g.Use(func(c *gin.Context) {
+				// As set by sessionMiddleware
+				c.Set("User", nil)
+				if tt.user != nil {
+					c.Set("User", tt.user)
+				}
+			})
+			g.GET("/", tt.middleware, func(c *gin.Context) {
+				reached = true
+				c.Status(http.StatusOK)
+			})
+			w := httptest.NewRecorder()
+			g.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			if reached != tt.want {
+				t.Errorf("handler reached = %v, want %v", reached, tt.want)
+			}
+			if !tt.want && w.Code != http.StatusFound {
+				t.Errorf("status = %d, want redirect", w.Code)
+			}
+		})
+	}
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"net"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"github.com/oschwald/maxminddb-golang"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/text/language"
 	"gopkg.in/yaml.v3"
 )
 
-func SetupLocales(log *logrus.Logger) (func(string, string) string, []string) {
+func SetupLocales(log *logrus.Logger) (func(string, string, ...any) string, []string) {
 	names := []string{}
 	b := i18n.NewBundle(language.English)
 	b.RegisterUnmarshalFunc("yaml", yaml.Unmarshal)
@@ -33,15 +36,161 @@ func SetupLocales(log *logrus.Logger) (func(string, string) string, []string) {
 		}
 	}
 
-	localizer := func(key string, locale string) string {
+	// Optional args are: plural count (if number of args is odd) followed
+	// by key-value pairs of template data. Plural count is also available
+	// in message templates as {{.Count}}.
+	//   T "Key" .Lang
+	//   T "CardsCount" .Lang 5
+	//   T "Greeting" .Lang "Name" .User.Name
+	localizer := func(key string, locale string, args ...any) string {
+		cfg := &i18n.LocalizeConfig{MessageID: key}
+		data := map[string]any{}
+		if len(args)%2 == 1 {
+			cfg.PluralCount = args[0]
+			data["Count"] = args[0]
+			data["PluralCount"] = args[0]
+			args = args[1:]
+		}
+		for i := 0; i < len(args); i += 2 {
+			name, ok := args[i].(string)
+			if !ok {
+				log.Errorf("Invalid template data key %v for message %s", args[i], key)
+				continue
+			}
+			data[name] = args[i+1]
+		}
+		if len(data) > 0 {
+			cfg.TemplateData = data
+		}
+
 		// Create a localizer for given locale
 		localizer := i18n.NewLocalizer(b, locale)
-		msg, err := localizer.Localize(&i18n.LocalizeConfig{MessageID: key})
+		msg, err := localizer.Localize(cfg)
 		if err != nil {
-			return "<<" + key + ">>"
+			if msg == "" {
+				log.WithFields(logrus.Fields{
+					"key":    key,
+					"locale": locale,
+					"err":    err,
+				}).Warn("Failed to localize message")
+				return "<<" + key + ">>"
+			}
+			// Fallback to default locale
+			log.WithFields(logrus.Fields{
+				"key":    key,
+				"locale": locale,
+				"err":    err,
+			}).Debug("Message localized with fallback")
 		}
 		return msg
 	}
 
 	return localizer, names
 }
+
+// Picks the best locale for a request out of loaded ones
+type LocaleNegotiator struct {
+	names   []string
+	matcher language.Matcher
+	geo     *maxminddb.Reader
+	log     *logrus.Logger
+}
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// GeoIP detection is enabled if path to GeoIP DB is set
+func SetupLocaleNegotiator(log *logrus.Logger, locales []string, path string) *LocaleNegotiator {
+	// First supported tag is used by matcher as a fallback,
+	// so keep english at front if it exists
+	names := []string{}
+	if slices.Contains(locales, "en") {
+		names = append(names, "en")
+	}
+	for _, name := range locales {
+		if name != "en" {
+			names = append(names, name)
+		}
+	}
+	tags := []language.Tag{}
+	for _, name := range names {
+		tags = append(tags, language.Make(name))
+	}
+
+	n := &LocaleNegotiator{
+		names:   names,
+		matcher: language.NewMatcher(tags),
+		log:     log,
+	}
+
+	if path == "" {
+		log.Debug("GEOIP_DB not set; GeoIP locale detection disabled")
+		return n
+	}
+	geo, err := maxminddb.Open(path)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":  err,
+			"path": path,
+		}).Error("Failed to open GeoIP DB; GeoIP locale detection disabled")
+		return n
+	}
+	n.geo = geo
+	log.Debugf("Using GeoIP DB %s", path)
+	return n
+}
+
+// Returns loaded locale matching name or "" if there is no such locale
+func (n *LocaleNegotiator) Find(name string) string {
+	if slices.Contains(n.names, name) {
+		return name
+	}
+	return ""
+}
+
+// Negotiate locale by Accept-Language header value, and by client IP
+// if the header gives no usable match
+func (n *LocaleNegotiator) Negotiate(acceptLanguage string, ip string) string {
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err == nil && len(tags) > 0 {
+		_, idx, conf := n.matcher.Match(tags...)
+		if conf != language.No {
+			return n.names[idx]
+		}
+	}
+	if country := n.country(ip); country != "" {
+		region, err := language.ParseRegion(country)
+		if err == nil {
+			tag, err := language.Compose(region)
+			if err == nil {
+				_, idx, conf := n.matcher.Match(tag)
+				if conf != language.No {
+					return n.names[idx]
+				}
+			}
+		}
+	}
+	return n.names[0]
+}
+
+func (n *LocaleNegotiator) country(ip string) string {
+	if n.geo == nil {
+		return ""
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	var record geoRecord
+	if err := n.geo.Lookup(addr, &record); err != nil {
+		n.log.WithFields(logrus.Fields{
+			"err": err,
+			"ip":  ip,
+		}).Debug("GeoIP lookup failed")
+		return ""
+	}
+	return record.Country.ISOCode
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultLocale = "en"
+
+var (
+	// {{ T "Key" .Lang }}
+	tmplStaticKeyRe = regexp.MustCompile(`\bT\s+"([^"]+)"`)
+	// {{ T .SubmitButton .Lang }}; key is passed from Go code
+	tmplDynamicKeyRe = regexp.MustCompile(`\bT\s+\.(\w+)`)
+)
+
+// Functions taking localization key, with index of key argument
+var keyArgs = map[string]int{
+	"localize":     1, // h.localize(c, "Key")
+	"localizer":    0, // localizer("Key", ...)
+	"passkeyError": 2, // h.passkeyError(c, status, "Key")
+}
+
+// Keys referenced from templates and Go code
+type usedKeys struct {
+	keys     map[string][]string // Key -> places where it is used
+	prefixes map[string][]string // Prefix of dynamically built keys -> places
+}
+
+func (u *usedKeys) add(key, place string) {
+	u.keys[key] = append(u.keys[key], place)
+}
+
+func (u *usedKeys) addPrefix(prefix, place string) {
+	u.prefixes[prefix] = append(u.prefixes[prefix], place)
+}
+
+func (u *usedKeys) contains(key string) bool {
+	if _, ok := u.keys[key]; ok {
+		return true
+	}
+	for prefix := range u.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type localeFile struct {
+	name       string
+	messages   map[string]*i18n.Message
+	duplicates []string
+}
+
+type localeReport struct {
+	name         string
+	duplicates   []string
+	missing      []string // Used in code but not defined
+	untranslated []string // Defined in default locale but not in this one
+	plurals      []string // Plural in default locale but not in this one
+}
+
+func (r localeReport) failed() bool {
+	return len(r.duplicates)+len(r.missing)+len(r.untranslated)+len(r.plurals) > 0
+}
+
+func loadLocaleFile(path string) (localeFile, error) {
+	base := filepath.Base(path)
+	lf := localeFile{
+		name:     strings.TrimSuffix(base, filepath.Ext(base)),
+		messages: map[string]*i18n.Message{},
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return lf, err
+	}
+	mf, err := i18n.ParseMessageFileBytes(data, path, map[string]i18n.UnmarshalFunc{
+		"yaml": yaml.Unmarshal,
+	})
+	if err != nil {
+		return lf, err
+	}
+	for _, msg := range mf.Messages {
+		if _, ok := lf.messages[msg.ID]; ok {
+			lf.duplicates = append(lf.duplicates, msg.ID)
+		}
+		lf.messages[msg.ID] = msg
+	}
+	return lf, nil
+}
+
+func isPlural(msg *i18n.Message) bool {
+	return msg.Zero != "" || msg.One != "" || msg.Two != "" || msg.Few != "" || msg.Many != ""
+}
+
+// Extracts localization keys used in templates
+func extractTemplateKeys(pattern string, used *usedKeys) (dynamic []string, err error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			place := fmt.Sprintf("%s:%d", file, i+1)
+			for _, m := range tmplStaticKeyRe.FindAllStringSubmatch(line, -1) {
+				used.add(m[1], place)
+			}
+			for _, m := range tmplDynamicKeyRe.FindAllStringSubmatch(line, -1) {
+				if !slices.Contains(dynamic, m[1]) {
+					dynamic = append(dynamic, m[1])
+				}
+			}
+		}
+	}
+	return dynamic, nil
+}
+
+func stringLit(expr ast.Expr) (string, bool) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+	return s, err == nil
+}
+
+// Extracts localization keys used in Go code: arguments of functions from
+// keyArgs, plus values of template data fields which
+// are used by templates as dynamic keys (e.g. "SubmitButton": "CreateCard").
+// For keys built in runtime like "Prefix"+x or fmt.Sprintf("Prefix%d", x)
+// the prefix is recorded.
+func extractGoKeys(pattern string, dynamic []string, used *usedKeys) error {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			return err
+		}
+		addExpr := func(expr ast.Expr) {
+			place := fset.Position(expr.Pos()).String()
+			if key, ok := stringLit(expr); ok {
+				if key != "" { // No message
+					used.add(key, place)
+				}
+				return
+			}
+			switch e := expr.(type) {
+			case *ast.BinaryExpr:
+				if prefix, ok := stringLit(e.X); ok && e.Op == token.ADD {
+					used.addPrefix(prefix, place)
+				}
+			case *ast.CallExpr:
+				sel, ok := e.Fun.(*ast.SelectorExpr)
+				if !ok || sel.Sel.Name != "Sprintf" || len(e.Args) == 0 {
+					return
+				}
+				if format, ok := stringLit(e.Args[0]); ok {
+					prefix, _, _ := strings.Cut(format, "%")
+					used.addPrefix(prefix, place)
+				}
+			}
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch node := n.(type) {
+			case *ast.CallExpr:
+				var name string
+				switch fun := node.Fun.(type) {
+				case *ast.SelectorExpr:
+					name = fun.Sel.Name
+				case *ast.Ident:
+					name = fun.Name
+				}
+				if i, ok := keyArgs[name]; ok && len(node.Args) > i {
+					addExpr(node.Args[i])
+				}
+			case *ast.KeyValueExpr:
+				if key, ok := stringLit(node.Key); ok && slices.Contains(dynamic, key) {
+					addExpr(node.Value)
+				}
+			}
+			return true
+		})
+	}
+	return nil
+}
+
+// Keys used in templates and Go code
+func findUsedKeys(templates, sources string) (*usedKeys, error) {
+	used := &usedKeys{
+		keys:     map[string][]string{},
+		prefixes: map[string][]string{},
+	}
+	dynamic, err := extractTemplateKeys(templates, used)
+	if err != nil {
+		return nil, err
+	}
+	if err := extractGoKeys(sources, dynamic, used); err != nil {
+		return nil, err
+	}
+	return used, nil
+}
+
+// Loads all locale files from dir; default locale goes first
+func loadLocales(dir string) ([]localeFile, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	locales := []localeFile{}
+	for _, file := range files {
+		lf, err := loadLocaleFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load locale file %s: %w", file, err)
+		}
+		locales = append(locales, lf)
+	}
+	i := slices.IndexFunc(locales, func(lf localeFile) bool {
+		return lf.name == defaultLocale
+	})
+	if i < 0 {
+		return nil, fmt.Errorf("default locale %s not found in %s", defaultLocale, dir)
+	}
+	locales[0], locales[i] = locales[i], locales[0]
+	return locales, nil
+}
+
+// Compares locale with used keys and default locale
+func (lf localeFile) report(def localeFile, used *usedKeys) localeReport {
+	report := localeReport{name: lf.name, duplicates: lf.duplicates}
+	for key := range used.keys {
+		if _, found := lf.messages[key]; !found {
+			report.missing = append(report.missing, key)
+		}
+	}
+	for key, msg := range def.messages {
+		local, found := lf.messages[key]
+		if !found {
+			if used.contains(key) {
+				report.untranslated = append(report.untranslated, key)
+			}
+			continue
+		}
+		if isPlural(msg) && !isPlural(local) {
+			report.plurals = append(report.plurals, key)
+		}
+	}
+	slices.Sort(report.missing)
+	slices.Sort(report.untranslated)
+	slices.Sort(report.plurals)
+	return report
+}
+
+// Keys of default locale used nowhere
+func unusedKeys(def localeFile, used *usedKeys) []string {
+	unused := []string{}
+	for key := range def.messages {
+		if !used.contains(key) {
+			unused = append(unused, key)
+		}
+	}
+	slices.Sort(unused)
+	return unused
+}
+
+func checkLocales(dir, templates, sources string, out io.Writer) (bool, error) {
+	used, err := findUsedKeys(templates, sources)
+	if err != nil {
+		return false, err
+	}
+	locales, err := loadLocales(dir)
+	if err != nil {
+		return false, err
+	}
+
+	ok := true
+	for _, lf := range locales {
+		report := lf.report(locales[0], used)
+		fmt.Fprintf(out, "Locale %s: %d messages\n", lf.name, len(lf.messages))
+		printKeys(out, "duplicated", report.duplicates, nil)
+		printKeys(out, "missing", report.missing, used.keys)
+		printKeys(out, "untranslated", report.untranslated, nil)
+		printKeys(out, "not pluralized", report.plurals, nil)
+		if report.failed() {
+			ok = false
+		}
+	}
+	printKeys(out, "unused", unusedKeys(locales[0], used), nil)
+
+	return ok, nil
+}
+
+func printKeys(out io.Writer, kind string, keys []string, places map[string][]string) {
+	if len(keys) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "  %s (%d):\n", kind, len(keys))
+	for _, key := range keys {
+		if p := places[key]; len(p) > 0 {
+			fmt.Fprintf(out, "    %s (%s)\n", key, p[0])
+		} else {
+			fmt.Fprintf(out, "    %s\n", key)
+		}
+	}
+}
+
+// i18n check: reports missing, unused and untranslated localization keys.
+// Exits with non-zero code if any locale is incomplete.
+func i18nCommand(args []string) int {
+	if len(args) < 1 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: cards i18n check")
+		return 2
+	}
+	ok, err := checkLocales("locales", "templates/*.html", "*.go", os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
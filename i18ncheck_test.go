@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLocalesComplete(t *testing.T) {
+	used := &usedKeys{
+		keys:     map[string][]string{},
+		prefixes: map[string][]string{},
+	}
+	dynamic, err := extractTemplateKeys("templates/*.html", used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := extractGoKeys("*.go", dynamic, used); err != nil {
+		t.Fatal(err)
+	}
+	if len(used.keys) == 0 {
+		t.Fatal("no used keys found")
+	}
+	locales, err := loadLocales("locales")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lf := range locales {
+		report := lf.report(locales[0], used)
+		for _, key := range report.duplicates {
+			t.Errorf("%s: duplicated key %s", lf.name, key)
+		}
+		for _, key := range report.missing {
+			t.Errorf("%s: missing key %s used at %s", lf.name, key, used.keys[key][0])
+		}
+		for _, key := range report.untranslated {
+			t.Errorf("%s: untranslated key %s", lf.name, key)
+		}
+		for _, key := range report.plurals {
+			t.Errorf("%s: key %s is not pluralized", lf.name, key)
+		}
+	}
+	for _, key := range unusedKeys(locales[0], used) {
+		t.Errorf("unused key %s", key)
+	}
+}
+
+func TestExtractKeys(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("page.html", `<h1>{{ T "Title" .Lang }}</h1>
+<p>{{ T "Days" .Lang .Count }} {{ T .Button .Lang }}</p>`)
+	write("code.go", `package main
+
+func route(h *Handler, c *gin.Context, status int) {
+	h.localize(c, "ErrMsgStatic")
+	h.localize(c, "ErrCode"+status)
+	h.localize(c, fmt.Sprintf("Sort%s%s", a, b))
+	h.passkeyError(c, status, "ErrMsgPasskey")
+	h.passkeyError(c, status, "")
+	_ = gin.H{"Button": "Submit", "Other": "NotKey"}
+}
+`)
+	write("code_test.go", `package main
+
+func test(h *Handler) { h.localize(c, "FromTest") }
+`)
+
+	used := &usedKeys{
+		keys:     map[string][]string{},
+		prefixes: map[string][]string{},
+	}
+	dynamic, err := extractTemplateKeys(filepath.Join(dir, "*.html"), used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(dynamic, []string{"Button"}) {
+		t.Errorf("dynamic fields = %v, want [Button]", dynamic)
+	}
+	if err := extractGoKeys(filepath.Join(dir, "*.go"), dynamic, used); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for key := range used.keys {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	want := []string{"Days", "ErrMsgPasskey", "ErrMsgStatic", "Submit", "Title"}
+	if !slices.Equal(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+	for _, key := range []string{"ErrCode404", "SortNameAsc"} {
+		if !used.contains(key) {
+			t.Errorf("key %s built in runtime not found", key)
+		}
+	}
+	if used.contains("NotKey") || used.contains("FromTest") {
+		t.Error("unexpected keys found")
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	linkUserKey = "link_uid" // ID of user that requested linking new provider
+	linkTimeKey = "link_at"
+	linkTTL     = 15 * time.Minute
+)
+
+func (h *Handler) findProvider(name string) (LoginProvider, bool) {
+	for _, provider := range h.providers {
+		if provider.Name == name {
+			return provider, true
+		}
+	}
+	return LoginProvider{}, false
+}
+
+// Allows configured provider icons hosted on other origins
+func (h *Handler) allowProviderIcons(c *gin.Context) {
+	for _, provider := range h.providers {
+		u, err := url.Parse(provider.Icon)
+		if err == nil && u.Host != "" {
+			h.allowCSP(c, "img-src", u.Scheme+"://"+u.Host)
+		}
+	}
+}
+
+// Returns ID of signed in user if they requested linking new provider.
+// Request is consumed anyway.
+func (h *Handler) takeLinkIntent(c *gin.Context) (uint, bool) {
+	sess := sessions.Default(c)
+	uid, ok := sess.Get(linkUserKey).(uint)
+	at, _ := sess.Get(linkTimeKey).(int64)
+	if !ok {
+		return 0, false
+	}
+	sess.Delete(linkUserKey)
+	sess.Delete(linkTimeKey)
+	sess.Save()
+	if time.Since(time.Unix(at, 0)) > linkTTL {
+		return 0, false
+	}
+	user := getUser(c)
+	if user == nil || user.ID != uid {
+		return 0, false
+	}
+	return uid, true
+}
+
+// Completes login with provider identity. If signed in user requested
+// linking new provider, the identity is linked to their account instead.
+// Optional role maps current role of user to the one from provider.
+func (h *Handler) signIn(c *gin.Context, pid, name string, role func(Role) Role) {
+	if uid, ok := h.takeLinkIntent(c); ok {
+		h.linkIdentity(c, uid, pid, name)
+		return
+	}
+
+	id, err := h.db.SignUser(pid, name)
+
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to complete auth")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedAuth500"),
+		)
+		return
+	}
+
+	if role != nil {
+		if err := h.applyRole(id, role); err != nil {
+			h.log.WithFields(logrus.Fields{
+				"err": err,
+				"uid": id,
+			}).Error("Failed to apply role from provider")
+		}
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"pid":  pid,
+		"uid":  id,
+		"name": name,
+	}).Info("Logged in")
+	if err := h.startSession(c, id, false); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to start session")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedAuth500"),
+		)
+		return
+	}
+
+	redirect(c, "/cards")
+}
+
+func (h *Handler) applyRole(id string, role func(Role) Role) error {
+	uid, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return err
+	}
+	user := User{ID: uint(uid)}
+	if err := h.db.GetUser(&user); err != nil {
+		return err
+	}
+	next := role(user.Role)
+	if next == user.Role {
+		return nil
+	}
+	h.log.WithFields(logrus.Fields{
+		"uid":  user.ID,
+		"from": user.Role,
+		"to":   next,
+	}).Info("User role changed by provider claims")
+	user.Role = next
+	return h.db.UpdateUser(user)
+}
+
+func (h *Handler) linkIdentity(c *gin.Context, uid uint, pid, name string) {
+	err := h.db.LinkIdentity(uid, pid, name)
+
+	if errors.Is(err, ErrIdentityTaken) {
+		h.errorPage(
+			c,
+			http.StatusConflict,
+			h.localize(c, "ErrMsgIdentityTaken"),
+		)
+		return
+	}
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to link identity")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToLinkIdentity"),
+		)
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"pid": pid,
+		"uid": uid,
+	}).Info("Identity linked")
+
+	redirect(c, "/identities")
+}
+
+func (h *Handler) identitiesRoute(c *gin.Context) {
+	user := getUser(c)
+
+	identities, err := h.db.ListIdentities(user.ID)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to list identities")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToListIdentities"),
+		)
+		return
+	}
+
+	h.allowProviderIcons(c)
+	h.execHTML(c, http.StatusOK, "page_identities.html", gin.H{
+		"Title":      h.localize(c, "TitleIdentities"),
+		"Identities": identities,
+		"Providers":  h.providers,
+	})
+}
+
+// Remembers linking request and sends user to provider login page
+func (h *Handler) linkIdentityRoute(c *gin.Context) {
+	user := getUser(c)
+	provider, ok := h.findProvider(c.Param("provider"))
+
+	if !ok {
+		h.errorBlock(c, http.StatusNotFound, "")
+		return
+	}
+
+	sess := sessions.Default(c)
+	sess.Set(linkUserKey, user.ID)
+	sess.Set(linkTimeKey, time.Now().Unix())
+	sess.Save()
+
+	redirect(c, provider.URL)
+}
+
+func (h *Handler) unlinkIdentityRoute(c *gin.Context) {
+	user := getUser(c)
+	pid := c.PostForm("pid")
+
+	err := h.db.UnlinkIdentity(user.ID, pid)
+
+	if errors.Is(err, ErrLastIdentity) {
+		h.errorBlock(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgLastIdentity"),
+		)
+		return
+	}
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to unlink identity")
+		h.errorBlock(c, http.StatusNotFound, "")
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"pid": pid,
+		"uid": user.ID,
+	}).Info("Identity unlinked")
+
+	redirect(c, "/identities")
+}
+
+// Merges user from :id param into one from "into" form field
+func (h *Handler) mergeUserRoute(c *gin.Context) {
+	user := getUser(c)
+
+	if !user.Can(PermUsersManage, 0) {
+		h.errorPage(c, http.StatusNotFound, "")
+		return
+	}
+
+	src, err := getUintParam(c, "id")
+	dst, e := strconv.ParseUint(c.PostForm("into"), 10, 64)
+	if err != nil || e != nil || src == uint(dst) {
+		h.errorBlock(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgBrokenUserID"),
+		)
+		return
+	}
+
+	err = h.db.MergeUsers(uint(dst), src)
+	if errors.Is(err, ErrSubscribed) {
+		h.errorBlock(
+			c,
+			http.StatusConflict,
+			h.localize(c, "ErrMsgMergeSubscribed"),
+		)
+		return
+	}
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"src": src,
+			"dst": dst,
+		}).Error("Failed to merge users")
+		h.errorBlock(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToMergeUsers"),
+		)
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"admin": user.ID,
+		"src":   src,
+		"dst":   dst,
+	}).Info("Users merged")
+	h.audit(c, user.ID, AuditUsersMerged, auditTarget("user", src), map[string]any{
+		"into": dst,
+	})
+	h.gallery.purge()
+
+	redirect(c, "/users")
+}
@@ -0,0 +1,766 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/quotedprintable"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxImportRows   = 500
+	maxImportSize   = 20 << 20    // vCard files with photos are large
+	maxPhotoPixels  = 5000 * 5000 // Of decoded photo
+	importTTL       = 30 * time.Minute
+	importFieldSkip = "" // Column is not imported
+)
+
+// Card fields that can be imported, in order of CSV mapping options
+var importFields = []string{"name", "company", "position", "description", "phone", "email", "telegram", "whatsapp", "vk"}
+
+// Common CSV headers of other apps -> field
+var importAliases = map[string]string{
+	"full name":    "name",
+	"fn":           "name",
+	"organization": "company",
+	"org":          "company",
+	"title":        "position",
+	"job title":    "position",
+	"note":         "description",
+	"notes":        "description",
+	"tel":          "phone",
+	"mobile":       "phone",
+	"telephone":    "phone",
+	"e-mail":       "email",
+	"mail":         "email",
+}
+
+// Photo types accepted as avatars -> file extension
+var importPhotoTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+func setImportField(fields *CardFields, field, value string) {
+	value = strings.TrimSpace(value)
+	switch field {
+	case "name":
+		fields.Name = value
+	case "company":
+		fields.Company = value
+	case "position":
+		fields.Position = value
+	case "description":
+		fields.Description = value
+	case "phone":
+		fields.Phone = value
+	case "email":
+		fields.Email = value
+	case "telegram":
+		fields.Telegram = strings.TrimPrefix(value, "@")
+	case "whatsapp":
+		fields.Whatsapp = value
+	case "vk":
+		fields.VK = value
+	}
+}
+
+// Guesses field from CSV header
+func guessImportField(header string) string {
+	header = strings.ToLower(strings.TrimSpace(header))
+	for _, field := range importFields {
+		if header == field {
+			return field
+		}
+	}
+	return importAliases[header]
+}
+
+type importRow struct {
+	Line     int // Row number in CSV file or contact number in vCard one
+	Fields   CardFields
+	Photo    []byte
+	BadPhoto bool   // Photo is not an image of accepted type
+	Err      string // Localized validation or creation error
+}
+
+// Uploaded file waiting for confirmation. Files are kept in memory for
+// importTTL, so import works only on single instance deployments.
+type pendingImport struct {
+	mu      sync.Mutex
+	ID      string
+	UserID  uint // Who uploaded the file
+	Owner   uint // Owner of created cards
+	Org     uint
+	Kind    string     // csv or vcf
+	Header  []string   // CSV only
+	Records [][]string // CSV only
+	Mapping []string   // CSV only; field of every column
+	Rows    []importRow
+	Done    bool
+	Report  []byte // CSV with failed rows after import
+	Created time.Time
+}
+
+// Maps CSV records to rows with current mapping
+func (imp *pendingImport) mapRows() {
+	if imp.Kind != "csv" {
+		return
+	}
+	imp.Rows = make([]importRow, 0, len(imp.Records))
+	for i, record := range imp.Records {
+		row := importRow{Line: i + 2} // Header is the first line
+		for col, value := range record {
+			if col < len(imp.Mapping) {
+				setImportField(&row.Fields, imp.Mapping[col], value)
+			}
+		}
+		imp.Rows = append(imp.Rows, row)
+	}
+}
+
+type importStore struct {
+	mu    sync.Mutex
+	items map[string]*pendingImport
+}
+
+func newImportStore() *importStore {
+	return &importStore{items: map[string]*pendingImport{}}
+}
+
+// Stores import replacing previous one of the same user, so each user
+// keeps at most one file in memory
+func (s *importStore) put(imp *pendingImport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, item := range s.items {
+		if now.Sub(item.Created) > importTTL || item.UserID == imp.UserID {
+			delete(s.items, id)
+		}
+	}
+	s.items[imp.ID] = imp
+}
+
+// Returns import uploaded by user; imports are not shared
+func (s *importStore) get(id string, uid uint) (*pendingImport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	imp, ok := s.items[id]
+	if !ok || imp.UserID != uid || time.Since(imp.Created) > importTTL {
+		return nil, false
+	}
+	return imp, true
+}
+
+// Parses CSV file with header row; both comma and semicolon separated
+// files are accepted
+func parseImportCSV(data []byte) ([]string, [][]string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) // BOM added by Excel
+	first, _, _ := bytes.Cut(data, []byte("\n"))
+	r := csv.NewReader(bytes.NewReader(data))
+	if bytes.Count(first, []byte(";")) > bytes.Count(first, []byte(",")) {
+		r.Comma = ';'
+	}
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) < 2 {
+		return nil, nil, errors.New("no rows after header")
+	}
+	return records[0], records[1:], nil
+}
+
+func unescapeVCard(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+// Splits structured vCard value on unescaped semicolons
+func splitVCard(value string) []string {
+	parts := []string{}
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case ';':
+			parts = append(parts, unescapeVCard(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, unescapeVCard(value[start:]))
+}
+
+func decodeVCardPhoto(params []string, value string) []byte {
+	if rest, ok := strings.CutPrefix(value, "data:"); ok {
+		meta, payload, _ := strings.Cut(rest, ",")
+		if !strings.HasSuffix(meta, ";base64") {
+			return nil
+		}
+		value = payload
+	} else if !containsFold(params, "ENCODING=B", "ENCODING=BASE64", "BASE64") {
+		return nil // Photo URL
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Photos are published as avatars, so metadata like EXIF with GPS location
+// is dropped: JPEG, PNG and GIF are re-encoded (only the first GIF frame is
+// kept) and metadata chunks are removed from WebP, as there is no encoder
+// for it.
+func cleanImportPhoto(data []byte) ([]byte, error) {
+	format := http.DetectContentType(data)
+	switch format {
+	case "image/webp":
+		return stripWebPMetadata(data)
+	case "image/jpeg", "image/png", "image/gif":
+	default:
+		return nil, fmt.Errorf("unsupported photo type %s", format)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxPhotoPixels {
+		return nil, fmt.Errorf("photo is too large: %dx%d", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	switch format {
+	case "image/jpeg":
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: 90})
+	case "image/png":
+		err = png.Encode(buf, img)
+	case "image/gif":
+		err = gif.Encode(buf, img, nil)
+	}
+	return buf.Bytes(), err
+}
+
+// Drops EXIF and XMP chunks of WebP file and clears their VP8X flags
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("invalid WebP header")
+	}
+	out := bytes.Clone(data[:12])
+	rest := data[12:]
+	for len(rest) > 0 {
+		if len(rest) < 8 {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		size := uint64(binary.LittleEndian.Uint32(rest[4:8]))
+		end := 8 + size + size&1 // Chunks are padded to even size
+		if end > uint64(len(rest)) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		chunk := rest[:end]
+		rest = rest[end:]
+		switch string(chunk[:4]) {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			chunk = bytes.Clone(chunk)
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04 // EXIF and XMP flags
+			}
+		}
+		out = append(out, chunk...)
+	}
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, nil
+}
+
+func containsFold(list []string, values ...string) bool {
+	for _, item := range list {
+		for _, value := range values {
+			if strings.EqualFold(item, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Parses multi-contact vCard file of versions 2.1, 3.0 or 4.0
+func parseVCards(data []byte) ([]importRow, error) {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	// Unfold continuation lines
+	text = strings.ReplaceAll(text, "\n ", "")
+	text = strings.ReplaceAll(text, "\n\t", "")
+
+	rows := []importRow{}
+	cur := -1
+	for _, line := range strings.Split(text, "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		params := strings.Split(name, ";")
+		prop := strings.ToUpper(params[0])
+		// Grouped properties like "item1.TEL"
+		if i := strings.LastIndex(prop, "."); i >= 0 {
+			prop = prop[i+1:]
+		}
+		if prop == "BEGIN" && strings.EqualFold(value, "VCARD") {
+			rows = append(rows, importRow{Line: len(rows) + 1})
+			cur = len(rows) - 1
+			continue
+		}
+		if cur < 0 {
+			continue
+		}
+		if prop == "END" {
+			cur = -1
+			continue
+		}
+		if containsFold(params, "ENCODING=QUOTED-PRINTABLE") {
+			if decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(value))); err == nil {
+				value = string(decoded)
+			}
+		}
+
+		fields := &rows[cur].Fields
+		switch prop {
+		case "FN":
+			fields.Name = strings.TrimSpace(unescapeVCard(value))
+		case "N":
+			// Family;Given;Additional;Prefixes;Suffixes
+			if fields.Name == "" {
+				parts := splitVCard(value)
+				if len(parts) > 1 {
+					parts[0], parts[1] = parts[1], parts[0]
+				}
+				fields.Name = strings.Join(strings.Fields(strings.Join(parts, " ")), " ")
+			}
+		case "ORG":
+			fields.Company = strings.TrimSpace(splitVCard(value)[0])
+		case "TITLE":
+			setImportField(fields, "position", unescapeVCard(value))
+		case "NOTE":
+			setImportField(fields, "description", unescapeVCard(value))
+		case "TEL":
+			if fields.Phone == "" {
+				setImportField(fields, "phone", strings.TrimPrefix(value, "tel:"))
+			}
+		case "EMAIL":
+			if fields.Email == "" {
+				setImportField(fields, "email", value)
+			}
+		case "URL", "X-SOCIALPROFILE", "IMPP":
+			value = unescapeVCard(value)
+			switch {
+			case strings.Contains(value, "t.me/"):
+				setImportField(fields, "telegram", value[strings.LastIndex(value, "/")+1:])
+			case strings.Contains(value, "wa.me/"):
+				setImportField(fields, "whatsapp", value)
+			case strings.Contains(value, "vk.com/"):
+				setImportField(fields, "vk", value)
+			}
+		case "PHOTO":
+			rows[cur].Photo = decodeVCardPhoto(params[1:], value)
+		}
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no contacts in file")
+	}
+	return rows, nil
+}
+
+// Validates rows against CardFields binding rules; returns number of
+// valid rows
+func (h *Handler) validateImportRows(c *gin.Context, rows []importRow) int {
+	valid := 0
+	for i := range rows {
+		row := &rows[i]
+		row.Err = ""
+		err := binding.Validator.ValidateStruct(&row.Fields)
+		var errs validator.ValidationErrors
+		if errors.As(err, &errs) && len(errs) > 0 {
+			field := h.localize(c, "ImportField"+camelKey(strings.ToLower(errs[0].Field())))
+			switch errs[0].Tag() {
+			case "required":
+				row.Err = h.localize(c, "ImportErrRequired", "Field", field)
+			case "email":
+				row.Err = h.localize(c, "ImportErrEmail", "Field", field)
+			default:
+				row.Err = h.localize(c, "ImportErrInvalid", "Field", field)
+			}
+		} else if err != nil {
+			row.Err = err.Error()
+		} else if row.BadPhoto || int64(len(row.Photo)) > h.maxUploadSize {
+			row.Err = h.localize(c, "ImportErrPhoto")
+		}
+		if row.Err == "" {
+			valid++
+		}
+	}
+	return valid
+}
+
+func importURL(imp *pendingImport) string {
+	return "/import/" + imp.ID
+}
+
+// Upload form. Org cards are imported with "org" and optional "owner"
+// query params, as in editor.
+func (h *Handler) importRoute(c *gin.Context) {
+	if _, _, ok := h.newCardTarget(c, getUser(c)); !ok {
+		return
+	}
+
+	h.execHTML(c, http.StatusOK, "page_import.html", gin.H{
+		"Title":  h.localize(c, "TitleImport"),
+		"Action": "/import?" + c.Request.URL.RawQuery,
+	})
+}
+
+func (h *Handler) uploadImportRoute(c *gin.Context) {
+	user := getUser(c)
+
+	owner, org, ok := h.newCardTarget(c, user)
+	if !ok {
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil || file.Size > maxImportSize {
+		h.errorPage(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgImportFile"),
+		)
+		return
+	}
+	src, err := file.Open()
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(src)
+		src.Close()
+	}
+	if err != nil {
+		h.errorPage(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgImportFile"),
+		)
+		return
+	}
+
+	imp := &pendingImport{
+		ID:      uuid.New().String(),
+		UserID:  user.ID,
+		Owner:   owner,
+		Org:     org,
+		Created: time.Now(),
+	}
+	if bytes.Contains(bytes.ToUpper(data[:min(len(data), 1024)]), []byte("BEGIN:VCARD")) {
+		imp.Kind = "vcf"
+		imp.Rows, err = parseVCards(data)
+	} else {
+		imp.Kind = "csv"
+		imp.Header, imp.Records, err = parseImportCSV(data)
+		for _, header := range imp.Header {
+			imp.Mapping = append(imp.Mapping, guessImportField(header))
+		}
+		imp.mapRows()
+	}
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err":  err,
+			"file": file.Filename,
+		}).Debug("Failed to parse import file")
+		h.errorPage(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgImportFile"),
+		)
+		return
+	}
+	if len(imp.Rows) > maxImportRows {
+		h.errorPage(
+			c,
+			http.StatusRequestEntityTooLarge,
+			h.localize(c, "ErrMsgTooManyImportRows", "Max", maxImportRows),
+		)
+		return
+	}
+
+	for i := range imp.Rows {
+		row := &imp.Rows[i]
+		if row.Photo == nil {
+			continue
+		}
+		photo, err := cleanImportPhoto(row.Photo)
+		if err != nil {
+			h.log.WithFields(logrus.Fields{
+				"err":  err,
+				"line": row.Line,
+			}).Debug("Failed to clean imported photo")
+		}
+		row.Photo, row.BadPhoto = photo, err != nil
+	}
+
+	h.imports.put(imp)
+	redirect(c, importURL(imp))
+}
+
+// Preview of parsed rows with validation errors and CSV column mapping
+func (h *Handler) importPreviewRoute(c *gin.Context) {
+	imp, ok := h.imports.get(c.Param("id"), getUser(c).ID)
+	if !ok {
+		h.errorPage(
+			c,
+			http.StatusNotFound,
+			h.localize(c, "ErrMsgImportExpired"),
+		)
+		return
+	}
+	imp.mu.Lock()
+	defer imp.mu.Unlock()
+
+	if imp.Done {
+		h.importResult(c, imp)
+		return
+	}
+
+	valid := h.validateImportRows(c, imp.Rows)
+
+	fields := []gin.H{}
+	for _, field := range importFields {
+		fields = append(fields, gin.H{
+			"ID":    field,
+			"Label": h.localize(c, "ImportField"+camelKey(field)),
+		})
+	}
+
+	columns := []gin.H{}
+	for i, header := range imp.Header {
+		columns = append(columns, gin.H{
+			"Index":  i,
+			"Header": header,
+			"Field":  imp.Mapping[i],
+		})
+	}
+
+	h.execHTML(c, http.StatusOK, "page_import.html", gin.H{
+		"Title":   h.localize(c, "TitleImport"),
+		"Import":  imp,
+		"Columns": columns,
+		"Fields":  fields,
+		"Valid":   valid,
+		"Invalid": len(imp.Rows) - valid,
+	})
+}
+
+// Updates CSV column mapping from "col-<index>" form fields
+func (h *Handler) importMappingRoute(c *gin.Context) {
+	imp, ok := h.imports.get(c.Param("id"), getUser(c).ID)
+	if ok {
+		imp.mu.Lock()
+		defer imp.mu.Unlock()
+	}
+	if !ok || imp.Done {
+		h.errorPage(
+			c,
+			http.StatusNotFound,
+			h.localize(c, "ErrMsgImportExpired"),
+		)
+		return
+	}
+
+	for i := range imp.Mapping {
+		field := c.PostForm(fmt.Sprintf("col-%d", i))
+		if field != importFieldSkip && guessImportField(field) != field {
+			field = importFieldSkip
+		}
+		imp.Mapping[i] = field
+	}
+	imp.mapRows()
+
+	redirect(c, importURL(imp))
+}
+
+// Creates cards from valid rows
+func (h *Handler) confirmImportRoute(c *gin.Context) {
+	imp, ok := h.imports.get(c.Param("id"), getUser(c).ID)
+	if ok {
+		imp.mu.Lock()
+		defer imp.mu.Unlock()
+	}
+	if !ok || imp.Done {
+		h.errorPage(
+			c,
+			http.StatusNotFound,
+			h.localize(c, "ErrMsgImportExpired"),
+		)
+		return
+	}
+
+	valid := h.validateImportRows(c, imp.Rows)
+	photos := int64(0)
+	for _, row := range imp.Rows {
+		if row.Err == "" {
+			photos += int64(len(row.Photo))
+		}
+	}
+	if valid == 0 || !h.checkQuota(c, imp.Owner, valid, photos) {
+		if valid == 0 {
+			redirect(c, importURL(imp))
+		}
+		return
+	}
+
+	listed := false
+	for i := range imp.Rows {
+		row := &imp.Rows[i]
+		if row.Err != "" {
+			continue
+		}
+		listed = listed || row.Fields.Listed
+		if err := h.importCard(imp, row); err != nil {
+			h.log.WithFields(logrus.Fields{
+				"err":  err,
+				"line": row.Line,
+			}).Error("Failed to import card")
+			row.Err = h.localize(c, "ErrMsgFailedToCreateCard500")
+		}
+	}
+	imp.Done = true
+	if listed {
+		h.gallery.purge()
+	}
+
+	report := &bytes.Buffer{}
+	w := csv.NewWriter(report)
+	w.Write([]string{"row", "name", "email", "error"})
+	for _, row := range imp.Rows {
+		if row.Err != "" {
+			w.Write([]string{fmt.Sprint(row.Line), row.Fields.Name, row.Fields.Email, row.Err})
+		}
+	}
+	w.Flush()
+	imp.Report = report.Bytes()
+
+	h.log.WithFields(logrus.Fields{
+		"uid":   imp.UserID,
+		"owner": imp.Owner,
+		"org":   imp.Org,
+		"rows":  len(imp.Rows),
+	}).Info("Cards imported")
+
+	redirect(c, importURL(imp))
+}
+
+// Card is deleted if its photo or org can't be saved, so failed row can
+// be imported again without duplicates
+func (h *Handler) importCard(imp *pendingImport, row *importRow) error {
+	card, err := h.db.CreateCard(imp.Owner, row.Fields)
+	if err != nil {
+		return err
+	}
+	card.OrgID = imp.Org
+	if row.Photo != nil {
+		ext := importPhotoTypes[http.DetectContentType(row.Photo)]
+		key := fmt.Sprintf("media/avatar/%d-%s%s", card.ID, uuid.New().String(), ext)
+		err = h.storage.WriteKey(h.ctx, key, bytes.NewReader(row.Photo), int64(len(row.Photo)), true)
+		if err == nil {
+			card.Avatar = key
+			card.AvatarSize = int64(len(row.Photo))
+		}
+	}
+	if err == nil && (card.OrgID != 0 || card.Avatar != "") {
+		err = h.db.UpdateCard(card)
+	}
+	if err == nil {
+		return nil
+	}
+
+	if delErr := h.db.DeleteCard(card.ID); delErr != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": delErr,
+			"cid": card.ID,
+		}).Error("Failed to delete partially imported card")
+	}
+	// Avatar is not deleted with card if the card was not updated
+	if card.Avatar != "" {
+		if delErr := h.storage.DelKey(h.ctx, card.Avatar); delErr != nil {
+			h.log.WithFields(logrus.Fields{
+				"err": delErr,
+				"key": card.Avatar,
+			}).Warn("Failed to delete imported photo")
+		}
+	}
+	return err
+}
+
+func (h *Handler) importResult(c *gin.Context, imp *pendingImport) {
+	failed := 0
+	for _, row := range imp.Rows {
+		if row.Err != "" {
+			failed++
+		}
+	}
+
+	back := "/cards"
+	if imp.Org != 0 {
+		back = fmt.Sprintf("/orgs/%d", imp.Org)
+	}
+
+	h.execHTML(c, http.StatusOK, "page_import.html", gin.H{
+		"Title":   h.localize(c, "TitleImport"),
+		"Import":  imp,
+		"Created": len(imp.Rows) - failed,
+		"Failed":  failed,
+		"Back":    back,
+	})
+}
+
+// Downloadable CSV with rows that were not imported
+func (h *Handler) importReportRoute(c *gin.Context) {
+	imp, ok := h.imports.get(c.Param("id"), getUser(c).ID)
+	if ok {
+		imp.mu.Lock()
+		defer imp.mu.Unlock()
+	}
+	if !ok || !imp.Done {
+		h.errorPage(
+			c,
+			http.StatusNotFound,
+			h.localize(c, "ErrMsgImportExpired"),
+		)
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="import-failures.csv"`)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", imp.Report)
+}
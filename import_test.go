@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseImportCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		header  []string
+		records [][]string
+	}{
+		{
+			"comma",
+			"Name,Email\nAlice,alice@example.com\n",
+			[]string{"Name", "Email"},
+			[][]string{{"Alice", "alice@example.com"}},
+		},
+		{
+			"semicolon",
+			"Name;Company;Notes\nAlice;Acme, Inc.;\"Line 1\nLine 2\"\n",
+			[]string{"Name", "Company", "Notes"},
+			[][]string{{"Alice", "Acme, Inc.", "Line 1\nLine 2"}},
+		},
+		{
+			"Excel BOM and CRLF",
+			"\xef\xbb\xbfName;Phone\r\nAlice;+1 555\r\nBob;+1 556\r\n",
+			[]string{"Name", "Phone"},
+			[][]string{{"Alice", "+1 555"}, {"Bob", "+1 556"}},
+		},
+		{
+			"ragged rows",
+			"Name,Email,Phone\nAlice\nBob,bob@example.com,+1,extra\n",
+			[]string{"Name", "Email", "Phone"},
+			[][]string{{"Alice"}, {"Bob", "bob@example.com", "+1", "extra"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, records, err := parseImportCSV([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(header, tt.header) {
+				t.Errorf("header = %q, want %q", header, tt.header)
+			}
+			if !slices.EqualFunc(records, tt.records, slices.Equal) {
+				t.Errorf("records = %q, want %q", records, tt.records)
+			}
+		})
+	}
+
+	for _, data := range []string{"", "Name,Email\n"} {
+		if _, _, err := parseImportCSV([]byte(data)); err == nil {
+			t.Errorf("%q parsed without rows", data)
+		}
+	}
+}
+
+func TestGuessImportField(t *testing.T) {
+	tests := map[string]string{
+		"Name":        "name",
+		" E-mail ":    "email",
+		"Job Title":   "position",
+		"ORG":         "company",
+		"Mobile":      "phone",
+		"Birthday":    importFieldSkip,
+		"description": "description",
+	}
+	for header, want := range tests {
+		if got := guessImportField(header); got != want {
+			t.Errorf("guessImportField(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestSplitVCard(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"Doe;John;;;", []string{"Doe", "John", "", "", ""}},
+		{`Acme\; Inc;R\&D`, []string{"Acme; Inc", `R\&D`}},
+		{`A\,B\nC;D\\;E`, []string{"A,B\nC", `D\`, "E"}},
+		{"single", []string{"single"}},
+		{"", []string{""}},
+	}
+	for _, tt := range tests {
+		if got := splitVCard(tt.value); !slices.Equal(got, tt.want) {
+			t.Errorf("splitVCard(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseVCards(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		want  []CardFields
+		photo []string
+	}{
+		{
+			"vCard 3.0",
+			"BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Alice Smith\r\nORG:Acme\\, Inc.;Sales\r\n" +
+				"TITLE:Manager\r\nNOTE:Line 1\\nLine 2\r\nTEL;TYPE=CELL:+1 555\r\nTEL:+1 556\r\n" +
+				"EMAIL:alice@example.com\r\nURL:https://t.me/alice\r\nEND:VCARD\r\n",
+			[]CardFields{{
+				Name:        "Alice Smith",
+				Company:     "Acme, Inc.",
+				Position:    "Manager",
+				Description: "Line 1\nLine 2",
+				Phone:       "+1 555",
+				Email:       "alice@example.com",
+				Telegram:    "alice",
+			}},
+			[]string{""},
+		},
+		{
+			"name from N and several contacts",
+			"BEGIN:VCARD\nN:Doe;John;;Dr.;\nEND:VCARD\nBEGIN:VCARD\nN:Roe;Jane\nFN:Jane R.\nEND:VCARD\n",
+			[]CardFields{{Name: "John Doe Dr."}, {Name: "Jane R."}},
+			[]string{"", ""},
+		},
+		{
+			"vCard 2.1 quoted-printable",
+			"BEGIN:VCARD\r\nVERSION:2.1\r\nFN;CHARSET=UTF-8;ENCODING=QUOTED-PRINTABLE:=D0=98=D0=B2=D0=B0=D0=BD\r\n" +
+				"NOTE;ENCODING=QUOTED-PRINTABLE:caf=C3=A9\r\nEND:VCARD\r\n",
+			[]CardFields{{Name: "Иван", Description: "café"}},
+			[]string{""},
+		},
+		{
+			"folded lines",
+			"BEGIN:VCARD\r\nFN:Alice\r\n  Smith\r\nNOTE:very\r\n\tlong\r\nEND:VCARD\r\n",
+			[]CardFields{{Name: "Alice Smith", Description: "verylong"}},
+			[]string{""},
+		},
+		{
+			"grouped properties",
+			"BEGIN:VCARD\nFN:Alice\nitem1.TEL:+1 555\nitem1.X-ABLabel:work\nitem2.EMAIL;type=INTERNET:alice@example.com\n" +
+				"item3.URL:https://vk.com/alice\nitem4.X-SOCIALPROFILE;type=whatsapp:https://wa.me/1555\nEND:VCARD\n",
+			[]CardFields{{
+				Name:     "Alice",
+				Phone:    "+1 555",
+				Email:    "alice@example.com",
+				VK:       "https://vk.com/alice",
+				Whatsapp: "https://wa.me/1555",
+			}},
+			[]string{""},
+		},
+		{
+			"vCard 4.0 data URI photo",
+			"BEGIN:VCARD\nVERSION:4.0\nFN:Alice\nTEL;VALUE=uri:tel:+1555\nPHOTO:data:image/jpeg;base64,aGVsbG8=\nEND:VCARD\n",
+			[]CardFields{{Name: "Alice", Phone: "+1555"}},
+			[]string{"hello"},
+		},
+		{
+			"vCard 3.0 base64 photo",
+			"BEGIN:VCARD\nFN:Alice\nPHOTO;ENCODING=b;TYPE=JPEG:aGVs\n bG8=\nEND:VCARD\n",
+			[]CardFields{{Name: "Alice"}},
+			[]string{"hello"},
+		},
+		{
+			"vCard 2.1 base64 photo",
+			"BEGIN:VCARD\nFN:Alice\nPHOTO;JPEG;ENCODING=BASE64:aGVsbG8=\nEND:VCARD\n",
+			[]CardFields{{Name: "Alice"}},
+			[]string{"hello"},
+		},
+		{
+			"photo URL and data URI without base64",
+			"BEGIN:VCARD\nFN:Alice\nPHOTO;VALUE=uri:https://example.com/a.jpg\nEND:VCARD\n" +
+				"BEGIN:VCARD\nFN:Bob\nPHOTO:data:image/jpeg,raw\nEND:VCARD\n",
+			[]CardFields{{Name: "Alice"}, {Name: "Bob"}},
+			[]string{"", ""},
+		},
+		{
+			"lines outside of vCard",
+			"FN:Nobody\nBEGIN:VCARD\nFN:Alice\nEND:VCARD\nFN:Other\n",
+			[]CardFields{{Name: "Alice"}},
+			[]string{""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parseVCards([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != len(tt.want) {
+				t.Fatalf("got %d rows, want %d", len(rows), len(tt.want))
+			}
+			for i, row := range rows {
+				if row.Line != i+1 {
+					t.Errorf("row %d: line = %d", i, row.Line)
+				}
+				if !reflect.DeepEqual(row.Fields, tt.want[i]) {
+					t.Errorf("row %d:\n%+v\nwant\n%+v", i, row.Fields, tt.want[i])
+				}
+				if string(row.Photo) != tt.photo[i] {
+					t.Errorf("row %d: photo = %q, want %q", i, row.Photo, tt.photo[i])
+				}
+			}
+		})
+	}
+
+	for _, data := range []string{"", "FN:Alice\nTEL:+1 555\n", strings.Repeat("garbage\n", 10)} {
+		if _, err := parseVCards([]byte(data)); err == nil {
+			t.Errorf("%q parsed without contacts", data)
+		}
+	}
+}
+
+func TestImportStore(t *testing.T) {
+	s := newImportStore()
+	first := &pendingImport{ID: "first", UserID: 1, Created: time.Now()}
+	other := &pendingImport{ID: "other", UserID: 2, Created: time.Now()}
+	s.put(first)
+	s.put(other)
+	if _, ok := s.get("first", 2); ok {
+		t.Error("import of other user returned")
+	}
+	if imp, ok := s.get("first", 1); !ok || imp != first {
+		t.Error("import not found")
+	}
+
+	s.put(&pendingImport{ID: "second", UserID: 1, Created: time.Now()})
+	if _, ok := s.get("first", 1); ok {
+		t.Error("previous import of user kept")
+	}
+	if _, ok := s.get("second", 1); !ok {
+		t.Error("new import not found")
+	}
+	if _, ok := s.get("other", 2); !ok {
+		t.Error("import of other user dropped")
+	}
+
+	s.put(&pendingImport{ID: "old", UserID: 3, Created: time.Now().Add(-importTTL - time.Minute)})
+	if _, ok := s.get("old", 3); ok {
+		t.Error("expired import returned")
+	}
+	s.put(&pendingImport{ID: "third", UserID: 4, Created: time.Now()})
+	if len(s.items) != 3 {
+		t.Errorf("%d imports stored, want 3", len(s.items))
+	}
+}
+
+func TestCleanImportPhoto(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	img.Set(1, 1, color.RGBA{R: 255, A: 255})
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	// APP1 segment with EXIF right after SOI marker
+	payload := []byte("Exif\x00\x00GPS-SECRET")
+	app1 := append([]byte{0xff, 0xe1, 0, byte(len(payload) + 2)}, payload...)
+	photo := append(append([]byte{0xff, 0xd8}, app1...), buf.Bytes()[2:]...)
+	if _, _, err := image.Decode(bytes.NewReader(photo)); err != nil {
+		t.Fatalf("test photo is broken: %v", err)
+	}
+
+	clean, err := cleanImportPhoto(photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(clean, []byte("GPS-SECRET")) {
+		t.Error("EXIF kept in JPEG")
+	}
+	if cfg, format, err := image.DecodeConfig(bytes.NewReader(clean)); err != nil || format != "jpeg" || cfg.Width != 8 {
+		t.Errorf("cleaned photo: %+v, %s, %v", cfg, format, err)
+	}
+
+	for _, data := range [][]byte{[]byte("not an image"), []byte("\xff\xd8\xff broken jpeg")} {
+		if _, err := cleanImportPhoto(data); err == nil {
+			t.Errorf("%q accepted", data)
+		}
+	}
+}
+
+func webpChunk(fourcc string, data []byte) []byte {
+	chunk := binary.LittleEndian.AppendUint32([]byte(fourcc), uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func TestStripWebPMetadata(t *testing.T) {
+	vp8x := []byte{0x0c, 0, 0, 0, 7, 0, 0, 7, 0, 0} // EXIF and XMP flags set
+	body := []byte("WEBP")
+	body = append(body, webpChunk("VP8X", vp8x)...)
+	body = append(body, webpChunk("VP8L", []byte("image"))...)
+	body = append(body, webpChunk("EXIF", []byte("GPS-SECRET"))...)
+	body = append(body, webpChunk("XMP ", []byte("<xmp/>"))...)
+	photo := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+	photo = append(photo, body...)
+
+	clean, err := cleanImportPhoto(photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("WEBP")
+	want = append(want, webpChunk("VP8X", append([]byte{0}, vp8x[1:]...))...)
+	want = append(want, webpChunk("VP8L", []byte("image"))...)
+	want = append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(want))), want...)
+	if !bytes.Equal(clean, want) {
+		t.Errorf("cleaned WebP:\n%q\nwant\n%q", clean, want)
+	}
+
+	if _, err := stripWebPMetadata(photo[:len(photo)-3]); err == nil {
+		t.Error("truncated WebP accepted")
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"os"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -34,25 +34,68 @@ func (gl gormlog) Error(_ context.Context, s string, v ...any) {
 func (gl gormlog) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
 }
 
-func SetupLogger() *logrus.Logger {
+// Level is validated with config, so invalid one falls back to info
+func SetupLogger(level string) *logrus.Logger {
 	logger := logrus.New()
-	lvl := os.Getenv("LOG_LEVEL")
-	switch strings.ToLower(lvl) {
-	case "trace":
-		logger.SetLevel(logrus.TraceLevel)
-	case "debug":
-		logger.SetLevel(logrus.DebugLevel)
-	case "info", "":
-		logger.SetLevel(logrus.InfoLevel)
-	case "warn", "warning":
-		logger.SetLevel(logrus.WarnLevel)
-	case "error":
-		logger.SetLevel(logrus.ErrorLevel)
-	default:
-		logger.SetLevel(logrus.InfoLevel)
-		logger.Warnf("Invalid LOG_LEVEL '%s'; Using INFO", lvl)
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		lvl = logrus.InfoLevel
 	}
-	logger.SetLevel(logrus.TraceLevel)
+	logger.SetLevel(lvl)
 	logger.SetOutput(os.Stdout)
 	return logger
 }
+
+// Logged error kept for admin dashboard
+type RecentError struct {
+	Time    time.Time
+	Message string
+	Fields  logrus.Fields
+}
+
+// Logrus hook remembering last errors
+type ErrorHook struct {
+	mu     sync.Mutex
+	size   int
+	errors []RecentError // Oldest first
+}
+
+func NewErrorHook(size int) *ErrorHook {
+	return &ErrorHook{size: size}
+}
+
+func (eh *ErrorHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+func (eh *ErrorHook) Fire(entry *logrus.Entry) error {
+	fields := logrus.Fields{}
+	for key, value := range entry.Data {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		fields[key] = value
+	}
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	eh.errors = append(eh.errors, RecentError{
+		Time:    entry.Time,
+		Message: entry.Message,
+		Fields:  fields,
+	})
+	if len(eh.errors) > eh.size {
+		eh.errors = eh.errors[len(eh.errors)-eh.size:]
+	}
+	return nil
+}
+
+// Recent returns remembered errors, newest first
+func (eh *ErrorHook) Recent() []RecentError {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+	result := make([]RecentError, 0, len(eh.errors))
+	for i := len(eh.errors) - 1; i >= 0; i-- {
+		result = append(result, eh.errors[i])
+	}
+	return result
+}
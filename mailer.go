@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Sends plain text emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+func buildMessage(from, to, subject, body string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// Sends emails through SMTP server; STARTTLS is used if server supports it
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, buildMessage(m.from, to, subject, body))
+}
+
+// Writes emails to log; for development only
+type LogMailer struct {
+	log *logrus.Logger
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	m.log.WithFields(logrus.Fields{
+		"to":      to,
+		"subject": subject,
+	}).Info("Email:\n" + body)
+	return nil
+}
+
+// Stores emails as .eml files in directory; for development only
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.ReplaceAll(to, "/", "_"))
+	return os.WriteFile(filepath.Join(m.dir, name), buildMessage(m.from, to, subject, body), 0o644)
+}
+
+// Returns nil if MAIL_SENDER is not set, so features that need email
+// are disabled
+func SetupMailer(log *logrus.Logger, cfg MailConfig) Mailer {
+	switch cfg.Sender {
+	case "":
+		return nil
+	case "log":
+		log.Warn("Emails are written to log")
+		return &LogMailer{log: log}
+	case "file":
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			log.Fatalf("Failed to create MAIL_DIR %s: %s", cfg.Dir, err)
+		}
+		log.Warnf("Emails are written to %s", cfg.Dir)
+		return &FileMailer{dir: cfg.Dir, from: cfg.From}
+	default:
+		m := &SMTPMailer{
+			addr: net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort)),
+			from: cfg.From,
+		}
+		if cfg.SMTPUser != "" {
+			m.auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, cfg.SMTPHost)
+		}
+		return m
+	}
+}
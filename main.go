@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"os/signal"
 	"sync"
 	"syscall"
@@ -13,25 +15,54 @@ func getStopCtx() (context.Context, context.CancelFunc) {
 	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 }
 
+// Subcommands; without any the service is started
+var commands = map[string]func(args []string) int{
+	"i18n":    i18nCommand,
+	"config":  configCommand,
+	"billing": billingCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		cmd, ok := commands[os.Args[1]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command: %s\n", os.Args[1])
+			os.Exit(2)
+		}
+		os.Exit(cmd(os.Args[2:]))
+	}
+
 	ctx, stop := getStopCtx()
 	defer stop()
 
 	err := godotenv.Load()
 
-	log := SetupLogger()
+	cfg, cfgErrs := LoadConfig(os.Getenv("CONFIG_FILE"))
+
+	log := SetupLogger(cfg.LogLevel)
 
 	if err != nil {
 		log.Warn("Failed to load .env file")
 	}
 
+	// Report all config errors at once instead of failing on the first one
+	for _, err := range cfgErrs {
+		log.Error(err)
+	}
+	if len(cfgErrs) > 0 {
+		log.Fatalf("Invalid config: %d errors; run `cards config check` for details", len(cfgErrs))
+	}
+
 	localizer, locales := SetupLocales(log)
+	negotiator := SetupLocaleNegotiator(log, locales, cfg.GeoIPDB)
+
+	mailer := SetupMailer(log, cfg.Mail)
 
-	storage := SetupBlobStorage(log)
-	db := SetupDB(ctx, storage, log)
-	g, srv := SetupServer(log, localizer)
-	names := SetupProviders(log)
-	SetupHandler(g, ctx, storage, db, log, names, locales, localizer)
+	storage := SetupBlobStorage(log, cfg.S3)
+	db := SetupDB(ctx, storage, log, cfg.DB)
+	g, srv := SetupServer(log, localizer, cfg)
+	providers, oidc := SetupProviders(log, cfg, mailer != nil)
+	SetupHandler(g, ctx, storage, db, log, providers, oidc, locales, localizer, negotiator, mailer, cfg)
 
 	var wg sync.WaitGroup
 	RunServer(srv, &wg, ctx, log)
@@ -1,85 +1,223 @@
 package main
 
 import (
-	"os"
+	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/providers/discord"
 	"github.com/markbates/goth/providers/github"
 	"github.com/markbates/goth/providers/google"
+	"github.com/markbates/goth/providers/openidConnect"
 	"github.com/markbates/goth/providers/yandex"
 	"github.com/sirupsen/logrus"
 )
 
-func SetupProviders(log *logrus.Logger) []string {
+// Login provider shown on login page
+type LoginProvider struct {
+	Name  string // As used in /auth/:provider routes
+	Title string
+	Icon  string
+	URL   string // Where login starts
+}
+
+// Matches claim of OIDC ID token or userinfo response, e.g. "groups=admins".
+// Array claims match if any element is equal to the value.
+type ClaimMatch struct {
+	Claim string
+	Value string
+}
+
+func parseClaimMatch(str string) (*ClaimMatch, error) {
+	if str == "" {
+		return nil, nil
+	}
+	claim, value, ok := strings.Cut(str, "=")
+	if !ok || claim == "" {
+		return nil, fmt.Errorf("expected <claim>=<value>, got %q", str)
+	}
+	return &ClaimMatch{Claim: claim, Value: value}, nil
+}
+
+func (m *ClaimMatch) Match(claims map[string]any) bool {
+	if m == nil {
+		return false
+	}
+	switch v := claims[m.Claim].(type) {
+	case []any:
+		for _, item := range v {
+			if fmt.Sprint(item) == m.Value {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		return fmt.Sprint(v) == m.Value
+	}
+}
+
+// Role mapping for OIDC provider
+type OIDCProvider struct {
+	AdminClaim     *ClaimMatch
+	ModeratorClaim *ClaimMatch
+	LimitedClaim   *ClaimMatch
+}
+
+// Returns role of user with given claims. Configured mappings are
+// authoritative: user that no longer matches a claim loses the role,
+// while roles that are not mapped are left as is.
+func (p *OIDCProvider) Role(claims map[string]any, current Role) Role {
+	switch {
+	case p.AdminClaim.Match(claims):
+		return RoleAdmin
+	case p.ModeratorClaim.Match(claims):
+		return RoleModerator
+	case p.LimitedClaim.Match(claims):
+		return RoleViewer
+	case p.AdminClaim != nil && current == RoleAdmin:
+		return RoleMember
+	case p.ModeratorClaim != nil && current == RoleModerator:
+		return RoleMember
+	case p.LimitedClaim != nil && current == RoleViewer:
+		return RoleMember
+	}
+	return current
+}
+
+// Loads OIDC providers listed in OIDC_PROVIDERS; callback URL of each
+// should point to /auth/<id>-oidc/callback.
+func setupOIDCProviders(log *logrus.Logger, configs []OIDCConfig) ([]goth.Provider, []LoginProvider, map[string]*OIDCProvider) {
 	providers := []goth.Provider{}
-	names := []string{}
+	list := []LoginProvider{}
+	mappings := map[string]*OIDCProvider{}
 
-	ghClientID := os.Getenv("GITHUB_CLIENT_ID")
-	ghClientSecret := os.Getenv("GITHUB_CLIENT_SECRET")
-	ghClientCallbackURL := os.Getenv("GITHUB_CLIENT_CALLBACK_URL")
+	for _, cfg := range configs {
+		scopes := cfg.Scopes
+		if !slices.Contains(scopes, "openid") {
+			scopes = append(scopes, "openid")
+		}
+
+		// Claims are validated with config
+		admin, _ := parseClaimMatch(cfg.AdminClaim)
+		moderator, _ := parseClaimMatch(cfg.ModeratorClaim)
+		limited, _ := parseClaimMatch(cfg.LimitedClaim)
+
+		provider, err := openidConnect.NewNamed(
+			cfg.ID, cfg.ClientID, cfg.ClientSecret, cfg.CallbackURL, cfg.DiscoveryURL, scopes...,
+		)
+		if err != nil {
+			// Unreachable issuer should not take whole service down
+			log.WithFields(logrus.Fields{
+				"err":      err,
+				"provider": cfg.ID,
+			}).Error("Failed to setup OIDC provider")
+			continue
+		}
 
-	if ghClientID != "" && ghClientSecret != "" && ghClientCallbackURL != "" {
+		providers = append(providers, provider)
+		list = append(list, LoginProvider{
+			Name:  provider.Name(),
+			Title: cfg.Title,
+			Icon:  cfg.Icon,
+			URL:   "/auth/" + provider.Name(),
+		})
+		mappings[provider.Name()] = &OIDCProvider{
+			AdminClaim:     admin,
+			ModeratorClaim: moderator,
+			LimitedClaim:   limited,
+		}
+		log.Debugf("Adding %s OIDC provider", cfg.ID)
+	}
+
+	return providers, list, mappings
+}
+
+// Email login is listed first if enabled
+func SetupProviders(log *logrus.Logger, cfg *Config, emailLogin bool) ([]LoginProvider, map[string]*OIDCProvider) {
+	providers := []goth.Provider{}
+	list := []LoginProvider{}
+
+	if emailLogin {
+		list = append(list, LoginProvider{
+			Name:  "email",
+			Title: "Email",
+			Icon:  "/static/email.svg",
+			URL:   "/login/email",
+		})
+		log.Debug("Adding email login")
+	}
+
+	if gh := cfg.OAuth.GitHub; gh.Enabled() {
 		providers = append(providers, github.New(
-			ghClientID, ghClientSecret, ghClientCallbackURL,
+			gh.ID, gh.Secret, gh.CallbackURL,
 		))
 		log.Debug("Adding github OAuth provider")
 	}
 
-	googleClientID := os.Getenv("GOOGLE_CLIENT_ID")
-	googleClientSecret := os.Getenv("GOOGLE_CLIENT_SECRET")
-	googleClientCallbackURL := os.Getenv("GOOGLE_CLIENT_CALLBACK_URL")
-
-	if googleClientID != "" && googleClientSecret != "" && googleClientCallbackURL != "" {
+	if gg := cfg.OAuth.Google; gg.Enabled() {
 		providers = append(providers, google.New(
-			googleClientID, googleClientSecret, googleClientCallbackURL,
+			gg.ID, gg.Secret, gg.CallbackURL,
 		))
 		log.Debug("Adding google OAuth provider")
 	}
 
-	dcClientID := os.Getenv("DISCORD_CLIENT_ID")
-	dcClientSecret := os.Getenv("DISCORD_CLIENT_SECRET")
-	dcClientCallbackURL := os.Getenv("DISCORD_CLIENT_CALLBACK_URL")
-
-	if dcClientID != "" && dcClientSecret != "" && dcClientCallbackURL != "" {
+	if dc := cfg.OAuth.Discord; dc.Enabled() {
 		providers = append(providers, discord.New(
-			dcClientID, dcClientSecret, dcClientCallbackURL,
+			dc.ID, dc.Secret, dc.CallbackURL,
 		))
 		log.Debug("Adding discord OAuth provider")
 	}
 
-	yandexClientID := os.Getenv("YANDEX_CLIENT_ID")
-	yandexClientSecret := os.Getenv("YANDEX_CLIENT_SECRET")
-	yandexClientCallbackURL := os.Getenv("YANDEX_CLIENT_CALLBACK_URL")
-
-	if yandexClientID != "" && yandexClientSecret != "" && yandexClientCallbackURL != "" {
+	if ya := cfg.OAuth.Yandex; ya.Enabled() {
 		providers = append(providers, yandex.New(
-			yandexClientID, yandexClientSecret, yandexClientCallbackURL,
+			ya.ID, ya.Secret, ya.CallbackURL,
 		))
 		log.Debug("Adding yandex OAuth provider")
 	}
 
-	if os.Getenv("VK_CLIENT_ID") != "" {
-		names = append(names, "vk")
+	if cfg.OAuth.VKClientID != "" {
+		list = append(list, LoginProvider{
+			Name:  "vk",
+			Title: "Vk/mail/Ok",
+			Icon:  "/static/vk-logo.svg",
+			URL:   "/login/vk",
+		})
 		log.Debug("Adding VK OAuth provider")
 	}
 
-	if os.Getenv("TG_CLIENT_ID") != "" {
-		names = append(names, "telegram")
+	if cfg.OAuth.Telegram.ID != "" {
+		list = append(list, LoginProvider{
+			Name:  "telegram",
+			Title: "Telegram",
+			Icon:  "/static/telegram-logo.svg",
+			URL:   "/login/tg",
+		})
 		log.Debug("Adding Tg OAuth provider")
 	}
 
-	if len(providers) < 1 {
-		log.Fatal("There is no OAuth providers configured")
+	for _, p := range providers {
+		list = append(list, LoginProvider{
+			Name:  p.Name(),
+			Title: p.Name(),
+			Icon:  "/static/" + p.Name() + "-logo.svg",
+			URL:   "/auth/" + p.Name(),
+		})
 	}
 
-	for _, p := range providers {
-		names = append(names, p.Name())
+	oidc, oidcList, mappings := setupOIDCProviders(log, cfg.OIDC)
+	providers = append(providers, oidc...)
+	list = append(list, oidcList...)
+
+	if len(list) < 1 {
+		log.Fatal("There is no login providers configured")
 	}
 
 	goth.UseProviders(providers...)
 
-	return names
+	return list, mappings
 }
 
 func UserCreds(user goth.User) (id string, name string) {
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseClaimMatch(t *testing.T) {
+	m, err := parseClaimMatch("groups=admins")
+	if err != nil || m == nil || m.Claim != "groups" || m.Value != "admins" {
+		t.Errorf("parseClaimMatch = %+v, %v", m, err)
+	}
+	if m, err := parseClaimMatch(""); m != nil || err != nil {
+		t.Errorf("empty claim parsed to %+v, %v", m, err)
+	}
+	for _, str := range []string{"groups", "=admins"} {
+		if _, err := parseClaimMatch(str); err == nil {
+			t.Errorf("%q parsed without error", str)
+		}
+	}
+}
+
+func TestClaimMatch(t *testing.T) {
+	m := &ClaimMatch{Claim: "groups", Value: "admins"}
+	tests := []struct {
+		claims map[string]any
+		want   bool
+	}{
+		{map[string]any{"groups": "admins"}, true},
+		{map[string]any{"groups": []any{"users", "admins"}}, true},
+		{map[string]any{"groups": []any{"users"}}, false},
+		{map[string]any{"groups": "users"}, false},
+		{map[string]any{"roles": "admins"}, false},
+		{map[string]any{"groups": nil}, false},
+		{map[string]any{}, false},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.claims); got != tt.want {
+			t.Errorf("Match(%v) = %v, want %v", tt.claims, got, tt.want)
+		}
+	}
+	if !(&ClaimMatch{Claim: "level", Value: "3"}).Match(map[string]any{"level": 3.0}) {
+		t.Error("number claim not matched")
+	}
+	var none *ClaimMatch
+	if none.Match(map[string]any{"groups": "admins"}) {
+		t.Error("nil matcher matched")
+	}
+}
+
+func TestOIDCProviderRole(t *testing.T) {
+	p := &OIDCProvider{
+		AdminClaim:     &ClaimMatch{Claim: "groups", Value: "admins"},
+		ModeratorClaim: &ClaimMatch{Claim: "groups", Value: "moderators"},
+	}
+	tests := []struct {
+		name    string
+		groups  []any
+		current Role
+		want    Role
+	}{
+		{"admin granted", []any{"admins"}, RoleMember, RoleAdmin},
+		{"admin wins", []any{"moderators", "admins"}, RoleMember, RoleAdmin},
+		{"moderator granted", []any{"moderators"}, RoleMember, RoleModerator},
+		{"admin revoked", []any{"users"}, RoleAdmin, RoleMember},
+		{"moderator revoked", nil, RoleModerator, RoleMember},
+		{"unmapped role kept", []any{"users"}, RoleViewer, RoleViewer},
+		{"member kept", []any{"users"}, RoleMember, RoleMember},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]any{"groups": tt.groups}
+			if got := p.Role(claims, tt.current); got != tt.want {
+				t.Errorf("Role = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	none := &OIDCProvider{}
+	if got := none.Role(map[string]any{"groups": []any{"admins"}}, RoleAdmin); got != RoleAdmin {
+		t.Errorf("provider without mapping changed role to %v", got)
+	}
+}
+
+// Minimal OIDC issuer: discovery, token and userinfo endpoints. ID token
+// is not signed, as goth doesn't verify signatures.
+func fakeOIDCIssuer(t *testing.T, clientID string, claims map[string]any) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"userinfo_endpoint":      srv.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		payload, _ := json.Marshal(map[string]any{
+			"iss": srv.URL,
+			"aud": clientID,
+			"sub": claims["sub"],
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		enc := base64.RawURLEncoding
+		idToken := enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString(payload) + "."
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(claims)
+	})
+	return srv
+}
+
+func TestOIDCLogin(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	srv := fakeOIDCIssuer(t, "cards", map[string]any{
+		"sub":                "42",
+		"preferred_username": "alice",
+		"groups":             []string{"staff", "admins"},
+	})
+
+	providers, list, mappings := setupOIDCProviders(log, []OIDCConfig{{
+		ID:           "corp",
+		DiscoveryURL: srv.URL + "/.well-known/openid-configuration",
+		ClientID:     "cards",
+		ClientSecret: "secret",
+		CallbackURL:  "http://localhost/auth/corp-oidc/callback",
+		Scopes:       []string{"profile"},
+		Title:        "Corp SSO",
+		AdminClaim:   "groups=admins",
+	}})
+	if len(providers) != 1 || len(list) != 1 {
+		t.Fatalf("got %d providers, want 1", len(providers))
+	}
+	provider := providers[0]
+	if provider.Name() != "corp-oidc" || list[0].URL != "/auth/corp-oidc" || list[0].Title != "Corp SSO" {
+		t.Errorf("unexpected provider %s: %+v", provider.Name(), list[0])
+	}
+
+	sess, err := provider.BeginAuth("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := sess.GetAuthURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/authorize" || u.Query().Get("state") != "state" || u.Query().Get("client_id") != "cards" {
+		t.Errorf("unexpected auth URL %s", authURL)
+	}
+	if scope := u.Query().Get("scope"); scope != "profile openid" {
+		t.Errorf("scope = %q, want openid added", scope)
+	}
+
+	// Callback
+	if _, err := sess.Authorize(provider, url.Values{"code": {"bad-code"}}); err == nil {
+		t.Error("bad code authorized")
+	}
+	if _, err := sess.Authorize(provider, url.Values{"code": {"good-code"}}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := provider.FetchUser(sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, name := UserCreds(user)
+	if pid != "corp-oidc::42" || name != "alice" {
+		t.Errorf("UserCreds = %q, %q", pid, name)
+	}
+
+	mapping, ok := mappings[user.Provider]
+	if !ok {
+		t.Fatalf("no role mapping for %s", user.Provider)
+	}
+	if role := mapping.Role(user.RawData, RoleMember); role != RoleAdmin {
+		t.Errorf("role = %v, want admin", role)
+	}
+}
+
+func TestOIDCUnreachableIssuer(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	providers, list, _ := setupOIDCProviders(log, []OIDCConfig{{
+		ID:           "broken",
+		DiscoveryURL: srv.URL + "/.well-known/openid-configuration",
+		ClientID:     "cards",
+	}})
+	if len(providers) != 0 || len(list) != 0 {
+		t.Errorf("provider with broken discovery was added")
+	}
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Role of user in organization
+type OrgRole uint
+
+const (
+	OrgMember OrgRole = 0 // Has cards branded by org
+	OrgAdmin  OrgRole = 1 // Manages org branding, members and their cards
+)
+
+var orgRoleNames = map[OrgRole]string{
+	OrgMember: "member",
+	OrgAdmin:  "admin",
+}
+
+func (r OrgRole) String() string {
+	return orgRoleNames[r]
+}
+
+// Card themes; the first one is default
+var Themes = []string{"dark", "light", "blue", "green"}
+
+const maxOrgNameLength = 128
+
+func newInviteCode() string {
+	return strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// Returns role of user in org; staff with users:manage permission act as
+// admins of any org
+func (h *Handler) orgRole(user *User, org uint) (OrgRole, bool) {
+	if user == nil || org == 0 {
+		return 0, false
+	}
+	if user.Can(PermUsersManage, 0) {
+		return OrgAdmin, true
+	}
+	m, err := h.db.GetMembership(org, user.ID)
+	if err != nil {
+		return 0, false
+	}
+	return m.Role, true
+}
+
+// Card permission check: org admins have ":any" permissions on cards of
+// their org
+func (h *Handler) canManageCard(user *User, card Card, perm Permission) bool {
+	if user.Can(perm, card.Owner) {
+		return true
+	}
+	role, ok := h.orgRole(user, card.OrgID)
+	return ok && role == OrgAdmin
+}
+
+// Where to go after card of owner is changed
+func (h *Handler) cardsPage(user *User, card Card) string {
+	if card.OrgID != 0 && !user.Can(PermCardsEditAny, card.Owner) {
+		return fmt.Sprintf("/orgs/%d", card.OrgID)
+	}
+	return fmt.Sprintf("/cards/%d", card.Owner)
+}
+
+// Applies branding of card org; returns card and its theme
+func (h *Handler) brandCard(card Card) (Card, string) {
+	if card.OrgID == 0 {
+		return card, ""
+	}
+	org, err := h.db.GetOrg(card.OrgID)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"cid": card.ID,
+		}).Error("Failed to load card org")
+		return card, ""
+	}
+	return card.Branded(org), org.Theme
+}
+
+// Owner and org of card created with "org" and "owner" query params.
+// Members create org cards for themselves, org admins for any member.
+// Writes error page and returns false if user can't create such card.
+func (h *Handler) newCardTarget(c *gin.Context, user *User) (owner, org uint, ok bool) {
+	if c.Query("org") == "" {
+		return user.ID, 0, true
+	}
+	oid, err := strconv.ParseUint(c.Query("org"), 10, 64)
+	owner = user.ID
+	if err == nil && c.Query("owner") != "" {
+		var uid uint64
+		uid, err = strconv.ParseUint(c.Query("owner"), 10, 64)
+		owner = uint(uid)
+	}
+	if err != nil {
+		h.errorPage(c, http.StatusBadRequest, "")
+		return 0, 0, false
+	}
+
+	role, member := h.orgRole(user, uint(oid))
+	if !member || (owner != user.ID && role != OrgAdmin) {
+		h.errorPage(
+			c,
+			http.StatusForbidden,
+			h.localize(c, "ErrMsgNotOrgAdmin"),
+		)
+		return 0, 0, false
+	}
+	if owner != user.ID {
+		if _, err := h.db.GetMembership(uint(oid), owner); err != nil {
+			h.errorPage(
+				c,
+				http.StatusBadRequest,
+				h.localize(c, "ErrMsgNotOrgMember"),
+			)
+			return 0, 0, false
+		}
+	}
+	return owner, uint(oid), true
+}
+
+// Loads org from :id param and checks that user is its admin.
+// Writes error with fail (errorPage or errorBlock) and returns false
+// otherwise.
+func (h *Handler) adminOrg(c *gin.Context, fail func(*gin.Context, int, string)) (Org, bool) {
+	oid, err := getUintParam(c, "id")
+	if err != nil {
+		fail(c, http.StatusBadRequest, "")
+		return Org{}, false
+	}
+	if role, ok := h.orgRole(getUser(c), oid); !ok || role != OrgAdmin {
+		fail(
+			c,
+			http.StatusForbidden,
+			h.localize(c, "ErrMsgNotOrgAdmin"),
+		)
+		return Org{}, false
+	}
+	org, err := h.db.GetOrg(oid)
+	if err != nil {
+		fail(c, http.StatusNotFound, "")
+		return Org{}, false
+	}
+	return org, true
+}
+
+// Reports whether org keeps at least one admin without user
+func (h *Handler) hasOtherAdmins(org, uid uint) (bool, error) {
+	members, err := h.db.ListMembers(org)
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(members, func(m Membership) bool {
+		return m.Role == OrgAdmin && m.UserID != uid
+	}), nil
+}
+
+func (h *Handler) orgsRoute(c *gin.Context) {
+	user := getUser(c)
+
+	orgs, err := h.db.ListOrgs(user.ID)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to list orgs")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToListOrgs"),
+		)
+		return
+	}
+
+	h.execHTML(c, http.StatusOK, "page_orgs.html", gin.H{
+		"Title": h.localize(c, "TitleOrgs"),
+		"Orgs":  orgs,
+	})
+}
+
+func (h *Handler) createOrgRoute(c *gin.Context) {
+	user := getUser(c)
+
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" || len(name) > maxOrgNameLength {
+		h.errorPage(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgInvalidOrgName"),
+		)
+		return
+	}
+
+	org, err := h.db.CreateOrg(Org{
+		Name:       name,
+		Theme:      Themes[0],
+		InviteCode: newInviteCode(),
+	}, user.ID)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to create org")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToCreateOrg"),
+		)
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"uid": user.ID,
+		"org": org.ID,
+	}).Info("Org created")
+
+	redirect(c, fmt.Sprintf("/orgs/%d", org.ID))
+}
+
+func (h *Handler) joinOrgRoute(c *gin.Context) {
+	user := getUser(c)
+
+	org, err := h.db.FindOrgByInvite(strings.TrimSpace(c.PostForm("code")))
+	if err != nil {
+		h.errorPage(
+			c,
+			http.StatusNotFound,
+			h.localize(c, "ErrMsgInvalidInviteCode"),
+		)
+		return
+	}
+
+	if _, err := h.db.GetMembership(org.ID, user.ID); err != nil {
+		err = h.db.SaveMembership(Membership{
+			OrgID:     org.ID,
+			UserID:    user.ID,
+			Role:      OrgMember,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			h.log.WithFields(logrus.Fields{
+				"err": err,
+			}).Error("Failed to join org")
+			h.errorPage(c, http.StatusInternalServerError, "")
+			return
+		}
+		h.log.WithFields(logrus.Fields{
+			"uid": user.ID,
+			"org": org.ID,
+		}).Info("User joined org")
+	}
+
+	redirect(c, fmt.Sprintf("/orgs/%d", org.ID))
+}
+
+// Org members and all org cards
+func (h *Handler) orgRoute(c *gin.Context) {
+	user := getUser(c)
+
+	oid, err := getUintParam(c, "id")
+	if err != nil {
+		redirect(c, "/orgs")
+		return
+	}
+
+	role, ok := h.orgRole(user, oid)
+	if !ok && !user.Can(PermUsersView, 0) {
+		h.errorPage(c, http.StatusNotFound, "")
+		return
+	}
+
+	org, err := h.db.GetOrg(oid)
+	if err != nil {
+		h.errorPage(c, http.StatusNotFound, "")
+		return
+	}
+
+	memberships, err := h.db.ListMembers(oid)
+	var cards []Card
+	if err == nil {
+		cards, err = h.db.ListOrgCards(oid)
+	}
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"org": oid,
+		}).Error("Failed to list org members")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToListOrgs"),
+		)
+		return
+	}
+
+	members := []gin.H{}
+	for _, m := range memberships {
+		member := User{ID: m.UserID}
+		if err := h.db.GetUser(&member); err != nil {
+			continue
+		}
+		members = append(members, gin.H{
+			"ID":    member.ID,
+			"Name":  member.Name,
+			"Admin": m.Role == OrgAdmin,
+			"Role":  h.localize(c, "OrgRole"+camelKey(m.Role.String())),
+		})
+	}
+
+	themes := []gin.H{}
+	for _, theme := range Themes {
+		themes = append(themes, gin.H{
+			"ID":    theme,
+			"Title": h.localize(c, "Theme"+camelKey(theme)),
+		})
+	}
+
+	for i := range cards {
+		cards[i], _ = h.brandCard(cards[i])
+	}
+	_, err = h.db.GetMembership(oid, user.ID)
+
+	h.execHTML(c, http.StatusOK, "page_org.html", gin.H{
+		"Title":   org.Name,
+		"Org":     org,
+		"Admin":   ok && role == OrgAdmin,
+		"Member":  err == nil,
+		"Members": members,
+		"Cards":   cards,
+		"Themes":  themes,
+	})
+}
+
+// Updates org name, theme and logo
+func (h *Handler) updateOrgRoute(c *gin.Context) {
+	org, ok := h.adminOrg(c, h.errorPage)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(c.PostForm("name"))
+	theme := c.PostForm("theme")
+	if name == "" || len(name) > maxOrgNameLength || !slices.Contains(Themes, theme) {
+		h.errorPage(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgInvalidFromData"),
+		)
+		return
+	}
+	org.Name = name
+	org.Theme = theme
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		h.errorPage(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgInvalidFromData"),
+		)
+		return
+	}
+
+	oldLogo := ""
+	if isFileInForm(form, "logo") {
+		logo := fmt.Sprintf("media/logo/org-%d-%s.webp", org.ID, uuid.New().String())
+		if !h.uploadFormFile(c, form, "logo", logo) {
+			return
+		}
+		oldLogo = org.Logo
+		org.Logo = logo
+	}
+
+	if err := h.db.UpdateOrg(org); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"org": org.ID,
+		}).Error("Failed to update org")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToUpdateOrg"),
+		)
+		return
+	}
+
+	if oldLogo != "" {
+		if err := h.storage.DelKey(h.ctx, oldLogo); err != nil {
+			h.log.WithFields(logrus.Fields{
+				"err":  err,
+				"logo": oldLogo,
+			}).Error("Failed to delete previous logo")
+		}
+	}
+	// Org name and logo are shown on its cards in directory
+	h.gallery.purge()
+
+	redirect(c, fmt.Sprintf("/orgs/%d", org.ID))
+}
+
+// Replaces invite code, so the old one stops working
+func (h *Handler) resetOrgInviteRoute(c *gin.Context) {
+	org, ok := h.adminOrg(c, h.errorBlock)
+	if !ok {
+		return
+	}
+
+	org.InviteCode = newInviteCode()
+	if err := h.db.UpdateOrg(org); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"org": org.ID,
+		}).Error("Failed to update org")
+		h.errorBlock(c, http.StatusInternalServerError, "")
+		return
+	}
+
+	redirect(c, fmt.Sprintf("/orgs/%d", org.ID))
+}
+
+// Sets role from :role param ("member" or "admin") to member from :uid param
+func (h *Handler) changeOrgRoleRoute(c *gin.Context) {
+	org, ok := h.adminOrg(c, h.errorBlock)
+	if !ok {
+		return
+	}
+
+	uid, err := getUintParam(c, "uid")
+	if err != nil {
+		h.errorBlock(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgBrokenUserID"),
+		)
+		return
+	}
+	m, err := h.db.GetMembership(org.ID, uid)
+	if err != nil {
+		h.errorBlock(
+			c,
+			http.StatusNotFound,
+			h.localize(c, "ErrMsgNotOrgMember"),
+		)
+		return
+	}
+
+	before := m.Role
+	switch c.Param("role") {
+	case OrgMember.String():
+		m.Role = OrgMember
+	case OrgAdmin.String():
+		m.Role = OrgAdmin
+	default:
+		h.errorBlock(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgUnknownRole"),
+		)
+		return
+	}
+
+	if m.Role == OrgMember {
+		others, err := h.hasOtherAdmins(org.ID, uid)
+		if err == nil && !others {
+			h.errorBlock(
+				c,
+				http.StatusBadRequest,
+				h.localize(c, "ErrMsgLastOrgAdmin"),
+			)
+			return
+		}
+	}
+
+	if err := h.db.SaveMembership(m); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to update membership")
+		h.errorBlock(c, http.StatusInternalServerError, "")
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"admin": getUser(c).ID,
+		"uid":   uid,
+		"org":   org.ID,
+		"role":  m.Role,
+	}).Info("Org role changed")
+	h.audit(c, getUser(c).ID, AuditOrgRoleChanged, auditTarget("org", org.ID), map[string]any{
+		"user": uid,
+		"role": [2]string{before.String(), m.Role.String()},
+	})
+
+	redirect(c, fmt.Sprintf("/orgs/%d", org.ID))
+}
+
+// Removes member from :uid param. Members may leave org themselves.
+func (h *Handler) removeOrgMemberRoute(c *gin.Context) {
+	user := getUser(c)
+
+	oid, err := getUintParam(c, "id")
+	uid, e := getUintParam(c, "uid")
+	if err != nil || e != nil {
+		h.errorBlock(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgBrokenUserID"),
+		)
+		return
+	}
+
+	if role, ok := h.orgRole(user, oid); !ok || (role != OrgAdmin && uid != user.ID) {
+		h.errorBlock(
+			c,
+			http.StatusForbidden,
+			h.localize(c, "ErrMsgNotOrgAdmin"),
+		)
+		return
+	}
+
+	m, err := h.db.GetMembership(oid, uid)
+	if err != nil {
+		h.errorBlock(
+			c,
+			http.StatusNotFound,
+			h.localize(c, "ErrMsgNotOrgMember"),
+		)
+		return
+	}
+	if m.Role == OrgAdmin {
+		others, err := h.hasOtherAdmins(oid, uid)
+		if err == nil && !others {
+			h.errorBlock(
+				c,
+				http.StatusBadRequest,
+				h.localize(c, "ErrMsgLastOrgAdmin"),
+			)
+			return
+		}
+	}
+
+	if err := h.db.DeleteMembership(oid, uid); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to delete membership")
+		h.errorBlock(c, http.StatusInternalServerError, "")
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"by":  user.ID,
+		"uid": uid,
+		"org": oid,
+	}).Info("Member removed from org")
+	h.audit(c, user.ID, AuditOrgMemberRemoved, auditTarget("org", oid), map[string]any{
+		"user": uid,
+	})
+
+	if uid == user.ID {
+		redirect(c, "/orgs")
+	} else {
+		redirect(c, fmt.Sprintf("/orgs/%d", oid))
+	}
+}
+
+func (h *Handler) deleteOrgRoute(c *gin.Context) {
+	org, ok := h.adminOrg(c, h.errorBlock)
+	if !ok {
+		return
+	}
+
+	if err := h.db.DeleteOrg(org.ID); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"org": org.ID,
+		}).Error("Failed to delete org")
+		h.errorBlock(c, http.StatusInternalServerError, "")
+		return
+	}
+
+	if org.Logo != "" {
+		if err := h.storage.DelKey(h.ctx, org.Logo); err != nil {
+			h.log.WithFields(logrus.Fields{
+				"err":  err,
+				"logo": org.Logo,
+			}).Error("Failed to delete org logo")
+		}
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"uid": getUser(c).ID,
+		"org": org.ID,
+	}).Info("Org deleted")
+	h.audit(c, getUser(c).ID, AuditOrgDeleted, auditTarget("org", org.ID), map[string]any{
+		"name": org.Name,
+	})
+	h.gallery.purge()
+
+	redirect(c, "/orgs")
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	passkeyRegKey   = "webauthn_reg"   // Registration ceremony state
+	passkeyLoginKey = "webauthn_login" // Login ceremony state
+
+	ceremonyTTL   = 5 * time.Minute
+	maxCeremonies = 10000 // Ceremonies in progress
+)
+
+// Adapts User with its passkeys to webauthn.User
+type passkeyUser struct {
+	user     User
+	passkeys []Passkey
+}
+
+// User handle is 8 byte big endian user ID
+func passkeyUserHandle(uid uint) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(uid))
+}
+
+func (u passkeyUser) WebAuthnID() []byte {
+	return passkeyUserHandle(u.user.ID)
+}
+
+func (u passkeyUser) WebAuthnName() string {
+	return u.user.Name
+}
+
+func (u passkeyUser) WebAuthnDisplayName() string {
+	return u.user.Name
+}
+
+func (u passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.passkeys))
+	for _, key := range u.passkeys {
+		creds = append(creds, key.Credential)
+	}
+	return creds
+}
+
+// Passkeys are enabled if PUBLIC_URL is set, as relying party ID and
+// origin are derived from it. If PASSKEY_REQUIRED_FOR_ADMIN is true,
+// admins have admin rights only in sessions started with passkey.
+func SetupPasskeys(log *logrus.Logger, cfg *Config) (*webauthn.WebAuthn, bool) {
+	if cfg.PublicURL == "" {
+		return nil, false
+	}
+
+	u, err := url.Parse(cfg.PublicURL)
+	if err != nil || u.Hostname() == "" {
+		log.Fatalf("Failed to parse PUBLIC_URL: %s", cfg.PublicURL)
+	}
+
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: "Cards",
+		RPOrigins:     []string{u.Scheme + "://" + u.Host},
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatal("Failed to setup passkeys")
+	}
+	log.Debug("Passkeys enabled")
+	return w, cfg.PasskeyRequiredForAdmin
+}
+
+func (h *Handler) loadPasskeyUser(uid uint) (passkeyUser, error) {
+	user := User{ID: uid}
+	if err := h.db.GetUser(&user); err != nil {
+		return passkeyUser{}, err
+	}
+	keys, err := h.db.ListPasskeys(uid)
+	return passkeyUser{user: user, passkeys: keys}, err
+}
+
+type ceremony struct {
+	kind    string // passkeyRegKey or passkeyLoginKey
+	data    webauthn.SessionData
+	expires time.Time
+}
+
+// State of WebAuthn ceremonies in progress. It is kept on server and cookie
+// session holds only random ID of ceremony, so replaying earlier copy of
+// cookie can't finish ceremony again.
+type ceremonyStore struct {
+	mu    sync.Mutex
+	items map[string]ceremony
+}
+
+func newCeremonyStore() *ceremonyStore {
+	return &ceremonyStore{items: map[string]ceremony{}}
+}
+
+// Stores ceremony and returns its ID
+func (s *ceremonyStore) put(kind string, data webauthn.SessionData, now time.Time) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, item := range s.items {
+		if now.After(item.expires) {
+			delete(s.items, id)
+		}
+	}
+	if len(s.items) >= maxCeremonies {
+		return "", errors.New("too many ceremonies in progress")
+	}
+	s.items[id] = ceremony{kind: kind, data: data, expires: now.Add(ceremonyTTL)}
+	return id, nil
+}
+
+// Returns and forgets ceremony; each one can be finished only once
+func (s *ceremonyStore) take(id, kind string, now time.Time) (webauthn.SessionData, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[id]
+	delete(s.items, id)
+	if !ok || item.kind != kind || now.After(item.expires) {
+		return webauthn.SessionData{}, false
+	}
+	return item.data, true
+}
+
+func (h *Handler) saveCeremony(c *gin.Context, key string, data *webauthn.SessionData) error {
+	id, err := h.ceremonies.put(key, *data, time.Now())
+	if err != nil {
+		return err
+	}
+	sess := sessions.Default(c)
+	sess.Set(key, id)
+	return sess.Save()
+}
+
+// Returns and forgets state of ceremony, so it can't be replayed
+func (h *Handler) takeCeremony(c *gin.Context, key string) (webauthn.SessionData, error) {
+	sess := sessions.Default(c)
+	id, _ := sess.Get(key).(string)
+	sess.Delete(key)
+	sess.Save()
+	data, ok := h.ceremonies.take(id, key, time.Now())
+	if !ok {
+		return data, errors.New("no ceremony in progress")
+	}
+	return data, nil
+}
+
+func (h *Handler) passkeyError(c *gin.Context, status int, key string) {
+	text := ""
+	if key != "" {
+		text = h.localize(c, key)
+	}
+	c.JSON(status, gin.H{"error": text})
+}
+
+// Passkeys are added and removed only in sessions started with passkey,
+// so stolen OAuth session can't be turned into passkey one. The first
+// passkey may be enrolled from any session, but not by admins who need
+// passkey for their rights, as they would get them right away.
+func (h *Handler) canManagePasskeys(c *gin.Context, keys []Passkey) bool {
+	if c.GetBool("PasskeySession") {
+		return true
+	}
+	return len(keys) == 0 && !c.GetBool("PasskeyRequired")
+}
+
+func (h *Handler) passkeysRoute(c *gin.Context) {
+	user := getUser(c)
+
+	keys, err := h.db.ListPasskeys(user.ID)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to list passkeys")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToListPasskeys"),
+		)
+		return
+	}
+
+	h.execHTML(c, http.StatusOK, "page_passkeys.html", gin.H{
+		"Title":           h.localize(c, "TitlePasskeys"),
+		"Passkeys":        keys,
+		"PasskeyRequired": c.GetBool("PasskeyRequired"),
+		"CanManage":       h.canManagePasskeys(c, keys),
+	})
+}
+
+func (h *Handler) deletePasskeyRoute(c *gin.Context) {
+	user := getUser(c)
+	if !c.GetBool("PasskeySession") {
+		h.errorBlock(
+			c,
+			http.StatusForbidden,
+			h.localize(c, "ErrMsgPasskeySessionRequired"),
+		)
+		return
+	}
+
+	if err := h.db.DeletePasskey(user.ID, c.Param("id")); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to delete passkey")
+		h.errorBlock(c, http.StatusNotFound, "")
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"uid": user.ID,
+		"id":  c.Param("id"),
+	}).Info("Passkey deleted")
+	h.audit(c, user.ID, AuditPasskeyDeleted, auditTarget("user", user.ID), map[string]any{
+		"passkey": c.Param("id"),
+	})
+
+	redirect(c, "/passkeys")
+}
+
+func (h *Handler) beginPasskeyRegistrationRoute(c *gin.Context) {
+	user := getUser(c)
+	if user == nil {
+		h.passkeyError(c, http.StatusUnauthorized, "")
+		return
+	}
+
+	pu, err := h.loadPasskeyUser(user.ID)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to load passkeys")
+		h.passkeyError(c, http.StatusInternalServerError, "ErrMsgPasskeyFailed")
+		return
+	}
+	if !h.canManagePasskeys(c, pu.passkeys) {
+		h.passkeyError(c, http.StatusForbidden, "ErrMsgPasskeySessionRequired")
+		return
+	}
+
+	creation, data, err := h.webauthn.BeginRegistration(
+		pu,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(webauthn.Credentials(pu.WebAuthnCredentials()).CredentialDescriptors()),
+	)
+	if err == nil {
+		err = h.saveCeremony(c, passkeyRegKey, data)
+	}
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to begin passkey registration")
+		h.passkeyError(c, http.StatusInternalServerError, "ErrMsgPasskeyFailed")
+		return
+	}
+
+	c.JSON(http.StatusOK, creation)
+}
+
+// Expects credential in body and passkey name in ?name= query param
+func (h *Handler) finishPasskeyRegistrationRoute(c *gin.Context) {
+	user := getUser(c)
+	if user == nil {
+		h.passkeyError(c, http.StatusUnauthorized, "")
+		return
+	}
+
+	data, err := h.takeCeremony(c, passkeyRegKey)
+	if err != nil {
+		h.passkeyError(c, http.StatusBadRequest, "ErrMsgPasskeyFailed")
+		return
+	}
+
+	pu, err := h.loadPasskeyUser(user.ID)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to load passkeys")
+		h.passkeyError(c, http.StatusInternalServerError, "ErrMsgPasskeyFailed")
+		return
+	}
+	// Other passkey may be added since ceremony began
+	if !h.canManagePasskeys(c, pu.passkeys) {
+		h.passkeyError(c, http.StatusForbidden, "ErrMsgPasskeySessionRequired")
+		return
+	}
+
+	cred, err := h.webauthn.FinishRegistration(pu, data, c.Request)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("Failed to finish passkey registration")
+		h.passkeyError(c, http.StatusBadRequest, "ErrMsgPasskeyFailed")
+		return
+	}
+
+	name := strings.TrimSpace(c.Query("name"))
+	if name == "" {
+		name = "Passkey " + strconv.Itoa(len(pu.passkeys)+1)
+	}
+	now := time.Now()
+	id := base64.RawURLEncoding.EncodeToString(cred.ID)
+	err = h.db.CreatePasskey(Passkey{
+		ID:         id,
+		UserID:     user.ID,
+		Name:       name,
+		Credential: *cred,
+		CreatedAt:  now,
+		LastUsed:   now,
+	})
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to save passkey")
+		h.passkeyError(c, http.StatusInternalServerError, "ErrMsgPasskeyFailed")
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"uid": user.ID,
+	}).Info("Passkey registered")
+	h.audit(c, user.ID, AuditPasskeyAdded, auditTarget("user", user.ID), map[string]any{
+		"passkey":         id,
+		"passkey_session": c.GetBool("PasskeySession"),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"redirect": "/passkeys"})
+}
+
+func (h *Handler) beginPasskeyLoginRoute(c *gin.Context) {
+	assertion, data, err := h.webauthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err == nil {
+		err = h.saveCeremony(c, passkeyLoginKey, data)
+	}
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to begin passkey login")
+		h.passkeyError(c, http.StatusInternalServerError, "ErrMsgPasskeyFailed")
+		return
+	}
+
+	c.JSON(http.StatusOK, assertion)
+}
+
+func (h *Handler) finishPasskeyLoginRoute(c *gin.Context) {
+	data, err := h.takeCeremony(c, passkeyLoginKey)
+	if err != nil {
+		h.passkeyError(c, http.StatusBadRequest, "ErrMsgPasskeyFailed")
+		return
+	}
+
+	var pu passkeyUser
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		if len(userHandle) != 8 {
+			return nil, errors.New("invalid user handle")
+		}
+		pu, err = h.loadPasskeyUser(uint(binary.BigEndian.Uint64(userHandle)))
+		return pu, err
+	}
+
+	_, cred, err := h.webauthn.FinishPasskeyLogin(findUser, data, c.Request)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("Failed to finish passkey login")
+		h.passkeyError(c, http.StatusUnauthorized, "ErrMsgPasskeyFailed")
+		return
+	}
+
+	// Keep sign counter and flags up to date
+	if key, err := h.db.GetPasskey(base64.RawURLEncoding.EncodeToString(cred.ID)); err == nil {
+		key.Credential = *cred
+		key.LastUsed = time.Now()
+		if err := h.db.UpdatePasskey(key); err != nil {
+			h.log.WithFields(logrus.Fields{
+				"err": err,
+			}).Error("Failed to update passkey")
+		}
+	}
+	if cred.Authenticator.CloneWarning {
+		h.log.WithFields(logrus.Fields{
+			"uid": pu.user.ID,
+		}).Warn("Passkey sign counter went back; authenticator may be cloned")
+	}
+
+	id := strconv.FormatUint(uint64(pu.user.ID), 10)
+	h.log.WithFields(logrus.Fields{
+		"uid":  id,
+		"name": pu.user.Name,
+	}).Info("Logged in with passkey")
+	if err := h.startSession(c, id, true); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to start session")
+		h.passkeyError(c, http.StatusInternalServerError, "ErrMsgFailedAuth500")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"redirect": "/cards"})
+}
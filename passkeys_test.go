@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestCeremonyStore(t *testing.T) {
+	s := newCeremonyStore()
+	now := time.Now()
+	data := webauthn.SessionData{Challenge: "challenge"}
+
+	id, err := s.put(passkeyLoginKey, data, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := s.take(id, passkeyLoginKey, now)
+	if !ok || got.Challenge != "challenge" {
+		t.Fatalf("take = %+v, %v", got, ok)
+	}
+	if _, ok := s.take(id, passkeyLoginKey, now); ok {
+		t.Error("ceremony finished twice")
+	}
+
+	id, _ = s.put(passkeyRegKey, data, now)
+	if _, ok := s.take(id, passkeyLoginKey, now); ok {
+		t.Error("registration taken as login")
+	}
+	if _, ok := s.take(id, passkeyRegKey, now); ok {
+		t.Error("ceremony of wrong kind was not forgotten")
+	}
+
+	id, _ = s.put(passkeyLoginKey, data, now)
+	if _, ok := s.take(id, passkeyLoginKey, now.Add(ceremonyTTL+time.Second)); ok {
+		t.Error("expired ceremony taken")
+	}
+	if _, ok := s.take("", passkeyLoginKey, now); ok {
+		t.Error("ceremony without ID taken")
+	}
+
+	s.put(passkeyLoginKey, data, now)
+	s.put(passkeyLoginKey, data, now.Add(ceremonyTTL+time.Second))
+	if len(s.items) != 1 {
+		t.Errorf("%d ceremonies stored, want expired one removed", len(s.items))
+	}
+}
+
+func TestCanManagePasskeys(t *testing.T) {
+	h := &Handler{}
+	keys := []Passkey{{ID: "key"}}
+	tests := []struct {
+		name     string
+		passkey  bool
+		required bool
+		keys     []Passkey
+		want     bool
+	}{
+		{"first passkey", false, false, nil, true},
+		{"first passkey of admin", false, true, nil, false},
+		{"other passkey without passkey session", false, false, keys, false},
+		{"passkey session", true, false, keys, true},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Set("PasskeySession", tt.passkey)
+		c.Set("PasskeyRequired", tt.required)
+		if got := h.canManagePasskeys(c, tt.keys); got != tt.want {
+			t.Errorf("%s: canManagePasskeys = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Paid feature that may be enabled by plan
+type Feature string
+
+const (
+	FeatureCustomSlug Feature = "custom-slug" // Custom card links
+	FeatureThemes     Feature = "themes"
+	FeatureFancyQR    Feature = "fancy-qr"
+)
+
+// Plan tier. Zero limits mean unlimited.
+type Plan struct {
+	ID            string
+	MaxCards      int
+	MaxMediaBytes int64 // Total size of avatars and logos of all cards
+	Features      []Feature
+}
+
+// Plans in order of increasing limits, as shown in UI
+var Plans = []Plan{
+	{
+		ID:            "free",
+		MaxCards:      3,
+		MaxMediaBytes: 10 << 20,
+	},
+	{
+		ID:            "pro",
+		MaxCards:      20,
+		MaxMediaBytes: 200 << 20,
+		Features:      []Feature{FeatureCustomSlug, FeatureThemes, FeatureFancyQR},
+	},
+	{
+		ID:            "business",
+		MaxMediaBytes: 2 << 30,
+		Features:      []Feature{FeatureCustomSlug, FeatureThemes, FeatureFancyQR},
+	},
+}
+
+func FindPlan(id string) (Plan, bool) {
+	for _, plan := range Plans {
+		if plan.ID == id {
+			return plan, true
+		}
+	}
+	return Plan{}, false
+}
+
+// Plan ID with higher limits; empty and unknown IDs are the lowest
+func betterPlan(a, b string) string {
+	rank := func(id string) int {
+		return slices.IndexFunc(Plans, func(p Plan) bool { return p.ID == id })
+	}
+	if rank(b) > rank(a) {
+		return b
+	}
+	return a
+}
+
+func (p Plan) Has(feature Feature) bool {
+	return slices.Contains(p.Features, feature)
+}
+
+// Resources used by user
+type Usage struct {
+	Cards      int
+	MediaBytes int64
+}
+
+func cardsUsage(cards []Card) Usage {
+	usage := Usage{Cards: len(cards)}
+	for _, card := range cards {
+		usage.MediaBytes += card.AvatarSize + card.LogoSize
+	}
+	return usage
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// Plan of active subscription takes precedence over the one assigned by
+// admin. Users without plan or with unknown one get default plan.
+func (h *Handler) userPlan(user *User) Plan {
+	if user.Subscription.Active(time.Now()) {
+		if plan, ok := FindPlan(user.Subscription.Plan); ok {
+			return plan
+		}
+	}
+	if plan, ok := FindPlan(user.Plan); ok {
+		return plan
+	}
+	plan, _ := FindPlan(h.cfg.DefaultPlan)
+	return plan
+}
+
+func (h *Handler) planTitle(c *gin.Context, plan Plan) string {
+	return h.localize(c, "Plan"+camelKey(plan.ID))
+}
+
+// "custom-slug" -> "CustomSlug"; used to build locale keys
+func camelKey(id string) string {
+	key := ""
+	for _, part := range strings.Split(id, "-") {
+		if part != "" {
+			key += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return key
+}
+
+// Localized description of plan usage for cards page
+func (h *Handler) planUsage(c *gin.Context, plan Plan, usage Usage) gin.H {
+	maxCards := h.localize(c, "Unlimited")
+	if plan.MaxCards > 0 {
+		maxCards = fmt.Sprint(plan.MaxCards)
+	}
+	maxMedia := h.localize(c, "Unlimited")
+	if plan.MaxMediaBytes > 0 {
+		maxMedia = formatBytes(plan.MaxMediaBytes)
+	}
+	features := []string{}
+	for _, feature := range plan.Features {
+		features = append(features, h.localize(c, "Feature"+camelKey(string(feature))))
+	}
+	return gin.H{
+		"Plan":     h.planTitle(c, plan),
+		"Cards":    usage.Cards,
+		"MaxCards": maxCards,
+		"Media":    formatBytes(usage.MediaBytes),
+		"MaxMedia": maxMedia,
+		"Features": features,
+	}
+}
+
+// Change of media bytes of card after saving form: sizes of uploaded
+// avatar and logo minus sizes of ones they replace
+func mediaDelta(card Card, form *multipart.Form) int64 {
+	delta := int64(0)
+	if isFileInForm(form, "avatar") {
+		delta += formFileSize(form, "avatar") - card.AvatarSize
+	}
+	if isFileInForm(form, "logo") {
+		delta += formFileSize(form, "logo") - card.LogoSize
+	}
+	return delta
+}
+
+// Checks that owner's plan allows them to have more cards and media; only
+// growth is checked, so users over quota can still edit and shrink media.
+// Writes error page and returns false if it doesn't.
+func (h *Handler) checkQuota(c *gin.Context, owner uint, cards int, media int64) bool {
+	if cards <= 0 && media <= 0 {
+		return true
+	}
+	user := User{ID: owner}
+	err := h.db.GetUser(&user)
+	var list []Card
+	if err == nil {
+		list, err = h.db.ListCards(owner)
+	}
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"uid": owner,
+		}).Error("Failed to check quota")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToCheckQuota"),
+		)
+		return false
+	}
+
+	plan := h.userPlan(&user)
+	usage := cardsUsage(list)
+
+	if cards > 0 && plan.MaxCards > 0 && usage.Cards+cards > plan.MaxCards {
+		h.errorPage(
+			c,
+			http.StatusForbidden,
+			h.localize(c, "ErrMsgCardLimitReached", "Plan", h.planTitle(c, plan), "Max", plan.MaxCards),
+		)
+		return false
+	}
+
+	if media > 0 && plan.MaxMediaBytes > 0 && usage.MediaBytes+media > plan.MaxMediaBytes {
+		h.errorPage(
+			c,
+			http.StatusRequestEntityTooLarge,
+			h.localize(
+				c, "ErrMsgStorageQuotaExceeded",
+				"Plan", h.planTitle(c, plan),
+				"Used", formatBytes(usage.MediaBytes),
+				"Max", formatBytes(plan.MaxMediaBytes),
+			),
+		)
+		return false
+	}
+
+	return true
+}
+
+// Assigns plan from :plan param to user from :id param
+func (h *Handler) changeUserPlanRoute(c *gin.Context) {
+	user := getUser(c)
+
+	if !user.Can(PermUsersManage, 0) {
+		h.errorPage(c, http.StatusNotFound, "")
+		return
+	}
+
+	uid, err := getUintParam(c, "id")
+	if err != nil {
+		h.errorBlock(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgBrokenUserID"),
+		)
+		return
+	}
+
+	plan, ok := FindPlan(c.Param("plan"))
+	if !ok {
+		h.errorBlock(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgUnknownPlan"),
+		)
+		return
+	}
+
+	target := User{ID: uid}
+	if err := h.db.GetUser(&target); err != nil {
+		h.errorBlock(c, http.StatusNotFound, "")
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"admin": user.ID,
+		"uid":   target.ID,
+		"from":  target.Plan,
+		"to":    plan.ID,
+	}).Info("User plan changed")
+
+	before := target.Plan
+	target.Plan = plan.ID
+	if err := h.db.UpdateUser(target); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to update user")
+		h.errorBlock(c, http.StatusInternalServerError, "")
+		return
+	}
+	h.audit(c, user.ID, AuditPlanChanged, auditTarget("user", target.ID), AuditDiff{}.Add(
+		"plan", before, plan.ID,
+	))
+
+	redirect(c, "/users")
+}
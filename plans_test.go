@@ -0,0 +1,34 @@
+package main
+
+import (
+	"mime/multipart"
+	"testing"
+)
+
+func TestMediaDelta(t *testing.T) {
+	card := Card{AvatarSize: 300, LogoSize: 100}
+	form := func(files map[string]int64) *multipart.Form {
+		f := &multipart.Form{File: map[string][]*multipart.FileHeader{}}
+		for input, size := range files {
+			f.File[input] = []*multipart.FileHeader{{Size: size}}
+		}
+		return f
+	}
+	tests := []struct {
+		name  string
+		card  Card
+		files map[string]int64
+		want  int64
+	}{
+		{"new card", Card{}, map[string]int64{"avatar": 300, "logo": 100}, 400},
+		{"nothing uploaded", card, nil, 0},
+		{"bigger avatar", card, map[string]int64{"avatar": 500}, 200},
+		{"smaller avatar", card, map[string]int64{"avatar": 100}, -200},
+		{"both replaced", card, map[string]int64{"avatar": 250, "logo": 200}, 50},
+	}
+	for _, tt := range tests {
+		if got := mediaDelta(tt.card, form(tt.files)); got != tt.want {
+			t.Errorf("%s: mediaDelta = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
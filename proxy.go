@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Extracts real client IP for requests coming through reverse proxies.
+//
+// Addresses from X-Forwarded-For are accepted only from trusted proxies:
+//   - TRUSTED_PROXIES is a comma separated list of IPs/CIDRs of proxies
+//     that are allowed to set X-Forwarded-For.
+//   - TRUSTED_PROXY_HOPS is a number of proxies in front of the service
+//     which addresses are not known in advance (e.g. Heroku router, that
+//     appends real client address to X-Forwarded-For; use 1 there).
+//
+// Without any of them X-Forwarded-For is ignored and remote address of
+// connection is used.
+type ProxyConfig struct {
+	TrustedProxies []string `env:"TRUSTED_PROXIES"`
+	Hops           int      `env:"TRUSTED_PROXY_HOPS" min:"0"`
+
+	trusted []*net.IPNet
+}
+
+// Parses IP or CIDR; single IP is treated as /32 or /128 network
+func parseTrustedProxy(str string) (*net.IPNet, error) {
+	if !strings.Contains(str, "/") {
+		if strings.Contains(str, ":") {
+			str += "/128"
+		} else {
+			str += "/32"
+		}
+	}
+	_, cidr, err := net.ParseCIDR(str)
+	return cidr, err
+}
+
+func SetupProxyConfig(log *logrus.Logger, p ProxyConfig) *ProxyConfig {
+	for _, str := range p.TrustedProxies {
+		cidr, err := parseTrustedProxy(str)
+		if err != nil {
+			log.Fatalf("Failed to parse TRUSTED_PROXIES entry: %s", str)
+		}
+		p.trusted = append(p.trusted, cidr)
+	}
+
+	log.WithFields(logrus.Fields{
+		"trusted": len(p.trusted),
+		"hops":    p.Hops,
+	}).Debug("Proxy config loaded")
+
+	return &p
+}
+
+func (p *ProxyConfig) isTrusted(ip net.IP) bool {
+	for _, cidr := range p.trusted {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns address of the client that made the request
+func (p *ProxyConfig) ClientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		remote = strings.TrimSpace(r.RemoteAddr)
+	}
+
+	chain := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				chain = append(chain, addr)
+			}
+		}
+	}
+	// Full chain of addresses with the closest one at the end
+	chain = append(chain, remote)
+
+	// Skip proxies with unknown addresses
+	i := len(chain) - 1
+	for hop := 0; hop < p.Hops && i > 0; hop++ {
+		i--
+	}
+	// Skip trusted proxies
+	for i > 0 {
+		ip := net.ParseIP(chain[i])
+		if ip == nil || !p.isTrusted(ip) {
+			break
+		}
+		i--
+	}
+
+	if net.ParseIP(chain[i]) == nil {
+		// Garbage in X-Forwarded-For; fallback to the closest peer
+		return remote
+	}
+	return chain[i]
+}
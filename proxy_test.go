@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseTrustedProxy(t *testing.T) {
+	tests := []struct {
+		str  string
+		want string
+	}{
+		{"10.0.0.1", "10.0.0.1/32"},
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"::1", "::1/128"},
+		{"fd00::/8", "fd00::/8"},
+	}
+	for _, tt := range tests {
+		cidr, err := parseTrustedProxy(tt.str)
+		if err != nil || cidr.String() != tt.want {
+			t.Errorf("parseTrustedProxy(%q) = %v, %v, want %s", tt.str, cidr, err, tt.want)
+		}
+	}
+	for _, str := range []string{"", "proxy", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxy(str); err == nil {
+			t.Errorf("parseTrustedProxy(%q) accepted", str)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+
+	tests := []struct {
+		name    string
+		trusted []string
+		hops    int
+		remote  string
+		xff     []string
+		want    string
+	}{
+		{"no proxy", nil, 0, "1.1.1.1:1234", nil, "1.1.1.1"},
+		{"remote without port", nil, 0, "1.1.1.1", nil, "1.1.1.1"},
+		{"untrusted peer ignored", nil, 0, "1.1.1.1:1234", []string{"2.2.2.2"}, "1.1.1.1"},
+		{"untrusted peer not in list", []string{"10.0.0.0/8"}, 0, "1.1.1.1:1234", []string{"2.2.2.2"}, "1.1.1.1"},
+		{"trusted peer", []string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", []string{"2.2.2.2"}, "2.2.2.2"},
+		{
+			"rightmost untrusted hop",
+			[]string{"10.0.0.0/8"}, 0, "10.0.0.1:1234",
+			[]string{"6.6.6.6, 2.2.2.2, 10.0.0.2"}, "2.2.2.2",
+		},
+		{
+			"several headers",
+			[]string{"10.0.0.0/8"}, 0, "10.0.0.1:1234",
+			[]string{"6.6.6.6", "2.2.2.2, 10.0.0.2"}, "2.2.2.2",
+		},
+		{"all trusted", []string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"garbage", []string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", []string{"unknown"}, "10.0.0.1"},
+		{"hops", nil, 1, "3.3.3.3:1234", []string{"6.6.6.6, 2.2.2.2"}, "2.2.2.2"},
+		{"hops appended by proxy", nil, 1, "3.3.3.3:1234", []string{"2.2.2.2"}, "2.2.2.2"},
+		{"hops over chain", nil, 3, "3.3.3.3:1234", []string{"2.2.2.2"}, "2.2.2.2"},
+		{
+			"hops and trusted",
+			[]string{"10.0.0.0/8"}, 1, "3.3.3.3:1234",
+			[]string{"6.6.6.6, 2.2.2.2, 10.0.0.2"}, "2.2.2.2",
+		},
+		{"ipv6", []string{"::1"}, 0, "[::1]:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := SetupProxyConfig(log, ProxyConfig{TrustedProxies: tt.trusted, Hops: tt.hops})
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, xff := range tt.xff {
+				r.Header.Add("X-Forwarded-For", xff)
+			}
+			if got := p.ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"io"
 	"slices"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -28,18 +30,28 @@ func remove[T comparable](l []T, item T) []T {
 }
 
 type RamDB struct {
-	Users           map[uint]User // User ID -> User
-	Cards           map[uint]Card // Card ID -> Card
-	MaxUID          uint
-	MaxCID          uint
-	usersByProvider map[string]uint // Provider ID -> User ID
-	cardsByUser     map[uint][]uint // User ID -> Slice of Card ID's
-	storage         *BlobStorage
-	ctx             context.Context
-	name            string
-	mu              sync.Mutex
-	defaultUserType uint
-	admins          []string
+	Users       map[uint]User       // User ID -> User
+	Cards       map[uint]Card       // Card ID -> Card
+	Sessions    map[string]Session  // Session ID -> Session
+	Identities  map[string]Identity // Provider ID -> Identity
+	LoginTokens map[string]LoginToken
+	Passkeys    map[string]Passkey // Credential ID -> Passkey
+	Events      map[string]ProcessedEvent
+	Orgs        map[uint]Org
+	Memberships []Membership
+	Audit       []AuditEntry
+	CardStats   []CardStat
+	MaxUID      uint
+	MaxCID      uint
+	MaxOID      uint
+	MaxAID      uint
+	cardsByUser map[uint][]uint // User ID -> Slice of Card ID's
+	storage     *BlobStorage
+	ctx         context.Context
+	name        string
+	mu          sync.Mutex
+	defaultRole Role
+	admins      []string
 }
 
 func LoadRamDb(
@@ -47,15 +59,15 @@ func LoadRamDb(
 	log *logrus.Logger,
 	storage *BlobStorage,
 	name string,
-	defaultUserType uint,
+	defaultRole Role,
 	admins []string,
 ) (Database, error) {
 	db := RamDB{
-		storage:         storage,
-		ctx:             ctx,
-		name:            name,
-		defaultUserType: defaultUserType,
-		admins:          admins,
+		storage:     storage,
+		ctx:         ctx,
+		name:        name,
+		defaultRole: defaultRole,
+		admins:      admins,
 	}
 	_, obj, err := storage.GetKey(ctx, name, false)
 	if err != nil {
@@ -81,20 +93,45 @@ func (db *RamDB) init() {
 	if db.Cards == nil {
 		db.Cards = make(map[uint]Card)
 	}
-	if db.usersByProvider == nil {
-		db.usersByProvider = make(map[string]uint)
+	if db.Sessions == nil {
+		db.Sessions = make(map[string]Session)
+	}
+	if db.Passkeys == nil {
+		db.Passkeys = make(map[string]Passkey)
+	}
+	if db.Orgs == nil {
+		db.Orgs = make(map[uint]Org)
+	}
+	if db.Events == nil {
+		db.Events = make(map[string]ProcessedEvent)
+	}
+	if db.LoginTokens == nil {
+		db.LoginTokens = make(map[string]LoginToken)
+	}
+	if db.Identities == nil {
+		db.Identities = make(map[string]Identity)
 	}
 	if db.cardsByUser == nil {
 		db.cardsByUser = make(map[uint][]uint)
 	}
+	// Users created before identities were introduced
 	for _, user := range db.Users {
-		db.usersByProvider[user.ProviderID] = user.ID
+		if _, ok := db.Identities[user.ProviderID]; !ok && user.ProviderID != "" {
+			db.Identities[user.ProviderID] = Identity{
+				ProviderID: user.ProviderID,
+				UserID:     user.ID,
+				Name:       user.Name,
+				CreatedAt:  time.Now(),
+			}
+		}
 	}
 	for _, card := range db.Cards {
 		db.cardsByUser[card.Owner] = append(db.cardsByUser[card.Owner], card.ID)
 	}
 }
 
+// Writes whole DB to storage. Caller must hold db.mu, as marshaling reads
+// all maps.
 func (db *RamDB) save() error {
 	data, err := json.Marshal(db)
 	if err != nil {
@@ -107,22 +144,28 @@ func (db *RamDB) save() error {
 func (db *RamDB) SignUser(pid, name string) (string, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	uid, ok := db.usersByProvider[pid]
+	identity, ok := db.Identities[pid]
+	uid := identity.UserID
 	if !ok {
-		typ := db.defaultUserType
+		role := db.defaultRole
 		if slices.Contains(db.admins, pid) {
-			typ = UserTypeAdmin
+			role = RoleAdmin
 		}
 		user := User{
 			ID:         db.MaxUID + 1,
 			ProviderID: pid,
 			Name:       name,
-			Type:       typ,
+			Role:       role,
 		}
 		uid = user.ID
 		db.MaxUID = user.ID
 		db.Users[user.ID] = user
-		db.usersByProvider[pid] = user.ID
+		db.Identities[pid] = Identity{
+			ProviderID: pid,
+			UserID:     user.ID,
+			Name:       name,
+			CreatedAt:  time.Now(),
+		}
 		db.cardsByUser[user.ID] = []uint{}
 		if err := db.save(); err != nil {
 			return "", err
@@ -132,6 +175,8 @@ func (db *RamDB) SignUser(pid, name string) (string, error) {
 }
 
 func (db *RamDB) GetUser(user *User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	found, ok := db.Users[user.ID]
 	if !ok {
 		return fmt.Errorf("User %d not found", user.ID)
@@ -141,30 +186,49 @@ func (db *RamDB) GetUser(user *User) error {
 }
 
 func (db *RamDB) DeleteUser(uid uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	user, ok := db.Users[uid]
 	if !ok {
 		return nil
 	}
-	cards, err := db.ListCards(uid)
-	if err != nil {
-		return err
+	for _, cid := range slices.Clone(db.cardsByUser[uid]) {
+		if err := db.deleteCard(cid); err != nil {
+			db.save()
+			return err
+		}
 	}
-	for _, card := range cards {
-		e := db.DeleteCard(card.ID)
-		if e != nil {
-			err = e
+	for pid, identity := range db.Identities {
+		if identity.UserID == uid {
+			delete(db.Identities, pid)
 		}
 	}
+	for id, key := range db.Passkeys {
+		if key.UserID == uid {
+			delete(db.Passkeys, id)
+		}
+	}
+	for id, sess := range db.Sessions {
+		if sess.UserID == uid {
+			delete(db.Sessions, id)
+		}
+	}
+	db.Memberships = slices.DeleteFunc(db.Memberships, func(m Membership) bool {
+		return m.UserID == uid
+	})
 	delete(db.Users, user.ID)
-	delete(db.usersByProvider, user.ProviderID)
+	delete(db.cardsByUser, user.ID)
 	return db.save()
 }
 
 func (db *RamDB) CreateCard(owner uint, fields CardFields) (Card, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	card := Card{
-		ID:     db.MaxCID + 1,
-		Owner:  uint(owner),
-		Fields: fields,
+		ID:        db.MaxCID + 1,
+		Owner:     uint(owner),
+		Fields:    fields,
+		CreatedAt: time.Now(),
 	}
 	db.MaxCID = card.ID
 	db.Cards[card.ID] = card
@@ -173,16 +237,34 @@ func (db *RamDB) CreateCard(owner uint, fields CardFields) (Card, error) {
 }
 
 func (db *RamDB) UpdateCard(card Card) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	db.Cards[card.ID] = card
 	return db.save()
 }
 
 func (db *RamDB) UpdateUser(user User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	db.Users[user.ID] = user
 	return db.save()
 }
 
+func (db *RamDB) ScheduleDeletion(uid uint, at *time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user, ok := db.Users[uid]
+	if !ok {
+		return fmt.Errorf("User %d not found", uid)
+	}
+	user.DeleteAt = at
+	db.Users[uid] = user
+	return db.save()
+}
+
 func (db *RamDB) GetCard(cid uint) (Card, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	card, ok := db.Cards[cid]
 	if !ok {
 		return card, fmt.Errorf("Card %d not found", cid)
@@ -191,8 +273,21 @@ func (db *RamDB) GetCard(cid uint) (Card, error) {
 }
 
 func (db *RamDB) DeleteCard(cid uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.deleteCard(cid); err != nil {
+		return err
+	}
+	return db.save()
+}
+
+// Deletes card with its media and stats; caller must hold db.mu and save
+func (db *RamDB) deleteCard(cid uint) error {
 	card, ok := db.Cards[cid]
 	if ok {
+		if err := deleteCardMedia(db.storage, card); err != nil {
+			return err
+		}
 		usercards, ok := db.cardsByUser[card.Owner]
 		if ok {
 			// O(n)
@@ -200,10 +295,30 @@ func (db *RamDB) DeleteCard(cid uint) error {
 		}
 	}
 	delete(db.Cards, cid)
-	return db.save()
+	db.CardStats = slices.DeleteFunc(db.CardStats, func(stat CardStat) bool {
+		return stat.CardID == cid
+	})
+	return nil
+}
+
+func (db *RamDB) ListUsersDueForDeletion(now time.Time) ([]User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	users := []User{}
+	for _, user := range db.Users {
+		if user.DeleteAt != nil && !user.DeleteAt.After(now) {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].DeleteAt.Before(*users[j].DeleteAt)
+	})
+	return users, nil
 }
 
 func (db *RamDB) ListCards(uid uint) ([]Card, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	result := []Card{}
 	cards, ok := db.cardsByUser[uid]
 	if ok {
@@ -217,10 +332,652 @@ func (db *RamDB) ListCards(uid uint) ([]Card, error) {
 	return result, nil
 }
 
-func (db *RamDB) ListUsers() ([]User, error) {
-	result := []User{}
+func (db *RamDB) Stats(since time.Time) (Stats, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stats := Stats{
+		Users:           int64(len(db.Users)),
+		UsersByRole:     map[Role]int64{},
+		UsersByProvider: map[string]int64{},
+		Cards:           int64(len(db.Cards)),
+	}
 	for _, user := range db.Users {
-		result = append(result, user)
+		stats.UsersByRole[user.Role]++
+	}
+
+	type userProvider struct {
+		provider string
+		uid      uint
+	}
+	seen := map[userProvider]bool{}
+	for _, identity := range db.Identities {
+		key := userProvider{identity.Provider(), identity.UserID}
+		if !seen[key] {
+			seen[key] = true
+			stats.UsersByProvider[identity.Provider()]++
+		}
+	}
+
+	days := map[time.Time]int64{}
+	for _, card := range db.Cards {
+		if card.Fields.IsHidden {
+			stats.HiddenCards++
+		}
+		for _, key := range []string{card.Avatar, card.Logo} {
+			if key != "" {
+				stats.MediaObjects++
+			}
+		}
+		stats.MediaBytes += card.AvatarSize + card.LogoSize
+		if !card.CreatedAt.Before(since) {
+			y, m, d := card.CreatedAt.Date()
+			days[time.Date(y, m, d, 0, 0, 0, 0, card.CreatedAt.Location())]++
+		}
+	}
+	for day, count := range days {
+		stats.CardsPerDay = append(stats.CardsPerDay, DayCount{Day: day, Count: count})
+	}
+	sort.Slice(stats.CardsPerDay, func(i, j int) bool {
+		return stats.CardsPerDay[i].Day.Before(stats.CardsPerDay[j].Day)
+	})
+	return stats, nil
+}
+
+func (db *RamDB) SearchUsers(q UserQuery) ([]UserSummary, error) {
+	db.mu.Lock()
+	identities := map[uint][]Identity{}
+	for _, identity := range db.Identities {
+		identities[identity.UserID] = append(identities[identity.UserID], identity)
+	}
+	result := []UserSummary{}
+	for _, user := range db.Users {
+		if !q.Match(user, identities[user.ID]) {
+			continue
+		}
+		summary := UserSummary{User: user, Cards: len(db.cardsByUser[user.ID])}
+		if q.After != nil && !q.less(*q.After, q.cursor(summary)) {
+			continue
+		}
+		result = append(result, summary)
+	}
+	db.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return q.less(q.cursor(result[i]), q.cursor(result[j]))
+	})
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
 	}
 	return result, nil
 }
+
+func (db *RamDB) LinkIdentity(uid uint, pid, name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if identity, ok := db.Identities[pid]; ok {
+		if identity.UserID != uid {
+			return ErrIdentityTaken
+		}
+		return nil
+	}
+	db.Identities[pid] = Identity{
+		ProviderID: pid,
+		UserID:     uid,
+		Name:       name,
+		CreatedAt:  time.Now(),
+	}
+	return db.save()
+}
+
+func (db *RamDB) UnlinkIdentity(uid uint, pid string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	identity, ok := db.Identities[pid]
+	if !ok || identity.UserID != uid {
+		return fmt.Errorf("Identity %s of user %d not found", pid, uid)
+	}
+	rest := db.listIdentities(uid)
+	rest = slices.DeleteFunc(rest, func(i Identity) bool {
+		return i.ProviderID == pid
+	})
+	if len(rest) == 0 {
+		return ErrLastIdentity
+	}
+	delete(db.Identities, pid)
+	// Keep User.ProviderID pointing to linked identity
+	if user := db.Users[uid]; user.ProviderID == pid {
+		user.ProviderID = rest[0].ProviderID
+		db.Users[uid] = user
+	}
+	return db.save()
+}
+
+func (db *RamDB) listIdentities(uid uint) []Identity {
+	result := []Identity{}
+	for _, identity := range db.Identities {
+		if identity.UserID == uid {
+			result = append(result, identity)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result
+}
+
+func (db *RamDB) ListIdentities(uid uint) ([]Identity, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.listIdentities(uid), nil
+}
+
+func (db *RamDB) MergeUsers(dst, src uint) error {
+	if dst == src {
+		return fmt.Errorf("can't merge user %d with itself", dst)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	into, ok := db.Users[dst]
+	if !ok {
+		return fmt.Errorf("User %d not found", dst)
+	}
+	from, ok := db.Users[src]
+	if !ok {
+		return fmt.Errorf("User %d not found", src)
+	}
+	if from.Subscription.Active(time.Now()) {
+		return ErrSubscribed
+	}
+	for pid, identity := range db.Identities {
+		if identity.UserID == src {
+			identity.UserID = dst
+			db.Identities[pid] = identity
+		}
+	}
+	for id, key := range db.Passkeys {
+		if key.UserID == src {
+			key.UserID = dst
+			db.Passkeys[id] = key
+		}
+	}
+	for _, cid := range db.cardsByUser[src] {
+		if card, ok := db.Cards[cid]; ok {
+			card.Owner = dst
+			db.Cards[cid] = card
+			db.cardsByUser[dst] = append(db.cardsByUser[dst], cid)
+		}
+	}
+	delete(db.cardsByUser, src)
+	// Orgs both users are members of keep membership of dst
+	for i, m := range db.Memberships {
+		if m.UserID == src && db.findMembership(m.OrgID, dst) < 0 {
+			db.Memberships[i].UserID = dst
+		}
+	}
+	db.Memberships = slices.DeleteFunc(db.Memberships, func(m Membership) bool {
+		return m.UserID == src
+	})
+	for id, sess := range db.Sessions {
+		if sess.UserID == src {
+			delete(db.Sessions, id)
+		}
+	}
+	if into.Lang == "" {
+		into.Lang = from.Lang
+	}
+	into.Plan = betterPlan(into.Plan, from.Plan)
+	db.Users[dst] = into
+	delete(db.Users, src)
+	return db.save()
+}
+
+func (db *RamDB) CreateSession(sess Session) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.Sessions[sess.ID] = sess
+	return db.save()
+}
+
+func (db *RamDB) GetSession(id string) (Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	sess, ok := db.Sessions[id]
+	if !ok {
+		return sess, fmt.Errorf("Session %s not found", id)
+	}
+	return sess, nil
+}
+
+func (db *RamDB) UpdateSession(sess Session) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.Sessions[sess.ID]; !ok {
+		return fmt.Errorf("Session %s not found", sess.ID)
+	}
+	db.Sessions[sess.ID] = sess
+	return db.save()
+}
+
+func (db *RamDB) ListSessions(uid uint) ([]Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	result := []Session{}
+	for _, sess := range db.Sessions {
+		if sess.UserID == uid {
+			result = append(result, sess)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastSeen.After(result[j].LastSeen)
+	})
+	return result, nil
+}
+
+func (db *RamDB) DeleteSession(id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.Sessions, id)
+	return db.save()
+}
+
+func (db *RamDB) DeleteUserSessions(uid uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for id, sess := range db.Sessions {
+		if sess.UserID == uid {
+			delete(db.Sessions, id)
+		}
+	}
+	return db.save()
+}
+
+func (db *RamDB) DeleteExpiredSessions(idle, created time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	deleted := false
+	for id, sess := range db.Sessions {
+		if sess.LastSeen.Before(idle) || sess.CreatedAt.Before(created) {
+			delete(db.Sessions, id)
+			deleted = true
+		}
+	}
+	if !deleted {
+		return nil
+	}
+	return db.save()
+}
+
+func (db *RamDB) CreatePasskey(key Passkey) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.Passkeys[key.ID]; ok {
+		return fmt.Errorf("Passkey %s already exists", key.ID)
+	}
+	db.Passkeys[key.ID] = key
+	return db.save()
+}
+
+func (db *RamDB) GetPasskey(id string) (Passkey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key, ok := db.Passkeys[id]
+	if !ok {
+		return key, fmt.Errorf("Passkey %s not found", id)
+	}
+	return key, nil
+}
+
+func (db *RamDB) UpdatePasskey(key Passkey) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.Passkeys[key.ID]; !ok {
+		return fmt.Errorf("Passkey %s not found", key.ID)
+	}
+	db.Passkeys[key.ID] = key
+	return db.save()
+}
+
+func (db *RamDB) ListPasskeys(uid uint) ([]Passkey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	result := []Passkey{}
+	for _, key := range db.Passkeys {
+		if key.UserID == uid {
+			result = append(result, key)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+func (db *RamDB) DeletePasskey(uid uint, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key, ok := db.Passkeys[id]
+	if !ok || key.UserID != uid {
+		return fmt.Errorf("Passkey %s not found", id)
+	}
+	delete(db.Passkeys, id)
+	return db.save()
+}
+
+func (db *RamDB) CreateLoginToken(token LoginToken) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.LoginTokens[token.ID] = token
+	return db.save()
+}
+
+func (db *RamDB) UseLoginToken(id string) (LoginToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	token, ok := db.LoginTokens[id]
+	if !ok {
+		return token, fmt.Errorf("Login token not found")
+	}
+	delete(db.LoginTokens, id)
+	return token, db.save()
+}
+
+func (db *RamDB) DeleteExpiredLoginTokens(now time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	deleted := false
+	for id, token := range db.LoginTokens {
+		if token.ExpiresAt.Before(now) {
+			delete(db.LoginTokens, id)
+			deleted = true
+		}
+	}
+	if !deleted {
+		return nil
+	}
+	return db.save()
+}
+
+func (db *RamDB) ProcessBillingEvent(event BillingEvent) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.Events[event.ID]; ok {
+		return ErrEventProcessed
+	}
+	db.Events[event.ID] = ProcessedEvent{
+		ID:        event.ID,
+		UserID:    event.UserID,
+		Type:      event.Type,
+		CreatedAt: time.Now(),
+	}
+	user, ok := db.Users[event.UserID]
+	if ok {
+		user.Subscription.Apply(event)
+		db.Users[user.ID] = user
+	}
+	if err := db.save(); err != nil {
+		return err
+	}
+	if !ok {
+		return ErrEventNoUser
+	}
+	return nil
+}
+
+func (db *RamDB) CreateOrg(org Org, admin uint) (Org, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	org.ID = db.MaxOID + 1
+	org.CreatedAt = time.Now()
+	db.MaxOID = org.ID
+	db.Orgs[org.ID] = org
+	db.Memberships = append(db.Memberships, Membership{
+		OrgID:     org.ID,
+		UserID:    admin,
+		Role:      OrgAdmin,
+		CreatedAt: org.CreatedAt,
+	})
+	return org, db.save()
+}
+
+func (db *RamDB) GetOrg(id uint) (Org, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	org, ok := db.Orgs[id]
+	if !ok {
+		return org, fmt.Errorf("Org %d not found", id)
+	}
+	return org, nil
+}
+
+func (db *RamDB) UpdateOrg(org Org) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.Orgs[org.ID]; !ok {
+		return fmt.Errorf("Org %d not found", org.ID)
+	}
+	db.Orgs[org.ID] = org
+	return db.save()
+}
+
+func (db *RamDB) DeleteOrg(id uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for cid, card := range db.Cards {
+		if card.OrgID == id {
+			card.OrgID = 0
+			db.Cards[cid] = card
+		}
+	}
+	db.Memberships = slices.DeleteFunc(db.Memberships, func(m Membership) bool {
+		return m.OrgID == id
+	})
+	delete(db.Orgs, id)
+	return db.save()
+}
+
+func (db *RamDB) FindOrgByInvite(code string) (Org, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, org := range db.Orgs {
+		if org.InviteCode != "" && org.InviteCode == code {
+			return org, nil
+		}
+	}
+	return Org{}, fmt.Errorf("Org with invite %s not found", code)
+}
+
+func (db *RamDB) ListOrgs(uid uint) ([]Org, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	result := []Org{}
+	for _, m := range db.Memberships {
+		if org, ok := db.Orgs[m.OrgID]; ok && m.UserID == uid {
+			result = append(result, org)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// Index of membership or -1
+func (db *RamDB) findMembership(org, uid uint) int {
+	return slices.IndexFunc(db.Memberships, func(m Membership) bool {
+		return m.OrgID == org && m.UserID == uid
+	})
+}
+
+func (db *RamDB) GetMembership(org, uid uint) (Membership, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	i := db.findMembership(org, uid)
+	if i < 0 {
+		return Membership{}, fmt.Errorf("User %d is not a member of org %d", uid, org)
+	}
+	return db.Memberships[i], nil
+}
+
+func (db *RamDB) ListMembers(org uint) ([]Membership, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	result := []Membership{}
+	for _, m := range db.Memberships {
+		if m.OrgID == org {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+func (db *RamDB) SaveMembership(m Membership) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if i := db.findMembership(m.OrgID, m.UserID); i >= 0 {
+		db.Memberships[i] = m
+	} else {
+		db.Memberships = append(db.Memberships, m)
+	}
+	return db.save()
+}
+
+func (db *RamDB) DeleteMembership(org, uid uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, cid := range db.cardsByUser[uid] {
+		if card, ok := db.Cards[cid]; ok && card.OrgID == org {
+			card.OrgID = 0
+			db.Cards[cid] = card
+		}
+	}
+	if i := db.findMembership(org, uid); i >= 0 {
+		db.Memberships = slices.Delete(db.Memberships, i, i+1)
+	}
+	return db.save()
+}
+
+func (db *RamDB) ListOrgCards(org uint) ([]Card, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	result := []Card{}
+	for _, card := range db.Cards {
+		if card.OrgID == org {
+			result = append(result, card)
+		}
+	}
+	sort.Sort(ByID(result))
+	return result, nil
+}
+
+func (db *RamDB) AppendAudit(entry AuditEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	entry.ID = db.MaxAID + 1
+	db.MaxAID = entry.ID
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	db.Audit = append(db.Audit, entry)
+	return db.save()
+}
+
+func (db *RamDB) ListAudit(f AuditFilter) ([]AuditEntry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	entries := []AuditEntry{}
+	for i := len(db.Audit) - 1; i >= 0; i-- {
+		if f.Limit > 0 && len(entries) == f.Limit {
+			break
+		}
+		if f.Match(db.Audit[i]) {
+			entries = append(entries, db.Audit[i])
+		}
+	}
+	return entries, nil
+}
+
+func (db *RamDB) DeleteAuditBefore(t time.Time) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n := len(db.Audit)
+	db.Audit = slices.DeleteFunc(db.Audit, func(e AuditEntry) bool {
+		return e.CreatedAt.Before(t)
+	})
+	deleted := int64(n - len(db.Audit))
+	if deleted == 0 {
+		return 0, nil
+	}
+	return deleted, db.save()
+}
+
+// Whole DB is rewritten on save, so it is skipped if there is nothing new
+func (db *RamDB) AddCardStats(stats []CardStat) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	changed := false
+	for _, stat := range stats {
+		// Counters of cards deleted before flush are dropped
+		if _, ok := db.Cards[stat.CardID]; !ok || stat.Empty() {
+			continue
+		}
+		changed = true
+		i := slices.IndexFunc(db.CardStats, func(old CardStat) bool {
+			return old.CardID == stat.CardID && old.Day.Equal(stat.Day)
+		})
+		if i < 0 {
+			db.CardStats = append(db.CardStats, stat)
+		} else {
+			db.CardStats[i] = db.CardStats[i].Add(stat)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return db.save()
+}
+
+func (db *RamDB) ListCardStats(cid uint, from time.Time) ([]CardStat, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stats := []CardStat{}
+	for _, stat := range db.CardStats {
+		if stat.CardID == cid && !stat.Day.Before(from) {
+			stats = append(stats, stat)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Day.Before(stats[j].Day)
+	})
+	return stats, nil
+}
+
+func (db *RamDB) ListDirectory(q DirectoryQuery) ([]Card, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	cards := []Card{}
+	for _, card := range db.Cards {
+		if !card.Fields.Listed || card.Fields.IsHidden {
+			continue
+		}
+		if q.BeforeID != 0 && card.ID >= q.BeforeID {
+			continue
+		}
+		if owner, ok := db.Users[card.Owner]; !ok || owner.DeleteAt != nil {
+			continue
+		}
+		company := card.Fields.Company
+		if company == "" {
+			company = db.Orgs[card.OrgID].Name
+		}
+		if q.Match(card, company) {
+			cards = append(cards, card)
+		}
+	}
+	sort.Slice(cards, func(i, j int) bool {
+		return cards[i].ID > cards[j].ID
+	})
+	if q.Limit > 0 && len(cards) > q.Limit {
+		cards = cards[:q.Limit]
+	}
+	return cards, nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/sirupsen/logrus"
+)
+
+// In-memory S3 with just enough of the API for BlobStorage
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+	puts     int
+}
+
+// Decodes body sent with aws-chunked encoding:
+// "<hex size>;chunk-signature=<sig>\r\n<data>\r\n" ... "0;...\r\n\r\n"
+func decodeAWSChunked(body io.Reader) ([]byte, error) {
+	r := bufio.NewReader(body)
+	out := []byte{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return out, nil
+		}
+		chunk := make([]byte, size+2) // With trailing CRLF
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		out = append(out, chunk[:size]...)
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		var data []byte
+		var err error
+		if strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") ||
+			strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			data, err = decodeAWSChunked(r.Body)
+		} else {
+			data, err = io.ReadAll(r.Body)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = data
+		s.modified[key] = time.Now()
+		s.puts++
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodGet, http.MethodHead:
+		if r.URL.Query().Get("list-type") == "2" {
+			s.list(w, key+r.URL.Query().Get("prefix"))
+			return
+		}
+		data, ok := s.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			}
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(s.objects, key)
+		delete(s.modified, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListObjectsV2 response; bucket path is a prefix of object paths
+func (s *fakeS3) list(w http.ResponseWriter, prefix string) {
+	bucket, _, _ := strings.Cut(strings.TrimPrefix(prefix, "/"), "/")
+	keys := []string{}
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<ListBucketResult><Name>%s</Name><KeyCount>%d</KeyCount><IsTruncated>false</IsTruncated>`, bucket, len(keys))
+	for _, key := range keys {
+		fmt.Fprintf(
+			w,
+			`<Contents><Key>%s</Key><LastModified>%s</LastModified><Size>%d</Size></Contents>`,
+			strings.TrimPrefix(key, "/"+bucket+"/"),
+			s.modified[key].UTC().Format(time.RFC3339),
+			len(s.objects[key]),
+		)
+	}
+	io.WriteString(w, `</ListBucketResult>`)
+}
+
+func (s *fakeS3) putCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.puts
+}
+
+// BlobStorage with "cards" bucket in fake S3
+func newTestStorage(t *testing.T) (*BlobStorage, *fakeS3) {
+	t.Helper()
+	s3 := &fakeS3{objects: map[string][]byte{}, modified: map[string]time.Time{}}
+	srv := httptest.NewServer(s3)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4("key", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	storage := &BlobStorage{
+		client: client,
+		bucket: "cards",
+		cache:  NewCache(10, 1<<20, log),
+	}
+	return storage, s3
+}
+
+// RamDB saved to fake S3
+func newTestRamDB(t *testing.T) (*RamDB, *fakeS3) {
+	t.Helper()
+	storage, s3 := newTestStorage(t)
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	db, err := LoadRamDb(context.Background(), log, storage, "db.json", RoleMember, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db.(*RamDB), s3
+}
+
+func TestRamDBSaved(t *testing.T) {
+	db, s3 := newTestRamDB(t)
+	if _, err := db.SignUser("test::1", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	data := s3.objects["/cards/db.json"]
+	if !bytes.Contains(data, []byte(`"Alice"`)) {
+		t.Errorf("saved DB has no user: %s", data)
+	}
+}
+
+func TestRamDBDeleteUser(t *testing.T) {
+	db, s3 := newTestRamDB(t)
+	id, _ := db.SignUser("test::1", "Alice")
+	uid64, _ := strconv.ParseUint(id, 10, 64)
+	uid := uint(uid64)
+
+	card, err := db.CreateCard(uid, CardFields{Name: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	card.Avatar = "media/avatar/1.webp"
+	s3.objects["/cards/"+card.Avatar] = []byte("image")
+	db.UpdateCard(card)
+	db.AddCardStats([]CardStat{{CardID: card.ID, Day: statDay(time.Now()), Views: 1}})
+
+	if err := db.DeleteUser(uid); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.GetUser(&User{ID: uid}); err == nil {
+		t.Error("user not deleted")
+	}
+	if _, err := db.GetCard(card.ID); err == nil {
+		t.Error("card not deleted")
+	}
+	if _, ok := s3.objects["/cards/"+card.Avatar]; ok {
+		t.Error("avatar not deleted")
+	}
+	if stats, _ := db.ListCardStats(card.ID, time.Time{}); len(stats) != 0 {
+		t.Error("card stats not deleted")
+	}
+	if ids, _ := db.ListIdentities(uid); len(ids) != 0 {
+		t.Error("identities not deleted")
+	}
+}
+
+func TestRamDBScheduleDeletion(t *testing.T) {
+	db, _ := newTestRamDB(t)
+	id, _ := db.SignUser("test::1", "Alice")
+	user := User{}
+	fmt.Sscan(id, &user.ID)
+	db.GetUser(&user)
+	user.Role = RoleAdmin
+	db.UpdateUser(user)
+
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := db.ScheduleDeletion(user.ID, &at); err != nil {
+		t.Fatal(err)
+	}
+	stored := User{ID: user.ID}
+	db.GetUser(&stored)
+	if stored.DeleteAt == nil || !stored.DeleteAt.Equal(at) || stored.Role != RoleAdmin {
+		t.Errorf("after scheduling: %+v", stored)
+	}
+	if err := db.ScheduleDeletion(user.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	stored = User{ID: user.ID}
+	db.GetUser(&stored)
+	if stored.DeleteAt != nil || stored.Role != RoleAdmin {
+		t.Errorf("after cancelling: %+v", stored)
+	}
+	if err := db.ScheduleDeletion(999, &at); err == nil {
+		t.Error("deletion of unknown user scheduled")
+	}
+}
+
+func TestRamDBAudit(t *testing.T) {
+	db, _ := newTestRamDB(t)
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.AppendAudit(AuditEntry{
+				Action:    AuditUserErased,
+				Target:    auditTarget("user", uint(i)),
+				CreatedAt: now.Add(-time.Duration(i) * time.Hour),
+			})
+		}()
+	}
+	wg.Wait()
+
+	entries, _ := db.ListAudit(AuditFilter{})
+	if len(entries) != 20 {
+		t.Fatalf("%d entries, want 20", len(entries))
+	}
+	ids := map[uint]bool{}
+	for _, e := range entries {
+		ids[e.ID] = true
+	}
+	if len(ids) != 20 {
+		t.Errorf("entry IDs are not unique")
+	}
+
+	deleted, err := db.DeleteAuditBefore(now.Add(-10*time.Hour + time.Minute))
+	if err != nil || deleted != 10 {
+		t.Errorf("DeleteAuditBefore = %d, %v; want 10", deleted, err)
+	}
+}
+
+// Admin pages read users and cards while requests change them
+func TestRamDBConcurrentAccess(t *testing.T) {
+	db, _ := newTestRamDB(t)
+	id, _ := db.SignUser("test::1", "Alice")
+	uid64, _ := strconv.ParseUint(id, 10, 64)
+	uid := uint(uid64)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			card, err := db.CreateCard(uid, CardFields{Name: "Alice"})
+			if err == nil {
+				db.UpdateCard(card)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			user := User{ID: uid}
+			if db.GetUser(&user) == nil {
+				user.Lang = "en"
+				db.UpdateUser(user)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			db.SearchUsers(UserQuery{Limit: 10})
+			db.ListCards(uid)
+			db.Stats(time.Now().AddDate(0, 0, -30))
+		}()
+	}
+	wg.Wait()
+
+	cards, _ := db.ListCards(uid)
+	if len(cards) != 10 {
+		t.Errorf("%d cards, want 10", len(cards))
+	}
+	users, _ := db.SearchUsers(UserQuery{Limit: 10})
+	if len(users) != 1 || users[0].Cards != 10 {
+		t.Errorf("SearchUsers = %+v", users)
+	}
+}
+
+func TestRamDBAddCardStats(t *testing.T) {
+	db, s3 := newTestRamDB(t)
+	id, _ := db.SignUser("test::1", "Alice")
+	uid64, _ := strconv.ParseUint(id, 10, 64)
+	card, _ := db.CreateCard(uint(uid64), CardFields{Name: "Alice"})
+	day := statDay(time.Now())
+
+	puts := s3.putCount()
+	db.AddCardStats(nil)
+	db.AddCardStats([]CardStat{{CardID: card.ID, Day: day}, {CardID: 999, Day: day, Views: 1}})
+	if s3.putCount() != puts {
+		t.Error("DB saved without new counters")
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			db.AddCardStats([]CardStat{{CardID: card.ID, Day: day, Views: 2, Visitors: 1}})
+		}()
+		go func() {
+			defer wg.Done()
+			db.UpdateCard(card)
+		}()
+	}
+	wg.Wait()
+
+	stats, _ := db.ListCardStats(card.ID, day)
+	if len(stats) != 1 || stats[0].Views != 20 || stats[0].Visitors != 10 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if stats, _ := db.ListCardStats(999, day); len(stats) != 0 {
+		t.Error("stats of unknown card saved")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Storage of token buckets. In-memory one is enough for a single instance;
+// multi-instance deployments may plug a shared one.
+type RateLimitStore interface {
+	// Take one token from the bucket with given key.
+	// Returns false and time to wait until next token if bucket is empty.
+	Take(key string, rate float64, burst int) (bool, time.Duration)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	idle    time.Duration // Buckets untouched for this long are dropped
+}
+
+func NewMemoryRateLimitStore(ctx context.Context, idle time.Duration) *MemoryRateLimitStore {
+	s := &MemoryRateLimitStore{
+		buckets: make(map[string]*bucket),
+		idle:    idle,
+	}
+	go func() {
+		ticker := time.NewTicker(idle)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.cleanup(now)
+			}
+		}
+	}()
+	return s
+}
+
+func (s *MemoryRateLimitStore) cleanup(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, b := range s.buckets {
+		if now.Sub(b.last) > s.idle {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(key string, rate float64, burst int) (bool, time.Duration) {
+	return s.take(key, rate, burst, time.Now())
+}
+
+func (s *MemoryRateLimitStore) take(key string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	} else {
+		b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// Token bucket policy: Burst requests at once, refilled with Rate per second
+type RateLimitPolicy struct {
+	Name   string
+	Rate   float64
+	Burst  int
+	ByUser bool // Key by user ID for logged in users instead of IP
+}
+
+// Parses "<requests>/<duration>" like "30/1m". "off" disables the policy.
+func parseRateLimit(str string) (rate float64, burst int, err error) {
+	count, period, ok := strings.Cut(str, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected <requests>/<duration>, got %q", str)
+	}
+	burst, err = strconv.Atoi(count)
+	if err != nil || burst < 1 {
+		return 0, 0, fmt.Errorf("invalid requests count %q", count)
+	}
+	dur, err := time.ParseDuration(period)
+	if err != nil || dur <= 0 {
+		return 0, 0, fmt.Errorf("invalid duration %q", period)
+	}
+	return float64(burst) / dur.Seconds(), burst, nil
+}
+
+// Returns nil if policy is "off"
+func newRateLimitPolicy(log *logrus.Logger, name, str string, byUser bool) *RateLimitPolicy {
+	if str == "off" {
+		log.Warnf("Rate limiting for %s disabled", name)
+		return nil
+	}
+	rate, burst, err := parseRateLimit(str)
+	if err != nil {
+		log.Fatalf("Failed to parse %s rate limit: %s", name, err)
+	}
+	return &RateLimitPolicy{
+		Name:   name,
+		Rate:   rate,
+		Burst:  burst,
+		ByUser: byUser,
+	}
+}
+
+type RateLimits struct {
+	Auth   *RateLimitPolicy
+	Upload *RateLimitPolicy
+	Media  *RateLimitPolicy
+	Card   *RateLimitPolicy
+	Report *RateLimitPolicy
+	Email  *RateLimitPolicy // Login links sent to one address
+}
+
+func SetupRateLimits(log *logrus.Logger, cfg RateLimitConfig) RateLimits {
+	return RateLimits{
+		Auth:   newRateLimitPolicy(log, "auth", cfg.Auth, false),
+		Upload: newRateLimitPolicy(log, "upload", cfg.Upload, true),
+		Media:  newRateLimitPolicy(log, "media", cfg.Media, false),
+		Card:   newRateLimitPolicy(log, "card", cfg.Card, false),
+		Report: newRateLimitPolicy(log, "report", cfg.Report, false),
+		Email:  newRateLimitPolicy(log, "email", cfg.Email, false),
+	}
+}
+
+// Middleware limiting requests rate by policy
+func (h *Handler) rateLimit(policy *RateLimitPolicy) gin.HandlerFunc {
+	if policy == nil {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		key := policy.Name + ":ip:" + h.clientIP(c)
+		if user := getUser(c); policy.ByUser && user != nil {
+			key = fmt.Sprintf("%s:user:%d", policy.Name, user.ID)
+		}
+
+		ok, wait := h.limiter.Take(key, policy.Rate, policy.Burst)
+		if ok {
+			c.Next()
+			return
+		}
+
+		h.log.WithFields(logrus.Fields{
+			"key":  key,
+			"path": c.Request.URL.Path,
+		}).Warn("Rate limit exceeded")
+
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		if c.GetHeader("HX-Request") == "true" {
+			h.errorBlock(c, http.StatusTooManyRequests, "")
+		} else {
+			h.errorPage(c, http.StatusTooManyRequests, "")
+		}
+		c.Abort()
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		str   string
+		rate  float64
+		burst int
+		ok    bool
+	}{
+		{"30/1m", 0.5, 30, true},
+		{"5/1s", 5, 5, true},
+		{"1/2s", 0.5, 1, true},
+		{"30", 0, 0, false},
+		{"0/1m", 0, 0, false},
+		{"-1/1m", 0, 0, false},
+		{"x/1m", 0, 0, false},
+		{"30/0s", 0, 0, false},
+		{"30/-1m", 0, 0, false},
+		{"30/minute", 0, 0, false},
+	}
+	for _, tt := range tests {
+		rate, burst, err := parseRateLimit(tt.str)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseRateLimit(%q) err = %v", tt.str, err)
+			continue
+		}
+		if rate != tt.rate || burst != tt.burst {
+			t.Errorf("parseRateLimit(%q) = %v, %v, want %v, %v", tt.str, rate, burst, tt.rate, tt.burst)
+		}
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewMemoryRateLimitStore(ctx, time.Hour)
+	now := time.Unix(1700000000, 0)
+
+	// Burst of 3, one token per second
+	for i := range 3 {
+		if ok, _ := s.take("a", 1, 3, now); !ok {
+			t.Fatalf("request %d of burst limited", i+1)
+		}
+	}
+	ok, wait := s.take("a", 1, 3, now)
+	if ok || wait != time.Second {
+		t.Errorf("empty bucket: take = %v, %v, want false, 1s", ok, wait)
+	}
+	if ok, _ := s.take("b", 1, 3, now); !ok {
+		t.Error("other key limited")
+	}
+
+	ok, wait = s.take("a", 1, 3, now.Add(500*time.Millisecond))
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("half refilled: take = %v, %v, want false, 500ms", ok, wait)
+	}
+	if ok, _ := s.take("a", 1, 3, now.Add(time.Second)); !ok {
+		t.Error("bucket not refilled")
+	}
+	if ok, _ := s.take("a", 1, 3, now.Add(time.Second)); ok {
+		t.Error("refilled more than one token")
+	}
+
+	// Refill is capped by burst
+	later := now.Add(time.Hour)
+	for i := range 3 {
+		if ok, _ := s.take("a", 1, 3, later); !ok {
+			t.Fatalf("request %d after idle limited", i+1)
+		}
+	}
+	if ok, _ := s.take("a", 1, 3, later); ok {
+		t.Error("bucket refilled over burst")
+	}
+
+	s.cleanup(later.Add(30 * time.Minute))
+	if _, ok := s.buckets["a"]; !ok {
+		t.Error("active bucket dropped")
+	}
+	if _, ok := s.buckets["b"]; ok {
+		t.Error("idle bucket kept")
+	}
+	s.cleanup(later.Add(2 * time.Hour))
+	if len(s.buckets) != 0 {
+		t.Errorf("%d buckets left after cleanup", len(s.buckets))
+	}
+}
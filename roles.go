@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Role of user. Values are stored in DB: first three match former user
+// types (usual, admin, limited).
+type Role uint
+
+const (
+	RoleMember    Role = 0 // Manages own cards
+	RoleAdmin     Role = 1 // Can do anything
+	RoleViewer    Role = 2 // Can only view public cards
+	RoleModerator Role = 3 // Support staff; views users and hides abusive cards
+)
+
+// Roles in order of increasing rights, as shown in UI
+var Roles = []Role{RoleViewer, RoleMember, RoleModerator, RoleAdmin}
+
+var roleNames = map[Role]string{
+	RoleViewer:    "viewer",
+	RoleMember:    "member",
+	RoleModerator: "moderator",
+	RoleAdmin:     "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return "role(" + strconv.FormatUint(uint64(r), 10) + ")"
+}
+
+// Parses role name; legacy numeric user types are accepted as well
+func ParseRole(str string) (Role, error) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	for role, name := range roleNames {
+		if str == name || str == strconv.FormatUint(uint64(role), 10) {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q; expected viewer, member, moderator or admin", str)
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	role, err := ParseRole(string(text))
+	if err == nil {
+		*r = role
+	}
+	return err
+}
+
+// Permissions on resources that have owner come in pairs: ":own" one
+// applies to user's own resources, ":any" one to resources of anyone.
+type Permission string
+
+const (
+	PermCardsViewOwn Permission = "cards:view:own" // View hidden cards
+	PermCardsViewAny Permission = "cards:view:any"
+	PermCardsEditOwn Permission = "cards:edit:own" // Create, edit and delete cards
+	PermCardsEditAny Permission = "cards:edit:any"
+	PermCardsHideOwn Permission = "cards:hide:own" // Change card visibility
+	PermCardsHideAny Permission = "cards:hide:any"
+	PermUsersView    Permission = "users:view"   // List users and their cards
+	PermUsersManage  Permission = "users:manage" // Change roles, delete, merge and sign out users
+	PermAuditView    Permission = "audit:view"   // View and export audit log
+	PermStatsView    Permission = "stats:view"   // View admin dashboard
+)
+
+var memberPermissions = []Permission{
+	PermCardsViewOwn,
+	PermCardsEditOwn,
+	PermCardsHideOwn,
+}
+
+var moderatorPermissions = append([]Permission{
+	PermCardsViewAny,
+	PermCardsHideAny,
+	PermUsersView,
+}, memberPermissions...)
+
+var rolePermissions = map[Role][]Permission{
+	RoleViewer:    {},
+	RoleMember:    memberPermissions,
+	RoleModerator: moderatorPermissions,
+	RoleAdmin: append([]Permission{
+		PermCardsEditAny,
+		PermUsersManage,
+		PermAuditView,
+		PermStatsView,
+	}, moderatorPermissions...),
+}
+
+func (r Role) Has(perm Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether role has all permissions of other one
+func (r Role) Includes(other Role) bool {
+	for _, p := range rolePermissions[other] {
+		if !r.Has(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Policy check used by all routes. Owner is ID of user that owns resource
+// or 0 if there is no such; ":any" permission is granted on user's own
+// resources if they have ":own" counterpart. Anonymous user can't do
+// anything.
+func (u *User) Can(perm Permission, owner uint) bool {
+	if u == nil {
+		return false
+	}
+	if u.Role.Has(perm) {
+		return true
+	}
+	if base, ok := strings.CutSuffix(string(perm), ":any"); ok && owner != 0 && owner == u.ID {
+		return u.Role.Has(Permission(base + ":own"))
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CSPModeEnforce    = "enforce"
+	CSPModeReportOnly = "report-only"
+	CSPModeOff        = "off"
+)
+
+// Directives are written in this order
+var cspDirectives = []string{
+	"default-src",
+	"script-src",
+	"style-src",
+	"img-src",
+	"font-src",
+	"connect-src",
+	"manifest-src",
+	"worker-src",
+	"frame-src",
+	"object-src",
+	"base-uri",
+	"form-action",
+	"frame-ancestors",
+}
+
+type SecurityConfig struct {
+	CSPMode           string `env:"CSP_MODE" default:"enforce"` // enforce, report-only or off
+	ReportURI         string `env:"CSP_REPORT_URI" default:"/csp-report"`
+	HSTSMaxAge        int    `env:"HSTS_MAX_AGE" default:"31536000" min:"0"` // 0 by default when GO_ENV=debug
+	HSTSSubdomains    bool   `env:"HSTS_INCLUDE_SUBDOMAINS"`
+	ReferrerPolicy    string `env:"REFERRER_POLICY" default:"strict-origin-when-cross-origin"`
+	PermissionsPolicy string `env:"PERMISSIONS_POLICY" default:"camera=(), microphone=(), geolocation=(), payment=(), usb=()"`
+}
+
+func SetupSecurity(log *logrus.Logger, cfg SecurityConfig) *SecurityConfig {
+	if cfg.CSPMode == CSPModeOff {
+		log.Warn("Content-Security-Policy disabled")
+	}
+	return &cfg
+}
+
+type cspPolicy map[string][]string
+
+func (cfg *SecurityConfig) basePolicy(nonce string) cspPolicy {
+	return cspPolicy{
+		"default-src":     {"'self'"},
+		"script-src":      {"'self'", "'nonce-" + nonce + "'"},
+		"style-src":       {"'self'", "'unsafe-inline'"}, // style="" attributes
+		"img-src":         {"'self'", "data:", "blob:"},  // QR codes & previews
+		"font-src":        {"'self'"},
+		"connect-src":     {"'self'"},
+		"manifest-src":    {"'self'"},
+		"worker-src":      {"'self'"},
+		"frame-src":       {"'none'"},
+		"object-src":      {"'none'"},
+		"base-uri":        {"'self'"},
+		"form-action":     {"'self'"},
+		"frame-ancestors": {"'none'"},
+	}
+}
+
+func (p cspPolicy) allow(directive string, sources ...string) {
+	if slices.Equal(p[directive], []string{"'none'"}) {
+		p[directive] = nil
+	}
+	for _, src := range sources {
+		if !slices.Contains(p[directive], src) {
+			p[directive] = append(p[directive], src)
+		}
+	}
+}
+
+func (p cspPolicy) String(reportURI string) string {
+	parts := []string{}
+	for _, directive := range cspDirectives {
+		if sources, ok := p[directive]; ok {
+			parts = append(parts, directive+" "+strings.Join(sources, " "))
+		}
+	}
+	if reportURI != "" {
+		parts = append(parts, "report-uri "+reportURI, "report-to csp")
+	}
+	return strings.Join(parts, "; ")
+}
+
+func newCSPNonce() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func (h *Handler) writeCSP(c *gin.Context, policy cspPolicy) {
+	switch h.security.CSPMode {
+	case CSPModeEnforce:
+		c.Header("Content-Security-Policy", policy.String(h.security.ReportURI))
+	case CSPModeReportOnly:
+		c.Header("Content-Security-Policy-Report-Only", policy.String(h.security.ReportURI))
+	}
+}
+
+// Extends CSP of current response with additional sources.
+// Should be called before response body is written.
+func (h *Handler) allowCSP(c *gin.Context, directive string, sources ...string) {
+	policy, ok := c.Get("CSP")
+	if !ok {
+		return
+	}
+	policy.(cspPolicy).allow(directive, sources...)
+	h.writeCSP(c, policy.(cspPolicy))
+}
+
+func (h *Handler) securityHeaders(c *gin.Context) {
+	nonce := newCSPNonce()
+	c.Set("CSPNonce", nonce)
+
+	if h.security.CSPMode != CSPModeOff {
+		policy := h.security.basePolicy(nonce)
+		c.Set("CSP", policy)
+		h.writeCSP(c, policy)
+		c.Header("Reporting-Endpoints", `csp="`+h.security.ReportURI+`"`)
+	}
+
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Referrer-Policy", h.security.ReferrerPolicy)
+	c.Header("Permissions-Policy", h.security.PermissionsPolicy)
+
+	if h.security.HSTSMaxAge > 0 {
+		hsts := "max-age=" + strconv.Itoa(h.security.HSTSMaxAge)
+		if h.security.HSTSSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		c.Header("Strict-Transport-Security", hsts)
+	}
+}
+
+// Collects CSP violation reports sent by browsers
+func (h *Handler) cspReportRoute(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, 64*1024)
+
+	var report any
+	if err := json.NewDecoder(c.Request.Body).Decode(&report); err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"ip":     h.clientIP(c),
+		"agent":  c.Request.UserAgent(),
+		"report": report,
+	}).Warn("CSP violation")
+
+	c.Status(http.StatusNoContent)
+}
@@ -6,8 +6,6 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
-	"os"
-	"strconv"
 	"sync"
 	"time"
 
@@ -33,30 +31,8 @@ func dict(values ...interface{}) (map[string]interface{}, error) {
 	return m, nil
 }
 
-func SetupServer(log *logrus.Logger, localizer func(string, string) string) (*gin.Engine, *http.Server) {
-	str_ttl := os.Getenv("COOKIE_TTL")
-	cookie_ttl := 24
-	if str_ttl == "" {
-		log.Warnf("Cookies TTL not set; using default value %d hours", cookie_ttl)
-	} else {
-		ttl, err := strconv.Atoi(str_ttl)
-		cookie_ttl = ttl
-		if err != nil {
-			log.Fatalf("Failed to parse cooie ttl: %s", str_ttl)
-		}
-	}
-
-	host, port := os.Getenv("GIN_HOST"), os.Getenv("GIN_PORT")
-	if host == "" {
-		host = "0.0.0.0"
-	}
-	if port == "" {
-		port = os.Getenv("PORT") // heroku case
-		if port == "" {
-			port = "8080"
-		}
-	}
-	addr := fmt.Sprintf("%s:%s", host, port)
+func SetupServer(log *logrus.Logger, localizer func(string, string, ...any) string, cfg *Config) (*gin.Engine, *http.Server) {
+	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
 
 	log.WithFields(logrus.Fields{
 		"addr": addr,
@@ -83,12 +59,12 @@ func SetupServer(log *logrus.Logger, localizer func(string, string) string) (*gi
 	}).ParseGlob("templates/*.html"))
 	g.SetHTMLTemplate(tmpl)
 
-	store := cookie.NewStore([]byte(os.Getenv("SESSION_SECRET")))
+	store := cookie.NewStore([]byte(cfg.Server.SessionSecret))
 	store.Options(sessions.Options{
 		Path:     "/",
-		MaxAge:   3600 * cookie_ttl,
-		HttpOnly: os.Getenv("GO_ENV") == "debug",
-		Secure:   os.Getenv("GO_ENV") != "debug",
+		MaxAge:   3600 * cfg.Server.CookieTTL,
+		HttpOnly: true,
+		Secure:   !cfg.Debug(),
 		SameSite: http.SameSiteLaxMode,
 	})
 	g.Use(sessions.Sessions("login", store))
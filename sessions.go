@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const sessionTokenKey = "sid"
+
+// Minimal interval between LastSeen updates
+const sessionTouchEvery = 5 * time.Minute
+
+// Server side sessions expiration settings
+type SessionConfig struct {
+	IdleTTL     time.Duration `env:"SESSION_IDLE_TTL" default:"168h"`     // Since last request
+	AbsoluteTTL time.Duration `env:"SESSION_ABSOLUTE_TTL" default:"720h"` // Since login
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (cfg SessionConfig) expired(sess Session, now time.Time) bool {
+	return now.Sub(sess.LastSeen) > cfg.IdleTTL || now.Sub(sess.CreatedAt) > cfg.AbsoluteTTL
+}
+
+// Periodically removes expired sessions from DB
+func (h *Handler) runSessionCleanup() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.ctx.Done():
+				return
+			case now := <-ticker.C:
+				err := h.db.DeleteExpiredSessions(
+					now.Add(-h.sessionCfg.IdleTTL),
+					now.Add(-h.sessionCfg.AbsoluteTTL),
+				)
+				if err != nil {
+					h.log.WithFields(logrus.Fields{
+						"err": err,
+					}).Error("Failed to delete expired sessions")
+				}
+			}
+		}
+	}()
+}
+
+// Creates server side session for user and binds it to the cookie
+func (h *Handler) createSession(c *gin.Context, uid uint, passkey bool) error {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(buf)
+	now := time.Now()
+	err := h.db.CreateSession(Session{
+		ID:        hashSessionToken(token),
+		UserID:    uid,
+		UserAgent: c.Request.UserAgent(),
+		IP:        h.clientIP(c),
+		CreatedAt: now,
+		LastSeen:  now,
+		Passkey:   passkey,
+	})
+	if err != nil {
+		return err
+	}
+	sessions.Default(c).Set(sessionTokenKey, token)
+	return nil
+}
+
+// Returns server side session bound to the cookie if it is still valid
+func (h *Handler) currentSession(c *gin.Context) (Session, bool) {
+	token, ok := sessions.Default(c).Get(sessionTokenKey).(string)
+	if !ok || token == "" {
+		return Session{}, false
+	}
+	sess, err := h.db.GetSession(hashSessionToken(token))
+	if err != nil {
+		return sess, false
+	}
+	now := time.Now()
+	if h.sessionCfg.expired(sess, now) {
+		if err := h.db.DeleteSession(sess.ID); err != nil {
+			h.log.WithFields(logrus.Fields{
+				"err": err,
+			}).Error("Failed to delete expired session")
+		}
+		return sess, false
+	}
+	if now.Sub(sess.LastSeen) > sessionTouchEvery {
+		sess.LastSeen = now
+		sess.IP = h.clientIP(c)
+		sess.UserAgent = c.Request.UserAgent()
+		if err := h.db.UpdateSession(sess); err != nil {
+			h.log.WithFields(logrus.Fields{
+				"err": err,
+			}).Error("Failed to update session")
+		}
+	}
+	return sess, true
+}
+
+// Deletes server side session bound to cookie and clears the cookie
+func (h *Handler) endSession(c *gin.Context) {
+	sess := sessions.Default(c)
+	if token, ok := sess.Get(sessionTokenKey).(string); ok && token != "" {
+		if err := h.db.DeleteSession(hashSessionToken(token)); err != nil {
+			h.log.WithFields(logrus.Fields{
+				"err": err,
+			}).Error("Failed to delete session")
+		}
+	}
+	sess.Clear()
+	sess.Save()
+}
+
+func (h *Handler) sessionsRoute(c *gin.Context) {
+	user := getUser(c)
+
+	list, err := h.db.ListSessions(user.ID)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to list sessions")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToListSessions"),
+		)
+		return
+	}
+
+	h.execHTML(c, http.StatusOK, "page_sessions.html", gin.H{
+		"Title":    h.localize(c, "TitleSessions"),
+		"Sessions": list,
+		"Current":  c.GetString("SessionID"),
+	})
+}
+
+// Signs out one of user's sessions
+func (h *Handler) revokeSessionRoute(c *gin.Context) {
+	user := getUser(c)
+
+	sess, err := h.db.GetSession(c.Param("id"))
+	if err != nil || sess.UserID != user.ID {
+		h.errorBlock(c, http.StatusNotFound, "")
+		return
+	}
+
+	if err := h.db.DeleteSession(sess.ID); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to delete session")
+		h.errorBlock(c, http.StatusInternalServerError, "")
+		return
+	}
+
+	redirect(c, "/sessions")
+}
+
+// Signs out all user's sessions except the current one
+func (h *Handler) revokeOtherSessionsRoute(c *gin.Context) {
+	user := getUser(c)
+	current := c.GetString("SessionID")
+
+	list, err := h.db.ListSessions(user.ID)
+	if err == nil {
+		for _, sess := range list {
+			if sess.ID == current {
+				continue
+			}
+			if e := h.db.DeleteSession(sess.ID); e != nil {
+				err = e
+			}
+		}
+	}
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to delete sessions")
+		h.errorBlock(c, http.StatusInternalServerError, "")
+		return
+	}
+
+	redirect(c, "/sessions")
+}
+
+// Signs out all sessions of the user
+func (h *Handler) revokeUserSessionsRoute(c *gin.Context) {
+	user := getUser(c)
+
+	if !user.Can(PermUsersManage, 0) {
+		h.errorPage(c, http.StatusNotFound, "")
+		return
+	}
+
+	uid, err := getUintParam(c, "id")
+	if err != nil {
+		h.errorBlock(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgBrokenUserID"),
+		)
+		return
+	}
+
+	if err := h.db.DeleteUserSessions(uid); err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+			"uid": uid,
+		}).Error("Failed to delete user sessions")
+		h.errorBlock(c, http.StatusInternalServerError, "")
+		return
+	}
+
+	h.log.WithFields(logrus.Fields{
+		"admin": user.ID,
+		"uid":   uid,
+	}).Info("User sessions revoked")
+	h.audit(c, user.ID, AuditSessionsRevoked, auditTarget("user", uid), nil)
+
+	redirect(c, "/users")
+}
@@ -26,6 +26,27 @@ const setupToggle = () => {
   });
 };
 
+// Card ID when on public card page, not in editor preview
+const publicCardId = () => {
+  const m = window.location.pathname.match(/^\/c\/(\d+)/);
+  return m ? m[1] : null;
+};
+
+// Reports vCard download or app install to card stats
+const sendCardEvent = (event) => {
+  const id = publicCardId();
+  if (id && navigator.sendBeacon) {
+    navigator.sendBeacon(`/c/${id}/event/${event}`);
+  }
+};
+
+// Link in online QR code; src param counts the scans
+const cardLink = () => {
+  const id = publicCardId();
+  if (!id) return window.location.href;
+  return `${window.location.origin}/c/${id}?src=qr`;
+};
+
 const isValidImageURL = (url) => {
   if (!url) return false;
   if (url === window.location.href) return false;
@@ -219,7 +240,7 @@ async function updateQRCode(text, targetId) {
 
 async function updateQRCodes() {
   console.log("Generating QR codes...");
-  await updateQRCode(window.location.href, "qr-code");
+  await updateQRCode(cardLink(), "qr-code");
   await updateQRCode(getVcf(), "qr-code-offline");
   console.log("QR codes generated");
 }
@@ -234,5 +255,7 @@ document.addEventListener("DOMContentLoaded", () => {
     a.download = getCardData().name + ".vcf";
     a.click();
     URL.revokeObjectURL(url);
+    sendCardEvent("vcard");
   });
+  window.addEventListener("appinstalled", () => sendCardEvent("install"));
 });
@@ -0,0 +1,27 @@
+const csrfToken = () => {
+  const meta = document.querySelector('meta[name="csrf-token"]');
+  return meta ? meta.content : "";
+};
+
+// Add token to all HTMX requests
+document.addEventListener("htmx:configRequest", (e) => {
+  e.detail.headers["X-CSRF-Token"] = csrfToken();
+});
+
+// Add token to plain POST forms
+const addCsrfInput = (form) => {
+  if (form.querySelector('input[name="_csrf"]')) return;
+  const input = document.createElement("input");
+  input.type = "hidden";
+  input.name = "_csrf";
+  input.value = csrfToken();
+  form.appendChild(input);
+};
+
+document.addEventListener("DOMContentLoaded", () => {
+  document.querySelectorAll("form").forEach((form) => {
+    if ((form.getAttribute("method") || "").toLowerCase() === "post") {
+      addCsrfInput(form);
+    }
+  });
+});
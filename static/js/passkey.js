@@ -0,0 +1,105 @@
+// WebAuthn ceremonies; options come from /auth-passkey/* endpoints
+const b64urlToBuf = (str) => {
+  const b64 = str.replace(/-/g, "+").replace(/_/g, "/");
+  const bin = atob(b64 + "=".repeat((4 - (b64.length % 4)) % 4));
+  return Uint8Array.from(bin, (c) => c.charCodeAt(0)).buffer;
+};
+
+const bufToB64url = (buf) =>
+  btoa(String.fromCharCode(...new Uint8Array(buf)))
+    .replace(/\+/g, "-")
+    .replace(/\//g, "_")
+    .replace(/=+$/, "");
+
+const showPasskeyError = (text) => {
+  const block = document.getElementById("global-error-block");
+  if (!block) return;
+  block.textContent = text;
+  block.style.visibility = "visible";
+};
+
+const passkeyPost = async (url, body) => {
+  const resp = await fetch(url, {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+      "X-CSRF-Token": csrfToken(),
+    },
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  const data = await resp.json().catch(() => ({}));
+  if (!resp.ok) throw new Error(data.error || resp.statusText);
+  return data;
+};
+
+const credentialToJSON = (cred) => {
+  const resp = {};
+  for (const key of [
+    "clientDataJSON",
+    "attestationObject",
+    "authenticatorData",
+    "signature",
+    "userHandle",
+  ]) {
+    if (cred.response[key]) resp[key] = bufToB64url(cred.response[key]);
+  }
+  if (cred.response.getTransports) {
+    resp.transports = cred.response.getTransports();
+  }
+  return {
+    id: cred.id,
+    rawId: bufToB64url(cred.rawId),
+    type: cred.type,
+    authenticatorAttachment: cred.authenticatorAttachment,
+    clientExtensionResults: cred.getClientExtensionResults(),
+    response: resp,
+  };
+};
+
+const registerPasskey = async (name) => {
+  try {
+    const { publicKey } = await passkeyPost("/auth-passkey/register/begin");
+    publicKey.challenge = b64urlToBuf(publicKey.challenge);
+    publicKey.user.id = b64urlToBuf(publicKey.user.id);
+    (publicKey.excludeCredentials || []).forEach((c) => {
+      c.id = b64urlToBuf(c.id);
+    });
+    const cred = await navigator.credentials.create({ publicKey });
+    const url =
+      "/auth-passkey/register/finish?name=" + encodeURIComponent(name || "");
+    const data = await passkeyPost(url, credentialToJSON(cred));
+    window.location = data.redirect;
+  } catch (e) {
+    showPasskeyError(e.message);
+  }
+};
+
+const loginPasskey = async () => {
+  try {
+    const { publicKey } = await passkeyPost("/auth-passkey/login/begin");
+    publicKey.challenge = b64urlToBuf(publicKey.challenge);
+    (publicKey.allowCredentials || []).forEach((c) => {
+      c.id = b64urlToBuf(c.id);
+    });
+    const cred = await navigator.credentials.get({ publicKey });
+    const data = await passkeyPost(
+      "/auth-passkey/login/finish",
+      credentialToJSON(cred),
+    );
+    window.location = data.redirect;
+  } catch (e) {
+    showPasskeyError(e.message);
+  }
+};
+
+document.addEventListener("DOMContentLoaded", () => {
+  const login = document.getElementById("passkey-login");
+  if (login) login.addEventListener("click", loginPasskey);
+
+  const register = document.getElementById("passkey-register");
+  if (register) {
+    register.addEventListener("click", () => {
+      registerPasskey(document.getElementById("passkey-name").value);
+    });
+  }
+});
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	statsDays    = 30 // Days in cards per day chart
+	recentErrors = 20 // Errors kept for dashboard
+)
+
+// Dashboard with totals for admins
+func (h *Handler) adminRoute(c *gin.Context) {
+	if !getUser(c).Can(PermStatsView, 0) {
+		h.errorPage(c, http.StatusNotFound, "")
+		return
+	}
+
+	y, m, d := time.Now().Date()
+	since := time.Date(y, m, d-statsDays+1, 0, 0, 0, 0, time.Local)
+	stats, err := h.db.Stats(since)
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to collect stats")
+		h.errorPage(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToCollectStats"),
+		)
+		return
+	}
+
+	roles := []gin.H{}
+	for _, role := range Roles {
+		roles = append(roles, gin.H{
+			"Title": h.localize(c, "Role"+camelKey(role.String())),
+			"Count": stats.UsersByRole[role],
+		})
+	}
+
+	providers := []gin.H{}
+	for _, provider := range h.providers {
+		providers = append(providers, gin.H{
+			"Title": provider.Title,
+			"Count": stats.UsersByProvider[provider.Name],
+		})
+	}
+
+	// Days without new cards are missing in stats
+	counts := map[string]int64{}
+	for _, day := range stats.CardsPerDay {
+		counts[day.Day.Format(time.DateOnly)] += day.Count
+	}
+	days := []gin.H{}
+	var most, total int64
+	for i := range statsDays {
+		day := since.AddDate(0, 0, i).Format(time.DateOnly)
+		days = append(days, gin.H{"Day": day, "Count": counts[day]})
+		most = max(most, counts[day])
+		total += counts[day]
+	}
+
+	cache := h.storage.CacheStats()
+
+	h.execHTML(c, http.StatusOK, "page_admin.html", gin.H{
+		"Title":       h.localize(c, "TitleAdmin"),
+		"Stats":       stats,
+		"PublicCards": stats.Cards - stats.HiddenCards,
+		"MediaBytes":  formatBytes(stats.MediaBytes),
+		"Roles":       roles,
+		"Providers":   providers,
+		"Days":        days,
+		"DaysMax":     most,
+		"DaysTotal":   total,
+		"Cache":       cache,
+		"CacheMemory": formatBytes(cache.MemUsed),
+		"HitRatio":    fmt.Sprintf("%.1f%%", cache.HitRatio()*100),
+		"Errors":      h.errors.Recent(),
+	})
+}
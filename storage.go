@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"context"
 	"io"
-	"os"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
@@ -85,48 +85,57 @@ func (s *BlobStorage) WriteKey(ctx context.Context, key string, src io.Reader, s
 	return err
 }
 
-// DelKey deletes from S3. If useCache==true, also evicts from cache.
+// DelKey deletes from S3 and evicts from cache.
 func (s *BlobStorage) DelKey(ctx context.Context, key string) error {
 	fullKey := s.prefix + key
+	s.cache.Delete(fullKey)
 	if err := s.client.RemoveObject(ctx, s.bucket, fullKey, minio.RemoveObjectOptions{}); err != nil {
 		return err
 	}
 	return nil
 }
 
-func SetupBlobStorage(log *logrus.Logger) *BlobStorage {
-	endpoint := os.Getenv("S3_ENDPOINT")
+type BlobInfo struct {
+	Key      string
+	Modified time.Time
+}
 
-	if endpoint == "" {
-		log.Fatal("S3_ENDPOINT not set")
+// ListKeys lists objects with given key prefix, bypassing cache.
+func (s *BlobStorage) ListKeys(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	list := []BlobInfo{}
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.prefix + prefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		list = append(list, BlobInfo{
+			Key:      strings.TrimPrefix(obj.Key, s.prefix),
+			Modified: obj.LastModified,
+		})
 	}
+	return list, nil
+}
 
-	accessKey := os.Getenv("S3_ACCESS_KEY")
-	secretKey := os.Getenv("S3_SECRET_KEY")
-	bucket := os.Getenv("S3_BUCKET")
-	token := os.Getenv("S3_TOKEN")
-	useSSL := os.Getenv("S3_USE_SSL") == "true"
-
-	prefix := os.Getenv("S3_PREFIX")
-
-	cache_objects_str := os.Getenv("S3_CACHE_COUNT")
-	cache_objects := 100
-	cache_memory_str := os.Getenv("S3_CACHE_MEMORY")
-	var cache_memory int64 = 5242880
-
-	cache_objects, err := strconv.Atoi(cache_objects_str)
-	if err != nil {
-		log.Fatalf("Failed to config S3 cache objects count: %s", cache_objects_str)
-	}
+// CacheStats reports usage of in-memory cache.
+func (s *BlobStorage) CacheStats() CacheStats {
+	return s.cache.Stats()
+}
 
-	cache_memory, err = strconv.ParseInt(cache_memory_str, 10, 64)
-	if err != nil {
-		log.Fatalf("Failed to config S3 cache size: %s", cache_memory_str)
+// Exists checks S3 directly, bypassing cache.
+func (s *BlobStorage) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.StatObject(ctx, s.bucket, s.prefix+key, minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return false, nil
 	}
+	return err == nil, err
+}
 
-	minioClient, err := minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(accessKey, secretKey, token),
-		Secure: useSSL,
+func SetupBlobStorage(log *logrus.Logger, cfg S3Config) *BlobStorage {
+	minioClient, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, cfg.Token),
+		Secure: cfg.UseSSL,
 	})
 
 	if err != nil {
@@ -135,7 +144,7 @@ func SetupBlobStorage(log *logrus.Logger) *BlobStorage {
 		}).Fatal("Failed to setup blob storage client")
 	}
 
-	ok, err := minioClient.BucketExists(context.Background(), bucket)
+	ok, err := minioClient.BucketExists(context.Background(), cfg.Bucket)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err": err,
@@ -144,7 +153,7 @@ func SetupBlobStorage(log *logrus.Logger) *BlobStorage {
 
 	if !ok {
 		log.Warn("Bucket not exists; Tying to create")
-		err := minioClient.MakeBucket(context.Background(), bucket, minio.MakeBucketOptions{})
+		err := minioClient.MakeBucket(context.Background(), cfg.Bucket, minio.MakeBucketOptions{})
 		if err != nil {
 			log.WithFields(logrus.Fields{
 				"err": err,
@@ -154,8 +163,8 @@ func SetupBlobStorage(log *logrus.Logger) *BlobStorage {
 
 	return &BlobStorage{
 		client: minioClient,
-		bucket: bucket,
-		prefix: prefix,
-		cache:  NewCache(cache_objects, cache_memory, log),
+		bucket: cfg.Bucket,
+		prefix: cfg.Prefix,
+		cache:  NewCache(cfg.CacheCount, cfg.CacheMemory, log),
 	}
 }
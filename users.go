@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const usersPageSize = 50
+
+// Sort orders of admin users list
+var userSorts = []string{"id", "name", "cards"}
+
+// User with number of owned cards, as shown in admin users list
+type UserSummary struct {
+	User  `gorm:"embedded"`
+	Cards int
+}
+
+// Position after the last user of previous page
+type UserCursor struct {
+	ID    uint
+	Name  string `json:",omitempty"`
+	Cards int    `json:",omitempty"`
+}
+
+func (c UserCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func ParseUserCursor(str string) (UserCursor, error) {
+	cursor := UserCursor{}
+	data, err := base64.RawURLEncoding.DecodeString(str)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	return cursor, err
+}
+
+// Admin users list query
+type UserQuery struct {
+	Search   string // Case-insensitive part of name
+	Role     *Role  // nil for any
+	Provider string // Login provider of any linked identity, as returned by Identity.Provider
+	Sort     string // One of userSorts; "id" if empty
+	Desc     bool
+	After    *UserCursor // nil for first page
+	Limit    int
+}
+
+func (q UserQuery) cursor(u UserSummary) UserCursor {
+	cursor := UserCursor{ID: u.ID}
+	switch q.Sort {
+	case "name":
+		cursor.Name = u.Name
+	case "cards":
+		cursor.Cards = u.Cards
+	}
+	return cursor
+}
+
+// Compares users in query sort order, with ID as tie-breaker
+func (q UserQuery) less(a, b UserCursor) bool {
+	if q.Desc {
+		a, b = b, a
+	}
+	switch {
+	case q.Sort == "name" && a.Name != b.Name:
+		return a.Name < b.Name
+	case q.Sort == "cards" && a.Cards != b.Cards:
+		return a.Cards < b.Cards
+	}
+	return a.ID < b.ID
+}
+
+// Reports whether user matches filters of query, not taking cursor into
+// account. Identities are the user's ones.
+func (q UserQuery) Match(u User, identities []Identity) bool {
+	if q.Search != "" && !strings.Contains(strings.ToLower(u.Name), strings.ToLower(q.Search)) {
+		return false
+	}
+	if q.Role != nil && u.Role != *q.Role {
+		return false
+	}
+	if q.Provider == "" {
+		return true
+	}
+	for _, identity := range identities {
+		if identity.Provider() == q.Provider {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds query from params: q, role, provider, sort ("-" prefix for
+// descending) and after cursor
+func parseUserQuery(c *gin.Context) (UserQuery, bool) {
+	q := UserQuery{
+		Search:   strings.TrimSpace(c.Query("q")),
+		Provider: c.Query("provider"),
+		Limit:    usersPageSize,
+	}
+	q.Sort, q.Desc = strings.CutPrefix(c.Query("sort"), "-")
+	if q.Sort == "" {
+		q.Sort = "id"
+	}
+	ok := false
+	for _, sort := range userSorts {
+		ok = ok || q.Sort == sort
+	}
+	if str := c.Query("role"); str != "" {
+		role, err := ParseRole(str)
+		ok = ok && err == nil
+		q.Role = &role
+	}
+	if str := c.Query("after"); str != "" {
+		cursor, err := ParseUserCursor(str)
+		ok = ok && err == nil
+		q.After = &cursor
+	}
+	return q, ok
+}
+
+// Full page or, for HTMX requests, rows of the next page with search
+// results
+func (h *Handler) listUsersRoute(c *gin.Context) {
+	user := getUser(c)
+
+	if !user.Can(PermUsersView, 0) {
+		h.errorPage(c, http.StatusNotFound, "")
+		return
+	}
+
+	// Search and next pages are loaded by HTMX into the table
+	partial := c.GetHeader("HX-Request") == "true"
+	fail := h.errorPage
+	if partial {
+		fail = h.errorBlock
+	}
+
+	query, ok := parseUserQuery(c)
+	if !ok {
+		fail(
+			c,
+			http.StatusBadRequest,
+			h.localize(c, "ErrMsgInvalidUserQuery"),
+		)
+		return
+	}
+	query.Limit++ // One more to know if there is next page
+
+	users, err := h.db.SearchUsers(query)
+
+	if err != nil {
+		h.log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Failed to list users")
+		fail(
+			c,
+			http.StatusInternalServerError,
+			h.localize(c, "ErrMsgFailedToListUsers"),
+		)
+		return
+	}
+
+	next := ""
+	if len(users) > usersPageSize {
+		users = users[:usersPageSize]
+		params := c.Request.URL.Query()
+		params.Set("after", query.cursor(users[len(users)-1]).String())
+		next = "/users?" + params.Encode()
+	}
+
+	roles := []gin.H{}
+	for _, role := range Roles {
+		roles = append(roles, gin.H{
+			"Role":  role,
+			"Title": h.localize(c, "Role"+camelKey(role.String())),
+		})
+	}
+
+	plans := []gin.H{}
+	for _, plan := range Plans {
+		plans = append(plans, gin.H{
+			"ID":    plan.ID,
+			"Title": h.planTitle(c, plan),
+		})
+	}
+
+	sorts := []gin.H{}
+	for _, sort := range userSorts {
+		for _, desc := range []bool{false, true} {
+			value, suffix := sort, ""
+			if desc {
+				value, suffix = "-"+sort, "Desc"
+			}
+			sorts = append(sorts, gin.H{
+				"Value": value,
+				"Title": h.localize(c, fmt.Sprintf("UsersSort%s%s", camelKey(sort), suffix)),
+			})
+		}
+	}
+
+	page := "page_users.html"
+	if partial {
+		page = "comp_userRows.html"
+	}
+
+	h.execHTML(c, http.StatusOK, page, gin.H{
+		"Title":     h.localize(c, "TitleUsers"),
+		"Users":     users,
+		"Next":      next,
+		"Roles":     roles,
+		"Plans":     plans,
+		"Sorts":     sorts,
+		"Providers": h.providers,
+		"Query":     c.Request.URL.Query(),
+	})
+}
@@ -0,0 +1,54 @@
+#!/bin/sh
+# Fetches pinned third-party frontend libraries into ./static so they are
+# served from our own origin (required by Content-Security-Policy).
+#
+# Every file is checked against its checksum in static/vendor.sha256
+# before it is put in place; files without checksum are refused.
+# After bumping a version run `./vendor-static.sh -u` to fetch it and
+# record its checksum, review the diff and commit vendor.sha256.
+set -eu
+
+cd "$(dirname "$0")/static"
+
+update=false
+if [ "${1:-}" = "-u" ]; then
+	update=true
+	touch vendor.sha256
+fi
+
+fetch() {
+	dst="$1"
+	url="$2"
+	if [ -s "$dst" ]; then
+		return
+	fi
+	echo "Fetching $url"
+	curl -fsSL -o "$dst.tmp" "$url"
+	if $update; then
+		grep -v "  $dst\$" vendor.sha256 >vendor.sha256.tmp || true
+		sha256sum "$dst.tmp" | sed "s|  $dst.tmp\$|  $dst|" >>vendor.sha256.tmp
+		mv vendor.sha256.tmp vendor.sha256
+	fi
+	sum=$(grep "  $dst\$" vendor.sha256 2>/dev/null || true)
+	if [ -z "$sum" ]; then
+		rm -f "$dst.tmp"
+		echo "No checksum of $dst in static/vendor.sha256; run with -u to record it" >&2
+		exit 1
+	fi
+	if ! echo "$sum" | sed "s|  $dst\$|  $dst.tmp|" | sha256sum -c >/dev/null 2>&1; then
+		rm -f "$dst.tmp"
+		echo "Checksum mismatch for $dst fetched from $url" >&2
+		exit 1
+	fi
+	mv "$dst.tmp" "$dst"
+}
+
+fetch js/htmx.min.js "https://cdn.jsdelivr.net/npm/htmx.org@2.0.5/dist/htmx.min.js"
+fetch js/response-targets.js "https://unpkg.com/htmx.org@1.9.12/dist/ext/response-targets.js"
+fetch js/qrcode.min.js "https://cdnjs.cloudflare.com/ajax/libs/qrcodejs/1.0.0/qrcode.js"
+fetch js/dom-to-image.min.js "https://cdnjs.cloudflare.com/ajax/libs/dom-to-image/2.6.0/dom-to-image.min.js"
+fetch js/cropper.min.js "https://cdnjs.cloudflare.com/ajax/libs/cropperjs/1.5.13/cropper.min.js"
+fetch css/cropper.min.css "https://cdnjs.cloudflare.com/ajax/libs/cropperjs/1.5.13/cropper.min.css"
+
+# Files fetched earlier are checked too
+sha256sum -c vendor.sha256